@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/Antony8720/url-shortener/internal/backup"
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+)
+
+// backupCommand implements `shortener backup [-out file] [flags]`, which
+// writes a backup of the configured storage to the file or stdout.
+func backupCommand(args []string) error {
+	var out string
+	cfg, _, err := config.LoadCommand(args, func(fs *flag.FlagSet) {
+		fs.StringVar(&out, "out", "", "backup file, stdout if empty")
+	})
+	if err != nil {
+		return err
+	}
+	s, err := storage.New(cfg)
+	if err != nil {
+		return err
+	}
+	if c, ok := s.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	w := io.Writer(os.Stdout)
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	trailer, err := backup.Write(ctx, w, s)
+	if err != nil {
+		if out != "" {
+			os.Remove(out)
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "backed up %d link(s), %d account(s), %d workspace(s) and %d webhook(s), sha256 %s\n", trailer.Count, trailer.Accounts, trailer.Workspaces, trailer.Webhooks, trailer.SHA256)
+	return nil
+}
+
+// restoreCommand implements `shortener restore [-in file] [flags]`, which
+// restores a backup from the file or stdin into the configured storage.
+// The storage must be empty.
+func restoreCommand(args []string) error {
+	var in string
+	var verifyOnly bool
+	cfg, _, err := config.LoadCommand(args, func(fs *flag.FlagSet) {
+		fs.StringVar(&in, "in", "", "backup file, stdin if empty")
+		fs.BoolVar(&verifyOnly, "verify", false, "only check the backup")
+	})
+	if err != nil {
+		return err
+	}
+
+	r, err := openBackup(in)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if verifyOnly {
+		trailer, err := backup.Verify(r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "backup of %d link(s), %d account(s), %d workspace(s) and %d webhook(s) is intact\n", trailer.Count, trailer.Accounts, trailer.Workspaces, trailer.Webhooks)
+		return nil
+	}
+
+	s, err := storage.New(cfg)
+	if err != nil {
+		return err
+	}
+	if c, ok := s.(io.Closer); ok {
+		defer c.Close()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	trailer, err := backup.Restore(ctx, r, s)
+	if errors.Is(err, backup.ErrNotEmpty) {
+		return fmt.Errorf("%w, point the server flags at a new file or database", err)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored %d link(s), %d account(s), %d workspace(s) and %d webhook(s)\n", trailer.Count, trailer.Accounts, trailer.Workspaces, trailer.Webhooks)
+	return nil
+}
+
+// openBackup opens the backup file, or copies stdin to a temporary file
+// because Restore reads the backup twice.
+func openBackup(path string) (*os.File, error) {
+	if path != "" {
+		return os.Open(path)
+	}
+	f, err := os.CreateTemp("", "shortener-restore-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if _, err := io.Copy(f, os.Stdin); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
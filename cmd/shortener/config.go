@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// configCommand implements `shortener config print [flags]`, which dumps the
+// effective configuration with secrets redacted.
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("usage: shortener config print [flags]")
+	}
+	cfg, err := config.Load(args[1:])
+	if err != nil {
+		return err
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	defer enc.Close()
+	return enc.Encode(cfg.Redacted())
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/google/uuid"
+)
+
+const linksUsage = `usage: shortener links <command> [flags] [short URL...]
+
+Commands:
+  list      list links, -user limits them to one user
+  lookup    show the given links
+  delete    delete the given links
+  reassign  move the given links to the user given by -to
+  count     count links and users
+
+Besides -o (table or json) every server flag is accepted, and the storage
+is chosen exactly as by the server. Deletions and reassignments are written
+to the audit log of the server with the request ID "cli".`
+
+// linksCommand implements `shortener links`, which manages the links of the
+// configured storage without a running server.
+func linksCommand(args []string) error {
+	return runLinks(args, os.Stdout)
+}
+
+func runLinks(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(linksUsage)
+	}
+	command := args[0]
+	switch command {
+	case "list", "lookup", "delete", "reassign", "count":
+	default:
+		return fmt.Errorf("unknown command %q\n%s", command, linksUsage)
+	}
+
+	var output, userFlag, toFlag string
+	cfg, shorts, err := config.LoadCommand(args[1:], func(fs *flag.FlagSet) {
+		fs.StringVar(&output, "o", "table", "output format: table or json")
+		if command == "list" {
+			fs.StringVar(&userFlag, "user", "", "list only the links of this user")
+		}
+		if command == "reassign" {
+			fs.StringVar(&toFlag, "to", "", "user receiving the links")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unknown output format %q", output)
+	}
+	s, err := storage.New(cfg)
+	if err != nil {
+		return err
+	}
+	if c, ok := s.(io.Closer); ok {
+		defer c.Close()
+	}
+	p := printer{out: out, json: output == "json"}
+	var auditLog audit.Log
+	if command == "delete" || command == "reassign" {
+		auditLog, err = audit.New(cfg)
+		if err != nil {
+			return fmt.Errorf("audit log: %w", err)
+		}
+		defer auditLog.Close()
+	}
+
+	switch command {
+	case "list":
+		var links []storage.Link
+		if userFlag != "" {
+			userID, err := uuid.Parse(userFlag)
+			if err != nil {
+				return fmt.Errorf("-user: %w", err)
+			}
+			links, err = s.GetUserLinks(userID, storage.LinkFilter{})
+			if err != nil {
+				return err
+			}
+		} else {
+			err = s.EachLink(context.Background(), func(link storage.Link) error {
+				links = append(links, link)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.Before(links[j].CreatedAt) })
+		return p.links(links)
+
+	case "lookup":
+		if len(shorts) == 0 {
+			return errors.New("lookup: no short URLs given")
+		}
+		links := make([]storage.Link, 0, len(shorts))
+		for _, short := range shorts {
+			link, ok := s.GetLink(short)
+			if !ok {
+				return fmt.Errorf("lookup %s: %w", short, storage.ErrNotFound)
+			}
+			links = append(links, link)
+		}
+		return p.links(links)
+
+	case "delete":
+		if len(shorts) == 0 {
+			return errors.New("delete: no short URLs given")
+		}
+		for _, short := range shorts {
+			link, ok := s.GetLink(short)
+			if !ok {
+				return fmt.Errorf("delete %s: %w", short, storage.ErrNotFound)
+			}
+			if err := s.Delete(link.UserID, []string{short}); err != nil {
+				return fmt.Errorf("delete %s: %w", short, err)
+			}
+			if err := recordCLIEvent(auditLog, audit.ActionDelete, link, nil); err != nil {
+				return err
+			}
+		}
+		return p.result("deleted", len(shorts))
+
+	case "reassign":
+		userID, err := uuid.Parse(toFlag)
+		if err != nil {
+			return fmt.Errorf("-to: %w", err)
+		}
+		if len(shorts) == 0 {
+			return errors.New("reassign: no short URLs given")
+		}
+		for _, short := range shorts {
+			before, ok := s.GetLink(short)
+			if !ok {
+				return fmt.Errorf("reassign %s: %w", short, storage.ErrNotFound)
+			}
+			if err := s.SetOwner(short, userID); err != nil {
+				return fmt.Errorf("reassign %s: %w", short, err)
+			}
+			after := before
+			after.UserID = userID
+			if err := recordCLIEvent(auditLog, audit.ActionReassign, before, &after); err != nil {
+				return err
+			}
+		}
+		return p.result("reassigned", len(shorts))
+
+	case "count":
+		urls, err := s.CountURLs()
+		if err != nil {
+			return err
+		}
+		users, err := s.CountUsers()
+		if err != nil {
+			return err
+		}
+		if p.json {
+			return p.encode(map[string]int{"urls": urls, "users": users})
+		}
+		_, err = fmt.Fprintf(out, "urls\t%d\nusers\t%d\n", urls, users)
+		return err
+	}
+	return nil
+}
+
+// recordCLIEvent writes a change made by the links command to the audit
+// log. There is no user behind it, so the actor is the nil UUID.
+func recordCLIEvent(auditLog audit.Log, action audit.Action, before storage.Link, after *storage.Link) error {
+	e := audit.Event{
+		Time:      time.Now().UTC(),
+		RequestID: "cli",
+		Action:    action,
+		Short:     before.Short,
+		Before:    audit.LinkState(before),
+	}
+	if after != nil {
+		e.After = audit.LinkState(*after)
+	}
+	if err := auditLog.Record(e); err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	return nil
+}
+
+// printer writes command results as a table or as JSON.
+type printer struct {
+	out  io.Writer
+	json bool
+}
+
+func (p printer) encode(v any) error {
+	enc := json.NewEncoder(p.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (p printer) links(links []storage.Link) error {
+	if p.json {
+		if links == nil {
+			links = []storage.Link{}
+		}
+		return p.encode(links)
+	}
+	tw := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHORT\tUSER\tCREATED\tEXPIRES\tTAGS\tORIGINAL URL")
+	for _, link := range links {
+		user := "-"
+		if link.UserID != uuid.Nil {
+			user = link.UserID.String()
+		}
+		expires := "-"
+		if !link.ExpiresAt.IsZero() {
+			expires = link.ExpiresAt.Format(time.RFC3339)
+		}
+		tags := "-"
+		if len(link.Tags) > 0 {
+			tags = strings.Join(link.Tags, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", link.Short, user,
+			link.CreatedAt.Format(time.RFC3339), expires, tags, link.Long)
+	}
+	return tw.Flush()
+}
+
+func (p printer) result(action string, n int) error {
+	if p.json {
+		return p.encode(map[string]int{action: n})
+	}
+	_, err := fmt.Fprintf(p.out, "%s %d link(s)\n", action, n)
+	return err
+}
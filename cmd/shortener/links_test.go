@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinksCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.log")
+	fs, err := storage.NewFileStorage(path)
+	require.NoError(t, err)
+	alice, bob := uuid.New(), uuid.New()
+	require.NoError(t, fs.Set(alice, "a1", "https://a.ru/1"))
+	require.NoError(t, fs.Set(alice, "a2", "https://a.ru/2"))
+	require.NoError(t, fs.Set(uuid.Nil, "anon", "https://anon.ru"))
+	require.NoError(t, fs.Close())
+
+	run := func(args ...string) string {
+		var out bytes.Buffer
+		require.NoError(t, runLinks(args, &out))
+		return out.String()
+	}
+
+	assert.Contains(t, run("list", "-f", path), "https://anon.ru")
+	var links []storage.Link
+	require.NoError(t, json.Unmarshal([]byte(run("list", "-f", path, "-o", "json", "-user", alice.String())), &links))
+	assert.Len(t, links, 2)
+
+	assert.Error(t, runLinks([]string{"delete", "-f", path, "a1"}, &bytes.Buffer{}), "changes of a file storage need an audit file")
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	run("reassign", "-f", path, "-audit-file", auditFile, "-to", bob.String(), "a2", "anon")
+	run("delete", "-f", path, "-audit-file", auditFile, "a1")
+	events, err := audit.NewFileLog(auditFile)
+	require.NoError(t, err)
+	defer events.Close()
+	recorded, err := events.Query(context.Background(), audit.Filter{})
+	require.NoError(t, err)
+	assert.Len(t, recorded, 3)
+
+	var counts map[string]int
+	require.NoError(t, json.Unmarshal([]byte(run("count", "-f", path, "-o", "json")), &counts))
+	assert.Equal(t, map[string]int{"urls": 2, "users": 1}, counts)
+
+	require.NoError(t, json.Unmarshal([]byte(run("lookup", "-f", path, "-o", "json", "anon")), &links))
+	require.Len(t, links, 1)
+	assert.Equal(t, bob, links[0].UserID)
+
+	assert.Error(t, runLinks([]string{"lookup", "-f", path, "missing"}, &bytes.Buffer{}))
+	assert.Error(t, runLinks([]string{"frobnicate", "-f", path}, &bytes.Buffer{}))
+}
@@ -1,24 +1,193 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Antony8720/url-shortener/internal/app"
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/certs"
 	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/geoip"
+	"github.com/Antony8720/url-shortener/internal/grpcserver"
 	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/Antony8720/url-shortener/internal/webhook"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+// commands are the subcommands available besides running the server.
+var commands = map[string]func(args []string) error{
+	"backup":          backupCommand,
+	"config":          configCommand,
+	"links":           linksCommand,
+	"migrate-storage": migrateCommand,
+	"restore":         restoreCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	log.Print("url-shortener: Enter main()")
-	cfg := config.New()
-	storage, err := storage.New(cfg)
+	if err := serve(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// shutdownTimeout bounds the wait for requests in flight on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// serve runs the configured servers until one of them fails or the process
+// is interrupted, and then shuts them down before stopping the webhook
+// deliveries and closing the GeoIP database, the audit log and the storage.
+func serve() error {
+	cfg, err := config.New()
+	if err != nil {
+		return err
+	}
+	urlStorage, err := storage.New(cfg)
+	if err != nil {
+		return err
+	}
+	if c, ok := urlStorage.(io.Closer); ok {
+		defer c.Close()
+	}
+	auditLog, err := audit.New(cfg)
+	if err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	defer auditLog.Close()
+	hooks := webhook.NewDispatcher(urlStorage, webhook.Options{})
+	defer hooks.Close()
+	cookieSecret, err := loadCookieSecret(cfg, urlStorage)
+	if err != nil {
+		return fmt.Errorf("cookie secret: %w", err)
+	}
+	user.SetSecret(cookieSecret)
+	limits := app.NewRateLimiters(cfg)
+	var geo geoip.Resolver
+	if cfg.GeoIPDatabase != "" {
+		db, err := geoip.Open(cfg.GeoIPDatabase)
+		if err != nil {
+			log.Printf("GeoIP database is not available, country targeting is disabled: %v", err)
+		} else {
+			defer db.Close()
+			geo = db
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.EnableHTTPS {
+		tlsConfig, err = newTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	errc := make(chan error, 3)
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddress != "" {
+		var opts []grpc.ServerOption
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		lis, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			return err
+		}
+		grpcServer = grpcserver.New(urlStorage, cfg.BaseURL, auditLog, hooks, limits, opts...)
+		go func() { errc <- grpcServer.Serve(lis) }()
+	}
+
+	servers := []*http.Server{{Addr: cfg.Address, Handler: app.MainRouter(urlStorage, cfg, auditLog, hooks, limits, geo)}}
+	if tlsConfig == nil {
+		go func() { errc <- servers[0].ListenAndServe() }()
+	} else {
+		servers[0].TLSConfig = tlsConfig
+		go func() { errc <- servers[0].ListenAndServeTLS("", "") }()
+		if cfg.HTTPRedirectAddress != "" {
+			redirect := &http.Server{Addr: cfg.HTTPRedirectAddress, Handler: app.HTTPSRedirect(cfg.BaseURL)}
+			servers = append(servers, redirect)
+			go func() { errc <- redirect.ListenAndServe() }()
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		log.Print("url-shortener: shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if serr := server.Shutdown(shutdownCtx); serr != nil {
+			log.Printf("url-shortener: shutting down %s: %v", server.Addr, serr)
+		}
+	}
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+	return err
+}
+
+// loadCookieSecret returns the configured cookie secret or, without one, the
+// secret kept by the storage, generated on first start, so that users keep
+// their links across restarts. Only links kept in memory, which are lost on
+// restart anyway, get a key for this process alone.
+func loadCookieSecret(cfg config.Cfg, urlStorage storage.URLStorage) (string, error) {
+	if cfg.CookieSecret != "" {
+		return cfg.CookieSecret, nil
+	}
+	secrets, ok := urlStorage.(storage.SecretStore)
+	if !ok {
+		log.Print("url-shortener: no cookie secret configured, users are forgotten on restart")
+		return "", nil
+	}
+	return secrets.Secret(context.Background(), "cookie-key", user.NewSecret)
+}
+
+// newTLSConfig loads the configured certificate or generates a self-signed
+// one for the host of the base URL.
+func newTLSConfig(cfg config.Cfg) (*tls.Config, error) {
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	var host string
+	if u, err := url.Parse(cfg.BaseURL); err == nil {
+		host = u.Hostname()
+	}
+	cert, err := certs.SelfSigned(host)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, err
 	}
-	baseURL := cfg.BaseURL
-	DBAddress := cfg.DBAddress
-	log.Fatal(http.ListenAndServe(cfg.Address, app.MainRouter(storage, baseURL, DBAddress)))
+	log.Print("url-shortener: serving HTTPS with a self-signed certificate")
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+)
+
+const migrateUsage = `usage: shortener migrate-storage --from <storage> --to <storage> [--dry-run] [-o table|json]
+
+A storage is "memory", "file:<path>" or a postgres:// or postgresql:// DSN.
+Links already present in the target are skipped, so an interrupted
+migration can be run again.`
+
+// migrateCommand implements `shortener migrate-storage`, which copies all
+// links with their owners from one storage backend to another.
+func migrateCommand(args []string) error {
+	return runMigrate(args, os.Stdout)
+}
+
+func runMigrate(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("migrate-storage", flag.ContinueOnError)
+	from := fs.String("from", "", "source storage")
+	to := fs.String("to", "", "target storage")
+	dryRun := fs.Bool("dry-run", false, "report what would be migrated without writing")
+	output := fs.String("o", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return errors.New(migrateUsage)
+	}
+	if *from == *to {
+		return errors.New("source and target are the same storage")
+	}
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	source, err := openStorage(*from)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	if c, ok := source.(io.Closer); ok {
+		defer c.Close()
+	}
+	target, err := openStorage(*to)
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+	if c, ok := target.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := storage.Migrate(ctx, source, target, *dryRun)
+	if *output == "json" {
+		if perr := (printer{out: out, json: true}).encode(report); perr != nil {
+			return perr
+		}
+	} else {
+		printReport(out, report, *dryRun)
+	}
+	return err
+}
+
+// openStorage opens the storage described by spec the way the server opens
+// the configured one.
+func openStorage(spec string) (storage.URLStorage, error) {
+	var cfg config.Cfg
+	switch {
+	case spec == "memory":
+	case strings.HasPrefix(spec, "file:"):
+		cfg.Filepath = strings.TrimPrefix(spec, "file:")
+		if cfg.Filepath == "" {
+			return nil, errors.New("file storage needs a path")
+		}
+	case strings.HasPrefix(spec, "postgres://"), strings.HasPrefix(spec, "postgresql://"):
+		cfg.DBAddress = spec
+	default:
+		return nil, fmt.Errorf("unknown storage %q", spec)
+	}
+	return storage.New(cfg)
+}
+
+func printReport(out io.Writer, report storage.MigrationReport, dryRun bool) {
+	verb := "migrated"
+	if dryRun {
+		verb = "would migrate"
+	}
+	fmt.Fprintf(out, "%s %d link(s), %d account(s), %d workspace(s) and %d webhook(s), skipped %d link(s) already present, %d conflict(s)\n",
+		verb, report.Migrated, report.Accounts, report.Workspaces, report.Webhooks, report.Skipped, len(report.Conflicts))
+	if len(report.Conflicts) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHORT\tORIGINAL URL\tCONFLICT")
+	for _, c := range report.Conflicts {
+		if c.Username != "" {
+			fmt.Fprintf(tw, "account %s\t\t%s\n", c.Username, c.Reason)
+			continue
+		}
+		if c.Workspace != "" {
+			fmt.Fprintf(tw, "workspace %s\t\t%s\n", c.Workspace, c.Reason)
+			continue
+		}
+		if c.Webhook != "" {
+			fmt.Fprintf(tw, "webhook %s\t\t%s\n", c.Webhook, c.Reason)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Short, c.Long, c.Reason)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,221 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// minPasswordLength and maxPasswordLength bound account passwords,
+	// bcrypt ignores everything after 72 bytes.
+	minPasswordLength = 8
+	maxPasswordLength = 72
+	// loginAttemptsPerMinute limits login attempts per username and client
+	// IP, so that guessing from one address does not lock the account out
+	// for everyone else.
+	loginAttemptsPerMinute = 5
+	// registrationsPerMinute limits registrations per client IP, each of
+	// which costs a bcrypt hash.
+	registrationsPerMinute = 5
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,64}$`)
+
+// CredentialsJSON is the body of the registration and login requests.
+type CredentialsJSON struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type AccountJSON struct {
+	Username string `json:"username"`
+}
+
+func (c CredentialsJSON) validate() error {
+	if !usernamePattern.MatchString(c.Username) {
+		return errors.New("username must be 3 to 64 letters, digits, dots, dashes or underscores")
+	}
+	if len(c.Password) < minPasswordLength || len(c.Password) > maxPasswordLength {
+		return errors.New("password must be 8 to 72 bytes long")
+	}
+	return nil
+}
+
+// RegisterUser creates an account for the user of the request, so that its
+// links can be reached again by logging in. A user that already has an
+// account gets a new user for the new account. Registrations are charged to
+// attempts by client IP.
+func RegisterUser(urlStorage storage.URLStorage, attempts *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req CredentialsJSON
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			http.Error(w, "400 "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok, _, wait := attempts.take(1, clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "429 too many attempts", http.StatusTooManyRequests)
+			return
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			http.Error(w, "500 hashing error", http.StatusInternalServerError)
+			return
+		}
+
+		account := storage.Account{Username: req.Username, PasswordHash: hash, UserID: u.UserID, CreatedAt: time.Now()}
+		err = urlStorage.CreateAccount(account)
+		if errors.Is(err, storage.ErrHasAccount) {
+			u = user.New()
+			account.UserID = u.UserID
+			err = urlStorage.CreateAccount(account)
+		}
+		if errors.Is(err, storage.ErrUsernameTaken) {
+			http.Error(w, "409 username is taken", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := setUserCookie(w, u); err != nil {
+			http.Error(w, "500 encoding error", http.StatusInternalServerError)
+			return
+		}
+		b, _ := json.Marshal(AccountJSON{Username: account.Username})
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}
+}
+
+// LoginUser checks the username and password and makes the user of the
+// account the user of the client. The links the client made before logging
+// in are moved to the account, as MergeUserURLs does, unless they belong to
+// another account.
+func LoginUser(urlStorage storage.URLStorage, attempts *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CredentialsJSON
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return
+		}
+		if ok, _, wait := attempts.take(1, req.Username+"|"+clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "429 too many attempts", http.StatusTooManyRequests)
+			return
+		}
+
+		account, ok := urlStorage.GetAccount(req.Username)
+		if !ok || bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(req.Password)) != nil {
+			http.Error(w, "401 invalid username or password", http.StatusUnauthorized)
+			return
+		}
+		if err := adoptAnonymousLinks(r, urlStorage, account.UserID); err != nil {
+			http.Error(w, "500 merge error", http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := setUserCookie(w, user.User{UserID: account.UserID}); err != nil {
+			http.Error(w, "500 encoding error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, AccountJSON{Username: account.Username})
+	}
+}
+
+// adoptAnonymousLinks moves the links of the cookie user of r, if it has no
+// account, to the user of an account it logs into.
+func adoptAnonymousLinks(r *http.Request, urlStorage storage.URLStorage, to uuid.UUID) error {
+	from, ok := cookieUser(r)
+	if !ok || isNewUser(r) || from.UserID == to {
+		return nil
+	}
+	if _, ok := urlStorage.GetUserAccount(from.UserID); ok {
+		return nil
+	}
+	n, err := urlStorage.MergeUsers(from.UserID, to)
+	if err != nil || n == 0 {
+		return err
+	}
+	recordMerge(r, from.UserID, to, n)
+	return nil
+}
+
+// recordMerge audits the move of n links from one user to another.
+func recordMerge(r *http.Request, from, to uuid.UUID, n int) {
+	before, _ := json.Marshal(map[string]any{"user_id": from, "links": n})
+	after, _ := json.Marshal(map[string]any{"user_id": to, "links": n})
+	recordEvent(r, audit.Event{Action: audit.ActionReassign, Before: before, After: after})
+}
+
+// MergeRequestJSON names the user whose links are merged into the current
+// one by the value of its Authorization cookie, which proves the client
+// holds that user.
+type MergeRequestJSON struct {
+	Token string `json:"token"`
+}
+
+type MergeResponseJSON struct {
+	Merged int `json:"merged"`
+}
+
+// MergeUserURLs moves all links of the user given in the request body to
+// the user of the request, e.g. after the client started using a second
+// device. The body carries the other user's Authorization cookie, which is
+// signed, so only its holder can give its links away.
+func MergeUserURLs(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req MergeRequestJSON
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return
+		}
+		var from user.User
+		if err := from.UserDecryptDecodeFromString(req.Token); err != nil {
+			http.Error(w, "400 invalid token", http.StatusBadRequest)
+			return
+		}
+		if from.UserID == u.UserID {
+			http.Error(w, "400 cannot merge a user into itself", http.StatusBadRequest)
+			return
+		}
+
+		n, err := urlStorage.MergeUsers(from.UserID, u.UserID)
+		if err != nil {
+			http.Error(w, "500 merge error", http.StatusInternalServerError)
+			return
+		}
+		if n > 0 {
+			recordMerge(r, from.UserID, u.UserID, n)
+		}
+		writeJSON(w, MergeResponseJSON{Merged: n})
+	}
+}
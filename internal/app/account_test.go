@@ -0,0 +1,201 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidCookieGetsNewUser(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	r := newTestRouter(t, urlStorage, config.Cfg{})
+
+	for _, value := range []string{"garbage", "abcd", ""} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("https://ya.ru/"+value))
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: value})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusCreated, w.Code, value)
+
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		var u user.User
+		require.NoError(t, u.UserDecryptDecodeFromString(cookies[0].Value))
+		assert.NotEqual(t, uuid.Nil, u.UserID)
+		history, err := urlStorage.GetHistory(u.UserID)
+		require.NoError(t, err)
+		assert.Len(t, history, 1, value)
+	}
+}
+
+func TestLegacyCookieIsSigned(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	r := newTestRouter(t, urlStorage, config.Cfg{})
+	userID := uuid.New()
+	require.NoError(t, urlStorage.Set(userID, "abc", "https://a.ru"))
+
+	// cookies of earlier releases are the bare encrypted user ID
+	legacy := userCookie(t, userID)
+	legacy.Value = legacy.Value[:32]
+	req := httptest.NewRequest("GET", "/api/user/urls", nil)
+	req.AddCookie(legacy)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "https://a.ru")
+
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	var u user.User
+	require.NoError(t, u.UserDecryptDecodeFromString(cookies[0].Value))
+	assert.Equal(t, userID, u.UserID)
+}
+
+func TestMergeUserURLs(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	r := newTestRouter(t, urlStorage, config.Cfg{})
+	shorten := func(long string, cookies ...*http.Cookie) *http.Cookie {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(long))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusCreated, w.Code)
+		return w.Result().Cookies()[0]
+	}
+	first := shorten("https://a.ru")
+	shorten("https://b.ru", first)
+	second := shorten("https://c.ru")
+
+	merge := func(token string, c *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/user/merge", strings.NewReader(`{"token":"`+token+`"}`))
+		req.AddCookie(c)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusBadRequest, merge("garbage", second).Code)
+	assert.Equal(t, http.StatusBadRequest, merge(second.Value, second).Code)
+	// the encrypted user ID alone, without the signature, is not enough
+	assert.Equal(t, http.StatusBadRequest, merge(first.Value[:32], second).Code)
+
+	w := merge(first.Value, second)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"merged":2}`, w.Body.String())
+
+	var from, to user.User
+	require.NoError(t, from.UserDecryptDecodeFromString(first.Value))
+	require.NoError(t, to.UserDecryptDecodeFromString(second.Value))
+	history, _ := urlStorage.GetHistory(to.UserID)
+	assert.Len(t, history, 3)
+	history, _ = urlStorage.GetHistory(from.UserID)
+	assert.Empty(t, history)
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	r := newTestRouter(t, urlStorage, config.Cfg{})
+	do := func(method, path, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	authCookie := func(w *httptest.ResponseRecorder) *http.Cookie {
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		return cookies[0]
+	}
+
+	w := do("POST", "/", "https://ya.ru")
+	require.Equal(t, http.StatusCreated, w.Code)
+	anonymous := authCookie(w)
+
+	credentials := `{"username":"alice","password":"correct horse"}`
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/user/register", `{"username":"a","password":"correct horse"}`, anonymous).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/user/register", `{"username":"alice","password":"short"}`, anonymous).Code)
+	w = do("POST", "/api/user/register", credentials, anonymous)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, anonymous.Value, authCookie(w).Value, "registration keeps the user")
+	assert.Equal(t, http.StatusConflict, do("POST", "/api/user/register", credentials).Code)
+
+	w = do("POST", "/api/user/register", `{"username":"alice2","password":"correct horse"}`, anonymous)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.NotEqual(t, anonymous.Value, authCookie(w).Value, "a second account gets a new user")
+
+	assert.Equal(t, http.StatusUnauthorized, do("POST", "/api/user/login", `{"username":"alice","password":"wrong password"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, do("POST", "/api/user/login", `{"username":"bob","password":"correct horse"}`).Code)
+	w = do("POST", "/api/user/login", credentials)
+	require.Equal(t, http.StatusOK, w.Code)
+	session := authCookie(w)
+	assert.Equal(t, anonymous.Value, session.Value)
+
+	w = do("GET", "/api/user/urls", "", session)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "https://ya.ru")
+
+	for range loginAttemptsPerMinute {
+		do("POST", "/api/user/login", `{"username":"alice","password":"wrong password"}`)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, do("POST", "/api/user/login", credentials).Code)
+
+	req := httptest.NewRequest("POST", "/api/user/login", strings.NewReader(credentials))
+	req.RemoteAddr = "192.0.2.2:1234"
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "other clients can still log in")
+}
+
+func TestLoginAdoptsAnonymousLinks(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	r := newTestRouter(t, urlStorage, config.Cfg{})
+	accountID, otherID, anonymousID := uuid.New(), uuid.New(), uuid.New()
+	hash, err := hashPassword("correct horse")
+	require.NoError(t, err)
+	require.NoError(t, urlStorage.CreateAccount(storage.Account{Username: "alice", PasswordHash: hash, UserID: accountID}))
+	require.NoError(t, urlStorage.CreateAccount(storage.Account{Username: "bob", PasswordHash: hash, UserID: otherID}))
+	require.NoError(t, urlStorage.Set(anonymousID, "anon", "https://anon.ru"))
+	require.NoError(t, urlStorage.Set(otherID, "bob", "https://bob.ru"))
+	login := func(c *http.Cookie) {
+		req := httptest.NewRequest("POST", "/api/user/login", strings.NewReader(`{"username":"alice","password":"correct horse"}`))
+		req.AddCookie(c)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	login(userCookie(t, anonymousID))
+	login(userCookie(t, otherID))
+	history, err := urlStorage.GetHistory(accountID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"anon": "https://anon.ru"}, history, "links of another account stay there")
+}
+
+func TestRegisterIsThrottled(t *testing.T) {
+	r := newTestRouter(t, storage.NewDataStorage(), config.Cfg{})
+	register := func(username, remoteAddr string) int {
+		req := httptest.NewRequest("POST", "/api/user/register", strings.NewReader(`{"username":"`+username+`","password":"correct horse"}`))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i := range registrationsPerMinute {
+		require.Equal(t, http.StatusCreated, register(fmt.Sprintf("user%d", i), "192.0.2.1:1234"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, register("late", "192.0.2.1:1234"))
+	assert.Equal(t, http.StatusCreated, register("late", "192.0.2.2:1234"), "other clients can still register")
+}
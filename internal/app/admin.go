@@ -0,0 +1,26 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/backup"
+	"github.com/Antony8720/url-shortener/internal/storage"
+)
+
+// GetBackup streams a compressed point-in-time backup of the storage.
+func GetBackup(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := fmt.Sprintf("shortener-%s.ndjson.gz", time.Now().UTC().Format("20060102T150405Z"))
+		w.Header().Set("content-type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+		w.WriteHeader(http.StatusOK)
+		// Once streaming started, a failure can only cut the body short,
+		// which restore detects by the missing trailer.
+		if _, err := backup.Write(r.Context(), w, urlStorage); err != nil {
+			log.Printf("backup: %v", err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package app
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Antony8720/url-shortener/internal/backup"
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBackup(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	require.NoError(t, urlStorage.Set(uuid.New(), "abc", "https://a.ru"))
+	r := newTestRouter(t, urlStorage, config.Cfg{AdminToken: "s3cret"})
+
+	for _, auth := range []string{"", "Bearer wrong", "s3cret"} {
+		req := httptest.NewRequest("GET", "/api/admin/backup", nil)
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, auth)
+	}
+
+	req := httptest.NewRequest("GET", "/api/admin/backup", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	trailer, err := backup.Verify(bytes.NewReader(w.Body.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, 1, trailer.Count)
+
+	r = newTestRouter(t, urlStorage, config.Cfg{})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/webhook"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+)
+
+const auditLogKey contextKey = "auditLog"
+
+const (
+	defaultAuditLimit = 1000
+	maxAuditLimit     = 10000
+)
+
+// AuditTrail makes handlers record their changes of links in auditLog.
+func AuditTrail(auditLog audit.Log) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), auditLogKey, auditLog)))
+		})
+	}
+}
+
+// recordEvent completes e with the user, request ID and address of the
+// request and writes it to the audit log of the request, if any. Failures
+// are logged, the change has already happened.
+func recordEvent(r *http.Request, e audit.Event) {
+	auditLog, ok := r.Context().Value(auditLogKey).(audit.Log)
+	if !ok {
+		return
+	}
+	u, _ := cookieUser(r)
+	e.Time = time.Now().UTC()
+	e.Actor = u.UserID
+	e.RequestID = middleware.GetReqID(r.Context())
+	e.IP = clientIP(r)
+	if err := auditLog.Record(e); err != nil {
+		log.Printf("audit: recording %s of %q: %v", e.Action, e.Short, err)
+	}
+}
+
+// recordLinkEvent records a change of the link short. before is the state
+// of the link before the change, nil for new links; the state after is
+// read from urlStorage unless the link was deleted. Creations and deletions
+// are also sent to the webhooks of the owner.
+func recordLinkEvent(r *http.Request, urlStorage storage.URLStorage, action audit.Action, short string, before *storage.Link) {
+	e := audit.Event{Action: action, Short: short}
+	if before != nil {
+		e.Before = audit.LinkState(*before)
+	}
+	if action != audit.ActionDelete {
+		if after, ok := urlStorage.GetLink(short); ok {
+			e.After = audit.LinkState(after)
+			if action == audit.ActionCreate {
+				notifyWebhooks(r, webhook.EventCreated, after, "")
+			}
+		}
+	} else if before != nil {
+		notifyWebhooks(r, webhook.EventDeleted, *before, "")
+	}
+	recordEvent(r, e)
+}
+
+// GetAuditLog returns the events of the audit log, oldest first, filtered
+// by the query parameters since and until (RFC 3339), actor, short and
+// limit.
+func GetAuditLog(auditLog audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := audit.Filter{Short: query.Get("short"), Limit: defaultAuditLimit}
+		var err error
+		for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if v := query.Get(param); v != "" {
+				if *t, err = time.Parse(time.RFC3339, v); err != nil {
+					http.Error(w, "400 "+param+" must be an RFC 3339 time", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if v := query.Get("actor"); v != "" {
+			if filter.Actor, err = uuid.Parse(v); err != nil {
+				http.Error(w, "400 invalid actor", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := query.Get("limit"); v != "" {
+			filter.Limit, err = strconv.Atoi(v)
+			if err != nil || filter.Limit < 1 || filter.Limit > maxAuditLimit {
+				http.Error(w, "400 limit must be between 1 and 10000", http.StatusBadRequest)
+				return
+			}
+		}
+
+		events, err := auditLog.Query(r.Context(), filter)
+		if err != nil {
+			http.Error(w, "500 audit log error", http.StatusInternalServerError)
+			return
+		}
+		if events == nil {
+			events = []audit.Event{}
+		}
+		writeJSON(w, events)
+	}
+}
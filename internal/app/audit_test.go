@@ -0,0 +1,110 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/Antony8720/url-shortener/internal/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	auditLog, err := audit.NewFileLog(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	t.Cleanup(func() { auditLog.Close() })
+	urlStorage := storage.NewDataStorage()
+	hooks := webhook.NewDispatcher(urlStorage, webhook.Options{})
+	t.Cleanup(hooks.Close)
+	r := MainRouter(urlStorage, config.Cfg{AdminToken: "s3cret"}, auditLog, hooks, RateLimiters{}, nil)
+	u := user.New()
+	value, err := u.UserEncryptEncodeToString()
+	require.NoError(t, err)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: value})
+		req.Header.Set("X-Real-IP", "203.0.113.7")
+		req.Header.Set("Authorization", "Bearer s3cret")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	start := time.Now().UTC().Add(-time.Second)
+
+	w := do("POST", "/", "https://ya.ru")
+	require.Equal(t, http.StatusCreated, w.Code)
+	short := w.Body.String()[strings.LastIndex(w.Body.String(), "/")+1:]
+	require.Equal(t, http.StatusOK, do("PATCH", "/api/user/urls/"+short, `{"title":"Yandex","password":"secret"}`).Code)
+	require.Equal(t, http.StatusAccepted, do("DELETE", "/api/user/urls", `["`+short+`","missing"]`).Code)
+
+	w = do("GET", "/api/admin/audit?since="+start.Format(time.RFC3339), "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var events []audit.Event
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &events))
+	require.Len(t, events, 3)
+	for i, action := range []audit.Action{audit.ActionCreate, audit.ActionUpdate, audit.ActionDelete} {
+		assert.Equal(t, action, events[i].Action)
+		assert.Equal(t, short, events[i].Short)
+		assert.Equal(t, u.UserID, events[i].Actor)
+		assert.Equal(t, "203.0.113.7", events[i].IP)
+		assert.NotEmpty(t, events[i].RequestID)
+	}
+	assert.Empty(t, events[0].Before)
+	assert.Contains(t, string(events[1].After), `"title":"Yandex"`)
+	assert.NotContains(t, string(events[1].After), "$2a$")
+	assert.Empty(t, events[2].After)
+
+	w = do("GET", "/api/admin/audit?until="+start.Format(time.RFC3339), "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+	assert.Equal(t, http.StatusBadRequest, do("GET", "/api/admin/audit?since=yesterday", "").Code)
+}
+
+func TestAuditWorkspaceMembers(t *testing.T) {
+	auditLog := audit.NewMemoryLog()
+	urlStorage := storage.NewDataStorage()
+	r := MainRouter(urlStorage, config.Cfg{}, auditLog, nil, RateLimiters{}, nil)
+	owner := user.New()
+	value, err := owner.UserEncryptEncodeToString()
+	require.NoError(t, err)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: value})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/api/workspaces", `{"name":"Sales"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var ws storage.Membership
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ws))
+	base := "/api/workspaces/" + ws.ID.String()
+	member := user.New().UserID.String()
+	require.Equal(t, http.StatusOK, do("PUT", base+"/members", `{"user_id":"`+member+`","role":"viewer"}`).Code)
+	require.Equal(t, http.StatusOK, do("PUT", base+"/members", `{"user_id":"`+member+`","role":"editor"}`).Code)
+	require.Equal(t, http.StatusNoContent, do("DELETE", base+"/members/"+member, "").Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/workspaces", `{"name":"`+strings.Repeat("a", maxWorkspaceBody)+`"}`).Code)
+
+	events, err := auditLog.Query(t.Context(), audit.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	for i, action := range []audit.Action{audit.ActionCreate, audit.ActionCreate, audit.ActionUpdate, audit.ActionDelete} {
+		assert.Equal(t, action, events[i].Action)
+		assert.Equal(t, owner.UserID, events[i].Actor)
+	}
+	assert.Contains(t, string(events[0].After), `"role":"owner"`)
+	assert.Contains(t, string(events[2].Before), `"role":"viewer"`)
+	assert.Contains(t, string(events[2].After), `"role":"editor"`)
+	assert.Contains(t, string(events[3].Before), member)
+	assert.Empty(t, events[3].After)
+}
@@ -2,16 +2,24 @@ package app
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
-	"github.com/Antony8720/url-shortener/internal/app/violationerror"
+
 	"github.com/Antony8720/url-shortener/internal/app/helpers"
+	"github.com/Antony8720/url-shortener/internal/app/violationerror"
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/geoip"
+	"github.com/Antony8720/url-shortener/internal/qr"
 	"github.com/Antony8720/url-shortener/internal/storage"
 	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/Antony8720/url-shortener/internal/webhook"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -19,10 +27,56 @@ import (
 
 type RequestJSON struct {
 	URL string `json:"url"`
+	// QR asks for a base64 encoded PNG QR code of the short URL.
+	QR           bool   `json:"qr,omitempty"`
+	Title        string `json:"title,omitempty"`
+	Interstitial bool   `json:"interstitial,omitempty"`
+	RedirectType int    `json:"redirect_type,omitempty"`
+	// QueryPassthrough is "keep", "override" or "append", see storage.LinkOptions.
+	QueryPassthrough string `json:"query_passthrough,omitempty"`
+	PathPassthrough  bool   `json:"path_passthrough,omitempty"`
+	// UTM parameters are added to URL before it is shortened.
+	UTM *storage.UTM `json:"utm,omitempty"`
+	// Password protects the link. Only its hash is stored.
+	Password string `json:"password,omitempty"`
+	// MaxClicks limits the number of visits, zero means unlimited.
+	MaxClicks int `json:"max_clicks,omitempty"`
+}
+
+// UpdateRequestJSON changes the options of a link. Omitted fields are left
+// unchanged.
+type UpdateRequestJSON struct {
+	Title            *string `json:"title"`
+	Interstitial     *bool   `json:"interstitial"`
+	RedirectType     *int    `json:"redirect_type"`
+	QueryPassthrough *string `json:"query_passthrough"`
+	PathPassthrough  *bool   `json:"path_passthrough"`
+	// Password replaces the password of the link, an empty one removes it.
+	Password *string `json:"password"`
+	// MaxClicks replaces the limit of visits and resets the remaining clicks.
+	MaxClicks *int `json:"max_clicks"`
+}
+
+type LinkJSON struct {
+	Short            string            `json:"short_url"`
+	Long             string            `json:"original_url"`
+	CreatedAt        time.Time         `json:"created_at"`
+	Title            string            `json:"title,omitempty"`
+	Interstitial     bool              `json:"interstitial,omitempty"`
+	RedirectType     int               `json:"redirect_type,omitempty"`
+	QueryPassthrough string            `json:"query_passthrough,omitempty"`
+	PathPassthrough  bool              `json:"path_passthrough,omitempty"`
+	Protected        bool              `json:"password_protected,omitempty"`
+	MaxClicks        int               `json:"max_clicks,omitempty"`
+	RemainingClicks  int               `json:"remaining_clicks,omitempty"`
+	Variants         []storage.Variant `json:"variants,omitempty"`
+	Tags             []string          `json:"tags,omitempty"`
+	ExpiresAt        time.Time         `json:"expires_at,omitzero"`
 }
 
 type ResponseJSON struct {
 	Result string `json:"result"`
+	QR     string `json:"qr,omitempty"`
 }
 
 type result struct {
@@ -30,9 +84,15 @@ type result struct {
 	Long  string `json:"original_url"`
 }
 
+type Stats struct {
+	URLs  int `json:"urls"`
+	Users int `json:"users"`
+}
+
 type InputBatch struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
+	CorrelationID string       `json:"correlation_id"`
+	OriginalURL   string       `json:"original_url"`
+	UTM           *storage.UTM `json:"utm,omitempty"`
 }
 
 type OutputBatch struct {
@@ -57,7 +117,8 @@ func SaveLongURL(storage storage.URLStorage, baseURL string) http.HandlerFunc {
 		}
 		u, ok := GetRequestUser(r)
 		if !ok {
-			u = user.User{UserID: uuid.Nil}
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
 		}
 
 		encURL, err := helpers.EncodeURL(u.UserID, longURL, storage)
@@ -75,20 +136,42 @@ func SaveLongURL(storage storage.URLStorage, baseURL string) http.HandlerFunc {
 				w.Write(b)
 			}
 
-		}
-
-		var fullEncURL string
-		if baseURL == "" {
-			fullEncURL = fmt.Sprintf("http://%s/%s", r.Host, encURL)
 		} else {
-			fullEncURL = fmt.Sprintf("%s/%s", baseURL, encURL)
+			recordLinkEvent(r, storage, audit.ActionCreate, encURL, nil)
 		}
 
+		fullEncURL := fullShortURL(r, baseURL, encURL)
+
 		writeBody([]byte(fullEncURL))
 	}
 }
 
-func SaveJSONLongURL(storage storage.URLStorage, baseURL string) http.HandlerFunc {
+func (req RequestJSON) options() (storage.LinkOptions, error) {
+	var utm storage.UTM
+	if req.UTM != nil {
+		utm = *req.UTM
+	}
+	var passwordHash string
+	if req.Password != "" {
+		var err error
+		passwordHash, err = hashPassword(req.Password)
+		if err != nil {
+			return storage.LinkOptions{}, err
+		}
+	}
+	return storage.LinkOptions{
+		PasswordHash:     passwordHash,
+		UTM:              utm,
+		Title:            req.Title,
+		Interstitial:     req.Interstitial,
+		RedirectType:     req.RedirectType,
+		QueryPassthrough: req.QueryPassthrough,
+		PathPassthrough:  req.PathPassthrough,
+		MaxClicks:        req.MaxClicks,
+	}, nil
+}
+
+func SaveJSONLongURL(urlStorage storage.URLStorage, baseURL string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		req := RequestJSON{}
 		b, err := io.ReadAll(r.Body)
@@ -102,10 +185,42 @@ func SaveJSONLongURL(storage storage.URLStorage, baseURL string) http.HandlerFun
 			http.Error(w, "400 page not found", http.StatusBadRequest)
 			return
 		}
+		if !validRedirectType(req.RedirectType) {
+			http.Error(w, "400 unsupported redirect type", http.StatusBadRequest)
+			return
+		}
+		if !validQueryPassthrough(req.QueryPassthrough) {
+			http.Error(w, "400 unsupported query passthrough", http.StatusBadRequest)
+			return
+		}
+		if req.MaxClicks < 0 {
+			http.Error(w, "400 max_clicks must not be negative", http.StatusBadRequest)
+			return
+		}
+		if len(req.Password) > maxPasswordLength {
+			http.Error(w, "400 password must be at most 72 bytes long", http.StatusBadRequest)
+			return
+		}
+		if req.UTM != nil {
+			req.URL, err = helpers.ApplyUTM(req.URL, *req.UTM)
+			if err != nil {
+				http.Error(w, "400 "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 
 		u, ok := GetRequestUser(r)
 		if !ok {
-			u = user.User{UserID: uuid.Nil}
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// The options are ready before the link exists, so that a failure
+		// cannot leave an unprotected link behind.
+		opts, err := req.options()
+		if err != nil {
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
 		}
 
 		var writeBody = func(b []byte) {
@@ -114,7 +229,7 @@ func SaveJSONLongURL(storage storage.URLStorage, baseURL string) http.HandlerFun
 			w.Write(b)
 		}
 
-		encURL, err := helpers.EncodeURL(u.UserID, req.URL, storage)
+		encURL, err := helpers.EncodeURL(u.UserID, req.URL, urlStorage)
 		if err != nil {
 			var uve *violationerror.UniqueViolationError
 
@@ -122,6 +237,12 @@ func SaveJSONLongURL(storage storage.URLStorage, baseURL string) http.HandlerFun
 				http.Error(w, "400 page not found", http.StatusBadRequest)
 				return
 			}
+			// The existing link lacks the protection asked for, handing it
+			// out would silently drop it.
+			if opts.PasswordHash != "" || opts.MaxClicks > 0 {
+				http.Error(w, "409 url is already shortened without password or max_clicks", http.StatusConflict)
+				return
+			}
 
 			writeBody = func(b []byte) {
 				w.Header().Set("content-type", "application/json")
@@ -129,16 +250,28 @@ func SaveJSONLongURL(storage storage.URLStorage, baseURL string) http.HandlerFun
 				w.Write(b)
 			}
 
-		}
-
-		var fullEncURL string
-		if baseURL == "" {
-			fullEncURL = fmt.Sprintf("http://%s/%s", r.Host, encURL)
 		} else {
-			fullEncURL = fmt.Sprintf("%s/%s", baseURL, encURL)
+			if opts != (storage.LinkOptions{}) {
+				if err := urlStorage.SetOptions(u.UserID, encURL, opts); err != nil {
+					urlStorage.Delete(u.UserID, []string{encURL})
+					http.Error(w, "500 internal server error", http.StatusInternalServerError)
+					return
+				}
+			}
+			recordLinkEvent(r, urlStorage, audit.ActionCreate, encURL, nil)
 		}
 
+		fullEncURL := fullShortURL(r, baseURL, encURL)
+
 		resp := ResponseJSON{Result: fullEncURL}
+		if req.QR {
+			png, err := qr.PNG(fullEncURL, qr.DefaultOptions())
+			if err != nil {
+				http.Error(w, "500 QR code error", http.StatusInternalServerError)
+				return
+			}
+			resp.QR = base64.StdEncoding.EncodeToString(png)
+		}
 		respBody, err := json.Marshal(resp)
 		if err != nil {
 			http.Error(w, "400 page not found", http.StatusBadRequest)
@@ -149,43 +282,312 @@ func SaveJSONLongURL(storage storage.URLStorage, baseURL string) http.HandlerFun
 	}
 }
 
-func RedirectToOriginalURL(storage storage.URLStorage) http.HandlerFunc {
+// RedirectToOriginalURL redirects to the destination of a link, with
+// defaultStatus unless the link has a redirect type. A "+" suffix,
+// ?preview=1 or the interstitial option render a preview page instead.
+// Every visit except previews is counted by helpers.Visit.
+func RedirectToOriginalURL(urlStorage storage.URLStorage, defaultStatus int, guard *LinkGuard, geo geoip.Resolver) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		urlPart := chi.URLParam(r, "url")
-		originalURL, ok := helpers.DecodeURL(urlPart, storage)
+		query := r.URL.Query()
+		preview := strings.HasSuffix(urlPart, "+") || query.Get("preview") == "1"
+		query.Del("preview")
+		link, ok := urlStorage.GetLink(strings.TrimSuffix(urlPart, "+"))
 		if !ok {
 			http.Error(w, "400 page not found", http.StatusBadRequest)
 			return
 		}
+		if link.Expired(time.Now()) {
+			http.Error(w, "410 link has expired", http.StatusGone)
+			return
+		}
+		if link.PasswordHash != "" && !guard.hasAccess(r, link.Short) {
+			writePasswordForm(w, r, link, false)
+			return
+		}
 
-		w.Header().Set("content-type", "text/plain; charset=utf-8")
-		w.Header().Set("Location", originalURL)
-		w.WriteHeader(http.StatusTemporaryRedirect)
+		extraPath := chi.URLParam(r, "*")
+		if extraPath != "" && !link.PathPassthrough {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		var variant string
+		if dest, ok := targetDestination(link, r, geo); ok {
+			link.Long = dest
+		} else if len(link.Variants) > 0 {
+			v := chooseVariant(w, r, link)
+			link.Long, variant = v.Destination, v.Name
+		}
+		var err error
+		link.Long, err = passthroughURL(link, query, extraPath)
+		if err != nil {
+			http.Error(w, "500 invalid destination", http.StatusInternalServerError)
+			return
+		}
+
+		// Previews show the destination without using up a click.
+		if link.MaxClicks > 0 && preview && link.RemainingClicks <= 0 {
+			http.Error(w, "410 link is no longer available", http.StatusGone)
+			return
+		}
+		if !preview {
+			err := helpers.Visit(urlStorage, link, variant)
+			switch {
+			case errors.Is(err, helpers.ErrExpired):
+				http.Error(w, "410 link has expired", http.StatusGone)
+				return
+			case errors.Is(err, storage.ErrExhausted):
+				http.Error(w, "410 link is no longer available", http.StatusGone)
+				return
+			case err != nil:
+				http.Error(w, "500 internal server error", http.StatusInternalServerError)
+				return
+			}
+			notifyWebhooks(r, webhook.EventClicked, link, variant)
+		}
+
+		if preview || link.Interstitial {
+			writePreview(w, link)
+			return
+		}
+
+		code := link.RedirectType
+		if code == 0 {
+			code = defaultStatus
+		}
+		writeRedirect(w, link, code)
 	}
 }
 
-func GetRequestUser(r *http.Request) (u user.User, ok bool) {
-	ck, err := r.Cookie("Authorization")
-	if err != nil {
-		return user.User{}, false
+func UpdateUserURL(urlStorage storage.URLStorage, baseURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req UpdateRequestJSON
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return
+		}
+
+		link, ok := urlStorage.GetLink(chi.URLParam(r, "url"))
+		if !ok || link.UserID != u.UserID {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		before := link
+		if req.Title != nil {
+			link.Title = *req.Title
+		}
+		if req.Interstitial != nil {
+			link.Interstitial = *req.Interstitial
+		}
+		if req.RedirectType != nil {
+			if !validRedirectType(*req.RedirectType) {
+				http.Error(w, "400 unsupported redirect type", http.StatusBadRequest)
+				return
+			}
+			link.RedirectType = *req.RedirectType
+		}
+		if req.QueryPassthrough != nil {
+			if !validQueryPassthrough(*req.QueryPassthrough) {
+				http.Error(w, "400 unsupported query passthrough", http.StatusBadRequest)
+				return
+			}
+			link.QueryPassthrough = *req.QueryPassthrough
+		}
+		if req.PathPassthrough != nil {
+			link.PathPassthrough = *req.PathPassthrough
+		}
+		if req.MaxClicks != nil {
+			if *req.MaxClicks < 0 {
+				http.Error(w, "400 max_clicks must not be negative", http.StatusBadRequest)
+				return
+			}
+			link.MaxClicks = *req.MaxClicks
+		}
+		if req.Password != nil {
+			if len(*req.Password) > maxPasswordLength {
+				http.Error(w, "400 password must be at most 72 bytes long", http.StatusBadRequest)
+				return
+			}
+			link.PasswordHash = ""
+			if *req.Password != "" {
+				var err error
+				link.PasswordHash, err = hashPassword(*req.Password)
+				if err != nil {
+					http.Error(w, "500 internal server error", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		err := urlStorage.SetOptions(u.UserID, link.Short, link.LinkOptions)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		recordLinkEvent(r, urlStorage, audit.ActionUpdate, link.Short, &before)
+
+		b, err := json.Marshal(newLinkJSON(r, baseURL, link))
+		if err != nil {
+			http.Error(w, "500 marshalling error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func newLinkJSON(r *http.Request, baseURL string, link storage.Link) LinkJSON {
+	return LinkJSON{
+		Short:            fullShortURL(r, baseURL, link.Short),
+		Long:             link.Long,
+		CreatedAt:        link.CreatedAt,
+		Title:            link.Title,
+		Interstitial:     link.Interstitial,
+		RedirectType:     link.RedirectType,
+		QueryPassthrough: link.QueryPassthrough,
+		PathPassthrough:  link.PathPassthrough,
+		Protected:        link.PasswordHash != "",
+		MaxClicks:        link.MaxClicks,
+		RemainingClicks:  link.RemainingClicks,
+		Variants:         link.Variants,
+		Tags:             link.Tags,
+		ExpiresAt:        link.ExpiresAt,
+	}
+}
+
+// validRedirectType reports whether code may be stored as the redirect
+// type of a link. Zero stands for the server default.
+func validRedirectType(code int) bool {
+	switch code {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
 	}
+	return false
+}
 
-	err = u.UserDecryptDecodeFromString(ck.Value)
-	if err != nil {
-		return user.User{}, false
+// permanentRedirectMaxAge is how long clients may cache permanent redirects.
+const permanentRedirectMaxAge = 24 * time.Hour
+
+// writeRedirect answers with a redirect to the destination link.Long.
+// Permanent redirects may be cached, temporary ones must reach the server on
+// every visit. Redirects of password protected links are never stored, a
+// shared cache would hand the destination to visitors without the password,
+// and neither are those of links with a limited number of clicks, which
+// must all be counted. The destination of links with targeting rules or
+// variants depends on the visitor, only the visitor's browser may keep it.
+func writeRedirect(w http.ResponseWriter, link storage.Link, code int) {
+	permanent := code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect
+	switch {
+	case link.PasswordHash != "", link.MaxClicks > 0:
+		w.Header().Set("Cache-Control", "private, no-store")
+	case permanent && (len(link.Rules) > 0 || len(link.Variants) > 0):
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(permanentRedirectMaxAge.Seconds())))
+		w.Header().Set("Vary", "User-Agent, Accept-Language")
+	case permanent:
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(permanentRedirectMaxAge.Seconds())))
+	default:
+		w.Header().Set("Cache-Control", "private, no-cache")
 	}
+	w.Header().Set("content-type", "text/plain; charset=utf-8")
+	w.Header().Set("Location", link.Long)
+	w.WriteHeader(code)
+}
 
-	return u, true
+// fullShortURL prefixes the short identifier with the base URL, or with the
+// host of the request when no base URL is configured.
+func fullShortURL(r *http.Request, baseURL, short string) string {
+	if baseURL == "" {
+		return fmt.Sprintf("http://%s/%s", r.Host, short)
+	}
+	return fmt.Sprintf("%s/%s", baseURL, short)
 }
 
-func GetUserURLs(storage storage.URLStorage, baseURL string) http.HandlerFunc {
+func GetQRCode(storage storage.URLStorage, baseURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		urlPart := chi.URLParam(r, "url")
+		if _, ok := helpers.DecodeURL(urlPart, storage); !ok {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+
+		opts := qr.DefaultOptions()
+		q := r.URL.Query()
+		var err error
+		if v := q.Get("size"); v != "" {
+			opts.Size, err = strconv.Atoi(v)
+			if err != nil || opts.Size < 32 || opts.Size > 2048 {
+				http.Error(w, "400 size must be between 32 and 2048", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("margin"); v != "" {
+			opts.Margin, err = strconv.Atoi(v)
+			if err != nil || opts.Margin < 0 || opts.Margin > 16 {
+				http.Error(w, "400 margin must be between 0 and 16", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("level"); v != "" {
+			opts.Level = v
+		}
+
+		fullEncURL := fullShortURL(r, baseURL, urlPart)
+		var b []byte
+		switch q.Get("format") {
+		case "", qr.FormatPNG:
+			b, err = qr.PNG(fullEncURL, opts)
+			w.Header().Set("content-type", "image/png")
+		case qr.FormatSVG:
+			b, err = qr.SVG(fullEncURL, opts)
+			w.Header().Set("content-type", "image/svg+xml")
+		default:
+			http.Error(w, "400 unknown format", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			w.Header().Del("content-type")
+			http.Error(w, "400 "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+// GetRequestUser returns the user the request acts as: the workspace on
+// workspace routes, otherwise the user of the Authorization cookie.
+func GetRequestUser(r *http.Request) (u user.User, ok bool) {
+	if id := requestWorkspace(r); id != uuid.Nil {
+		return user.User{UserID: id}, true
+	}
+	return cookieUser(r)
+}
+
+// GetUserURLs lists the links of the user, optionally only those of the
+// UTM campaign given by the campaign query parameter.
+func GetUserURLs(urlStorage storage.URLStorage, baseURL string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		u, ok := GetRequestUser(r)
 		if !ok {
-			u = user.User{UserID: uuid.Nil}
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
 		}
 
-		all, err := storage.GetHistory(u.UserID)
+		filter := storage.LinkFilter{Campaign: r.URL.Query().Get("campaign")}
+		all, err := urlStorage.GetUserLinks(u.UserID, filter)
 		if err != nil {
 			http.Error(w, "400 page not found", http.StatusBadRequest)
 			return
@@ -198,10 +600,10 @@ func GetUserURLs(storage storage.URLStorage, baseURL string) http.HandlerFunc {
 			return
 		}
 		var res []result
-		for short, long := range all {
+		for _, link := range all {
 			res = append(res, result{
-				Short: fmt.Sprintf("%s/%s", baseURL, short),
-				Long:  long,
+				Short: fmt.Sprintf("%s/%s", baseURL, link.Short),
+				Long:  link.Long,
 			})
 		}
 
@@ -217,6 +619,63 @@ func GetUserURLs(storage storage.URLStorage, baseURL string) http.HandlerFunc {
 	}
 }
 
+func DeleteUserURLs(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var shorts []string
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&shorts); err != nil {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return
+		}
+
+		var deleted []storage.Link
+		for _, short := range shorts {
+			if link, ok := urlStorage.GetLink(short); ok && link.UserID == u.UserID {
+				deleted = append(deleted, link)
+			}
+		}
+		if err := urlStorage.Delete(u.UserID, shorts); err != nil {
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		for _, link := range deleted {
+			recordLinkEvent(r, urlStorage, audit.ActionDelete, link.Short, &link)
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func GetStats(storage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		urls, err := storage.CountURLs()
+		if err != nil {
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		users, err := storage.CountUsers()
+		if err != nil {
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(Stats{URLs: urls, Users: users})
+		if err != nil {
+			http.Error(w, "500 marshalling error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
 func Ping(DBAddress string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		pgxConfig, err := pgxpool.ParseConfig(DBAddress)
@@ -244,11 +703,12 @@ func Ping(DBAddress string) http.HandlerFunc {
 	}
 }
 
-func SaveBatch(storage storage.URLStorage, baseURL string) http.HandlerFunc {
+func SaveBatch(urlStorage storage.URLStorage, baseURL string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		u, ok := GetRequestUser(r)
 		if !ok {
-			u = user.User{UserID: uuid.Nil}
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
 		}
 
 		b, err := io.ReadAll(r.Body)
@@ -265,24 +725,38 @@ func SaveBatch(storage storage.URLStorage, baseURL string) http.HandlerFunc {
 			return
 		}
 
+		for i, batch := range ib {
+			if batch.UTM == nil {
+				continue
+			}
+			ib[i].OriginalURL, err = helpers.ApplyUTM(batch.OriginalURL, *batch.UTM)
+			if err != nil {
+				http.Error(w, "400 "+batch.CorrelationID+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
 		bo := make([]OutputBatch, 0, len(ib))
-		var fullEncURL string
 		for _, batch := range ib {
-			encURL, err := helpers.EncodeURL(u.UserID, batch.OriginalURL, storage)
+			encURL, err := helpers.EncodeURL(u.UserID, batch.OriginalURL, urlStorage)
 			if err != nil {
 				http.Error(w, "400 page not found", http.StatusBadRequest)
 				return
 			}
-			if baseURL == "" {
-				fullEncURL = fmt.Sprintf("http://%s/%s", r.Host, encURL)
-			} else {
-				fullEncURL = fmt.Sprintf("%s/%s", baseURL, encURL)
+			if batch.UTM != nil {
+				err = urlStorage.SetOptions(u.UserID, encURL, storage.LinkOptions{UTM: *batch.UTM})
+				if err != nil {
+					urlStorage.Delete(u.UserID, []string{encURL})
+					http.Error(w, "500 internal server error", http.StatusInternalServerError)
+					return
+				}
 			}
+			recordLinkEvent(r, urlStorage, audit.ActionCreate, encURL, nil)
+			fullEncURL := fullShortURL(r, baseURL, encURL)
 			bo = append(bo, OutputBatch{
 				CorrelationID: batch.CorrelationID,
 				ShortURL:      fullEncURL,
 			})
-			fmt.Print(batch)
 		}
 
 		result, err := json.MarshalIndent(bo, "", " ")
@@ -7,9 +7,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/config"
 	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/Antony8720/url-shortener/internal/webhook"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -31,10 +38,18 @@ func testRequest(t *testing.T, ts *httptest.Server, method, path string, body io
 	defer resp.Body.Close()
 	return resp.StatusCode, string(respBody)
 }
+
+// newTestRouter returns MainRouter with an audit log in memory and a
+// webhook dispatcher closed at the end of the test.
+func newTestRouter(t *testing.T, urlStorage storage.URLStorage, cfg config.Cfg) chi.Router {
+	hooks := webhook.NewDispatcher(urlStorage, webhook.Options{})
+	t.Cleanup(hooks.Close)
+	return MainRouter(urlStorage, cfg, audit.NewMemoryLog(), hooks, NewRateLimiters(cfg), nil)
+}
+
 func TestSaveLongURL(t *testing.T) {
 	storage := storage.NewDataStorage()
-	baseURL := ""
-	r := MainRouter(storage, baseURL, "")
+	r := newTestRouter(t, storage, config.Cfg{})
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 	statusCode, _ := testRequest(t, ts, "POST", "/", strings.NewReader("https://ya.ru"), true)
@@ -43,8 +58,7 @@ func TestSaveLongURL(t *testing.T) {
 
 func TestRedirectToOriginalURL(t *testing.T) {
 	storage := storage.NewDataStorage()
-	baseURL := ""
-	r := MainRouter(storage, baseURL, "")
+	r := newTestRouter(t, storage, config.Cfg{})
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 	statusCode, body := testRequest(t, ts, "POST", "/", strings.NewReader("https://ya.ru"), true)
@@ -55,8 +69,7 @@ func TestRedirectToOriginalURL(t *testing.T) {
 
 func TestSaveJSONLongURL(t *testing.T) {
 	storage := storage.NewDataStorage()
-	baseURL := ""
-	r := MainRouter(storage, baseURL, "")
+	r := newTestRouter(t, storage, config.Cfg{})
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 	statusCode, body := testRequest(t, ts, "POST", "/api/shorten", strings.NewReader(fmt.Sprintf("{\"%s\":\"%s\"}", "url", "https://ya.ru")), true)
@@ -65,3 +78,371 @@ func TestSaveJSONLongURL(t *testing.T) {
 	err := json.Unmarshal([]byte(body), &resp)
 	require.NoError(t, err)
 }
+
+func TestDeleteUserURLs(t *testing.T) {
+	storage := storage.NewDataStorage()
+	r := newTestRouter(t, storage, config.Cfg{})
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader("https://ya.ru"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+	cookies := w.Result().Cookies()
+	short := w.Body.String()[strings.LastIndex(w.Body.String(), "/")+1:]
+
+	req = httptest.NewRequest("DELETE", "/api/user/urls", strings.NewReader(fmt.Sprintf("[%q]", short)))
+	for _, ck := range cookies {
+		req.AddCookie(ck)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	_, ok := storage.Get(short)
+	assert.False(t, ok)
+}
+
+func TestGetStats(t *testing.T) {
+	storage := storage.NewDataStorage()
+	r := newTestRouter(t, storage, config.Cfg{TrustedSubnet: "192.168.1.0/24"})
+	for _, long := range []string{"https://a.ru", "https://b.ru"} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(long))
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req := httptest.NewRequest("GET", "/api/internal/stats", nil)
+	req.Header.Set("X-Real-IP", "192.168.1.10")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var stats Stats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, Stats{URLs: 2, Users: 2}, stats)
+
+	req = httptest.NewRequest("GET", "/api/internal/stats", nil)
+	req.Header.Set("X-Real-IP", "10.0.0.1")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestGetQRCode(t *testing.T) {
+	storage := storage.NewDataStorage()
+	r := newTestRouter(t, storage, config.Cfg{})
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	statusCode, body := testRequest(t, ts, "POST", "/api/shorten", strings.NewReader(`{"url":"https://ya.ru","qr":true}`), true)
+	require.Equal(t, http.StatusCreated, statusCode)
+	resp := ResponseJSON{}
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	assert.NotEmpty(t, resp.QR)
+
+	statusCode, body = testRequest(t, ts, "GET", resp.Result+"/qr?size=128&level=H", nil, false)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.True(t, strings.HasPrefix(body, "\x89PNG"))
+
+	statusCode, body = testRequest(t, ts, "GET", resp.Result+"/qr?format=svg&margin=0", nil, false)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.True(t, strings.HasPrefix(body, "<svg"))
+
+	statusCode, _ = testRequest(t, ts, "GET", resp.Result+"/qr?level=X", nil, false)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestPreviewAndInterstitial(t *testing.T) {
+	storage := storage.NewDataStorage()
+	r := newTestRouter(t, storage, config.Cfg{})
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	statusCode, body := testRequest(t, ts, "POST", "/api/shorten", strings.NewReader(`{"url":"https://ya.ru","title":"Yandex"}`), true)
+	require.Equal(t, http.StatusCreated, statusCode)
+	resp := ResponseJSON{}
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+
+	statusCode, _ = testRequest(t, ts, "GET", resp.Result, nil, false)
+	assert.Equal(t, http.StatusTemporaryRedirect, statusCode)
+
+	statusCode, body = testRequest(t, ts, "GET", resp.Result+"+", nil, false)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, "Yandex")
+	assert.Contains(t, body, "https://ya.ru")
+
+	short := resp.Result[strings.LastIndex(resp.Result, "/")+1:]
+	link, _ := storage.GetLink(short)
+	req := httptest.NewRequest("PATCH", "/api/user/urls/"+short, strings.NewReader(`{"interstitial":true}`))
+	req.AddCookie(userCookie(t, link.UserID))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"title":"Yandex"`)
+
+	statusCode, body = testRequest(t, ts, "GET", resp.Result, nil, false)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, "Continue to the destination")
+
+	req = httptest.NewRequest("PATCH", "/api/user/urls/"+short, strings.NewReader(`{"interstitial":false}`))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func userCookie(t *testing.T, userID uuid.UUID) *http.Cookie {
+	u := user.User{UserID: userID}
+	enu, err := u.UserEncryptEncodeToString()
+	require.NoError(t, err)
+	return &http.Cookie{Name: "Authorization", Value: enu}
+}
+
+func TestRedirectType(t *testing.T) {
+	storage := storage.NewDataStorage()
+	r := newTestRouter(t, storage, config.Cfg{RedirectStatus: http.StatusFound})
+	shorten := func(body string) (int, string) {
+		req := httptest.NewRequest("POST", "/api/shorten", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		resp := ResponseJSON{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Result[strings.LastIndex(resp.Result, "/")+1:]
+	}
+	redirect := func(short string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/"+short, nil))
+		return w
+	}
+
+	code, _ := shorten(`{"url":"https://a.ru","redirect_type":200}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, short := shorten(`{"url":"https://a.ru","redirect_type":301}`)
+	require.Equal(t, http.StatusCreated, code)
+	w := redirect(short)
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Contains(t, w.Header().Get("Cache-Control"), "max-age")
+
+	_, short = shorten(`{"url":"https://b.ru"}`)
+	w = redirect(short)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"))
+
+	link, _ := storage.GetLink(short)
+	req := httptest.NewRequest("PATCH", "/api/user/urls/"+short, strings.NewReader(`{"redirect_type":308}`))
+	req.AddCookie(userCookie(t, link.UserID))
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, http.StatusPermanentRedirect, redirect(short).Code)
+}
+
+func TestPassthrough(t *testing.T) {
+	storage := storage.NewDataStorage()
+	r := newTestRouter(t, storage, config.Cfg{})
+	userID := uuid.New()
+	require.NoError(t, storage.Set(userID, "keep", "https://a.ru/docs?utm_source=site"))
+	require.NoError(t, storage.SetOptions(userID, "keep", storageOptions(`{"query_passthrough":"keep","path_passthrough":true}`)))
+	require.NoError(t, storage.Set(userID, "over", "https://b.ru/?utm_source=site"))
+	require.NoError(t, storage.SetOptions(userID, "over", storageOptions(`{"query_passthrough":"override"}`)))
+	require.NoError(t, storage.Set(userID, "none", "https://c.ru/"))
+
+	tests := []struct {
+		path     string
+		code     int
+		location string
+	}{
+		{"/keep?utm_source=x&utm_medium=mail", http.StatusTemporaryRedirect, "https://a.ru/docs?utm_medium=mail&utm_source=site"},
+		{"/keep/extra/path?a=1", http.StatusTemporaryRedirect, "https://a.ru/docs/extra/path?a=1&utm_source=site"},
+		{"/over?utm_source=x", http.StatusTemporaryRedirect, "https://b.ru/?utm_source=x"},
+		{"/over/extra", http.StatusNotFound, ""},
+		{"/none?utm_source=x", http.StatusTemporaryRedirect, "https://c.ru/"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		assert.Equal(t, tt.code, w.Code, tt.path)
+		assert.Equal(t, tt.location, w.Header().Get("Location"), tt.path)
+	}
+}
+
+func storageOptions(body string) storage.LinkOptions {
+	var req RequestJSON
+	json.Unmarshal([]byte(body), &req)
+	opts, _ := req.options()
+	return opts
+}
+
+func TestUTM(t *testing.T) {
+	storage := storage.NewDataStorage()
+	r := newTestRouter(t, storage, config.Cfg{})
+	ck := userCookie(t, uuid.New())
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.AddCookie(ck)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("/api/shorten", `{"url":"https://a.ru/?x=1","utm":{"medium":"email"}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = post("/api/shorten", `{"url":"https://a.ru/?x=1","utm":{"source":"news","medium":"email","campaign":"spring"}}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	resp := ResponseJSON{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	long, ok := storage.Get(resp.Result[strings.LastIndex(resp.Result, "/")+1:])
+	require.True(t, ok)
+	assert.Equal(t, "https://a.ru/?utm_campaign=spring&utm_medium=email&utm_source=news&x=1", long)
+
+	w = post("/api/shorten/batch", `[{"correlation_id":"1","original_url":"https://b.ru","utm":{"source":"ads","campaign":"autumn"}},{"correlation_id":"2","original_url":"https://c.ru"}]`)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	list := func(query string) []result {
+		req := httptest.NewRequest("GET", "/api/user/urls"+query, nil)
+		req.AddCookie(ck)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var res []result
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return res
+	}
+	assert.Len(t, list(""), 3)
+	autumn := list("?campaign=autumn")
+	require.Len(t, autumn, 1)
+	assert.Equal(t, "https://b.ru?utm_campaign=autumn&utm_source=ads", autumn[0].Long)
+}
+
+func TestPasswordProtectedURL(t *testing.T) {
+	storage := storage.NewDataStorage()
+	r := newTestRouter(t, storage, config.Cfg{})
+	req := httptest.NewRequest("POST", "/api/shorten", strings.NewReader(`{"url":"https://secret.ru","password":"s3cret"}`))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+	resp := ResponseJSON{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	path := resp.Result[strings.LastIndex(resp.Result, "/"):]
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotContains(t, w.Body.String(), "secret.ru")
+
+	unlock := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader("password="+password))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w = unlock("wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = unlock("s3cret")
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	req = httptest.NewRequest("GET", path, nil)
+	for _, ck := range w.Result().Cookies() {
+		req.AddCookie(ck)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "https://secret.ru", w.Header().Get("Location"))
+
+	for i := 0; i < passwordAttemptsPerMinute; i++ {
+		unlock("wrong")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, unlock("s3cret").Code)
+
+	req = httptest.NewRequest("POST", path, strings.NewReader("password=s3cret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "198.51.100.7:1234"
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusSeeOther, w.Code, "other clients are not locked out")
+}
+
+func TestPasswordProtectedPermanentRedirectIsNotCached(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	r := newTestRouter(t, urlStorage, config.Cfg{})
+	shorten := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/api/shorten", strings.NewReader(body)))
+		return w
+	}
+
+	w := shorten(`{"url":"https://long-secret.ru","password":"` + strings.Repeat("x", 73) + `"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	n, err := urlStorage.CountURLs()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	w = shorten(`{"url":"https://cached-secret.ru","password":"s3cret","redirect_type":301}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	resp := ResponseJSON{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	path := resp.Result[strings.LastIndex(resp.Result, "/"):]
+
+	req := httptest.NewRequest("POST", path, strings.NewReader("password=s3cret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	req = httptest.NewRequest("GET", path, nil)
+	for _, ck := range w.Result().Cookies() {
+		req.AddCookie(ck)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "private, no-store", w.Header().Get("Cache-Control"))
+}
+
+func TestMaxClicks(t *testing.T) {
+	storage := storage.NewDataStorage()
+	r := newTestRouter(t, storage, config.Cfg{})
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	statusCode, body := testRequest(t, ts, "POST", "/api/shorten", strings.NewReader(`{"url":"https://once.ru","max_clicks":3}`), true)
+	require.Equal(t, http.StatusCreated, statusCode)
+	resp := ResponseJSON{}
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+
+	codes := make(chan int, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statusCode, _ := testRequest(t, ts, "GET", resp.Result, nil, false)
+			codes <- statusCode
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	count := map[int]int{}
+	for code := range codes {
+		count[code]++
+	}
+	assert.Equal(t, map[int]int{http.StatusTemporaryRedirect: 3, http.StatusGone: 17}, count)
+}
+
+func TestSingleUseLinkPreview(t *testing.T) {
+	r := newTestRouter(t, storage.NewDataStorage(), config.Cfg{})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/shorten", strings.NewReader(`{"url":"https://once.ru","max_clicks":1,"redirect_type":301}`)))
+	require.Equal(t, http.StatusCreated, w.Code)
+	resp := ResponseJSON{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	path := resp.Result[strings.LastIndex(resp.Result, "/"):]
+	visit := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, visit(path+"+").Code)
+	assert.Equal(t, http.StatusOK, visit(path+"?preview=1").Code)
+	w = visit(path)
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "private, no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, http.StatusGone, visit(path).Code)
+	assert.Equal(t, http.StatusGone, visit(path+"+").Code)
+}
@@ -2,6 +2,8 @@ package helpers
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
 
 	"github.com/Antony8720/url-shortener/internal/app/violationerror"
 	"github.com/Antony8720/url-shortener/internal/storage"
@@ -9,21 +11,21 @@ import (
 	"github.com/google/uuid"
 )
 
-func EncodeURL(userID uuid.UUID, baseURL string, urlStorage storage.URLStorage) (string, error){
+func EncodeURL(userID uuid.UUID, baseURL string, urlStorage storage.URLStorage) (string, error) {
 	encURL := utils.RandURL()
-	for{
+	for {
 		_, ok := urlStorage.Get(encURL)
-		if ok{
+		if ok {
 			encURL = utils.RandURL()
 		} else {
 			break
 		}
 	}
 	err := urlStorage.Set(userID, encURL, baseURL)
-	if err != nil{
+	if err != nil {
 		var uve *violationerror.UniqueViolationError
-		if errors.As(err, &uve){
-			if err, ok := err.(*violationerror.UniqueViolationError); ok{
+		if errors.As(err, &uve) {
+			if err, ok := err.(*violationerror.UniqueViolationError); ok {
 				return err.Short, err
 			}
 		}
@@ -32,6 +34,36 @@ func EncodeURL(userID uuid.UUID, baseURL string, urlStorage storage.URLStorage)
 	return encURL, err
 }
 
-func DecodeURL(encURL string, urlStorage storage.URLStorage) (baseURL string, ok bool){
+func DecodeURL(encURL string, urlStorage storage.URLStorage) (baseURL string, ok bool) {
 	return urlStorage.Get(encURL)
-}
\ No newline at end of file
+}
+
+// ApplyUTM adds the campaign parameters to longURL, replacing parameters of
+// the same name. The source is required, as in Google's campaign URL builder.
+func ApplyUTM(longURL string, utm storage.UTM) (string, error) {
+	if utm.Source == "" {
+		return "", errors.New("utm source is required")
+	}
+	u, err := url.Parse(longURL)
+	if err != nil {
+		return "", err
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute URL", longURL)
+	}
+
+	q := u.Query()
+	for key, value := range map[string]string{
+		"utm_source":   utm.Source,
+		"utm_medium":   utm.Medium,
+		"utm_campaign": utm.Campaign,
+		"utm_term":     utm.Term,
+		"utm_content":  utm.Content,
+	} {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
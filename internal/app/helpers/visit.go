@@ -0,0 +1,34 @@
+package helpers
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/storage"
+)
+
+// ErrExpired is returned when visiting a link past its expiry.
+var ErrExpired = errors.New("link has expired")
+
+// Visit counts a visit of link, the same way for HTTP redirects and gRPC
+// resolves. It fails with ErrExpired for expired links and with
+// storage.ErrExhausted for links with max_clicks that have none left.
+// Otherwise a click is used up and the visit is recorded as a click of
+// variant; failing to record it is only logged.
+func Visit(urlStorage storage.URLStorage, link storage.Link, variant string) error {
+	now := time.Now()
+	if link.Expired(now) {
+		return ErrExpired
+	}
+	if link.MaxClicks > 0 {
+		if _, err := urlStorage.Redeem(link.Short); err != nil {
+			return err
+		}
+	}
+	click := storage.Click{Short: link.Short, Variant: variant, At: now}
+	if err := urlStorage.RecordClick(click); err != nil {
+		log.Printf("recording click of %s: %v", link.Short, err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HTTPSRedirect sends plain HTTP requests to the same path under baseURL,
+// which is expected to use the https scheme.
+func HTTPSRedirect(baseURL string) http.Handler {
+	base := strings.TrimSuffix(baseURL, "/")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, base+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,373 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/app/violationerror"
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/utils"
+)
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	// maxImportErrors limits the errors listed in an import summary.
+	maxImportErrors = 100
+	// maxImportBody and maxImportRecords bound a single import request.
+	maxImportBody    = 10 << 20
+	maxImportRecords = 10000
+	// tagSeparator separates the tags in the tags column of CSV files.
+	tagSeparator = ";"
+	// maxTags and maxTagLength bound the tags of an imported link.
+	maxTags      = 20
+	maxTagLength = 64
+)
+
+// csvColumns are the columns of exported CSV files. Imports need a header
+// with at least original_url and ignore unknown columns.
+var csvColumns = []string{"short_url", "original_url", "alias", "tags", "expires_at", "created_at"}
+
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// reservedAliases are first path segments taken by other routes.
+var reservedAliases = map[string]bool{"api": true, "ping": true}
+
+// LinkRecord is a link in import and export files. Times are RFC 3339.
+type LinkRecord struct {
+	ShortURL    string   `json:"short_url,omitempty"`
+	OriginalURL string   `json:"original_url"`
+	Alias       string   `json:"alias,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	ExpiresAt   string   `json:"expires_at,omitempty"`
+	CreatedAt   string   `json:"created_at,omitempty"`
+}
+
+// ImportError describes a record that could not be imported. Records are
+// numbered from 1, not counting the CSV header.
+type ImportError struct {
+	Record int    `json:"record"`
+	Error  string `json:"error"`
+}
+
+type ImportSummary struct {
+	Imported  int           `json:"imported"`
+	Failed    int           `json:"failed"`
+	Errors    []ImportError `json:"errors,omitempty"`
+	Truncated bool          `json:"errors_truncated,omitempty"`
+}
+
+func (s *ImportSummary) fail(record int, err error) {
+	s.Failed++
+	if len(s.Errors) == maxImportErrors {
+		s.Truncated = true
+		return
+	}
+	s.Errors = append(s.Errors, ImportError{Record: record, Error: err.Error()})
+}
+
+// requestFormat returns the format given by the format query parameter or,
+// failing that, by the content type of the request.
+func requestFormat(r *http.Request) string {
+	switch r.URL.Query().Get("format") {
+	case formatCSV:
+		return formatCSV
+	case formatNDJSON:
+		return formatNDJSON
+	case "":
+	default:
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return formatCSV
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return formatNDJSON
+	}
+	return ""
+}
+
+// recordReader reads records one at a time, so imports of any size use
+// constant memory.
+type recordReader func() (LinkRecord, error)
+
+func newCSVRecordReader(body io.Reader) (recordReader, error) {
+	cr := csv.NewReader(body)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["original_url"]; !ok {
+		return nil, errors.New("CSV header has no original_url column")
+	}
+	cr.ReuseRecord = true
+
+	return func() (LinkRecord, error) {
+		row, err := cr.Read()
+		if err != nil {
+			return LinkRecord{}, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		rec := LinkRecord{
+			OriginalURL: field("original_url"),
+			Alias:       field("alias"),
+			ExpiresAt:   field("expires_at"),
+			CreatedAt:   field("created_at"),
+		}
+		if tags := field("tags"); tags != "" {
+			rec.Tags = strings.Split(tags, tagSeparator)
+		}
+		return rec, nil
+	}, nil
+}
+
+func newNDJSONRecordReader(body io.Reader) recordReader {
+	dec := json.NewDecoder(body)
+	return func() (LinkRecord, error) {
+		var rec LinkRecord
+		err := dec.Decode(&rec)
+		return rec, err
+	}
+}
+
+// skippable reports whether reading may continue with the next record
+// after err. Malformed JSON and read errors end the import.
+func skippable(err error) bool {
+	var parseErr *csv.ParseError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &parseErr) || errors.As(err, &typeErr)
+}
+
+// parseRecord validates an imported record and turns it into a link. Links
+// keep the creation time of an exported record, new ones are created now.
+func parseRecord(rec LinkRecord) (storage.Link, error) {
+	u, err := url.Parse(rec.OriginalURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return storage.Link{}, fmt.Errorf("%q is not an absolute http(s) URL", rec.OriginalURL)
+	}
+	link := storage.Link{Long: rec.OriginalURL, Short: rec.Alias, CreatedAt: time.Now()}
+	if rec.Alias != "" && (!aliasPattern.MatchString(rec.Alias) || reservedAliases[rec.Alias]) {
+		return storage.Link{}, fmt.Errorf("alias %q is not allowed", rec.Alias)
+	}
+	for _, tag := range rec.Tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			if len(tag) > maxTagLength {
+				return storage.Link{}, fmt.Errorf("tags must be at most %d bytes long", maxTagLength)
+			}
+			link.Tags = append(link.Tags, tag)
+		}
+	}
+	if len(link.Tags) > maxTags {
+		return storage.Link{}, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	if rec.ExpiresAt != "" {
+		link.ExpiresAt, err = time.Parse(time.RFC3339, rec.ExpiresAt)
+		if err != nil {
+			return storage.Link{}, fmt.Errorf("expires_at %q is not an RFC 3339 time", rec.ExpiresAt)
+		}
+	}
+	if rec.CreatedAt != "" {
+		createdAt, err := time.Parse(time.RFC3339, rec.CreatedAt)
+		if err != nil {
+			return storage.Link{}, fmt.Errorf("created_at %q is not an RFC 3339 time", rec.CreatedAt)
+		}
+		if createdAt.After(link.CreatedAt) {
+			return storage.Link{}, fmt.Errorf("created_at %q is in the future", rec.CreatedAt)
+		}
+		link.CreatedAt = createdAt
+	}
+	return link, nil
+}
+
+// addImportedLink stores the link under its alias or a random short URL and
+// returns the short URL.
+func addImportedLink(urlStorage storage.URLStorage, link storage.Link) (string, error) {
+	random := link.Short == ""
+	for {
+		if random {
+			link.Short = utils.RandURL()
+		}
+		err := urlStorage.AddLink(link)
+		var uve *violationerror.UniqueViolationError
+		switch {
+		case errors.As(err, &uve):
+			return "", fmt.Errorf("already shortened as %s", uve.Short)
+		case errors.Is(err, storage.ErrExists) && random:
+			continue
+		case errors.Is(err, storage.ErrExists):
+			return "", fmt.Errorf("alias %q is taken", link.Short)
+		}
+		return link.Short, err
+	}
+}
+
+// ImportUserURLs creates links of the user from a CSV or NDJSON body read
+// record by record. Invalid records are skipped and listed in the summary.
+// Every created link is charged to shortenLimiter like a shortening; the
+// import stops with 429 when the limit is reached and with 413 when the
+// body or the number of records is too large, keeping the links created
+// so far.
+func ImportUserURLs(urlStorage storage.URLStorage, shortenLimiter *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportBody)
+		defer r.Body.Close()
+
+		var next recordReader
+		switch requestFormat(r) {
+		case formatCSV:
+			var err error
+			next, err = newCSVRecordReader(r.Body)
+			if err != nil {
+				http.Error(w, "400 "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		case formatNDJSON:
+			next = newNDJSONRecordReader(r.Body)
+		default:
+			http.Error(w, "415 expected text/csv or application/x-ndjson", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var summary ImportSummary
+		status := http.StatusOK
+		for n := 1; ; n++ {
+			rec, err := next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			if err != nil && !skippable(err) {
+				summary.fail(n, err)
+				break
+			}
+			if n > maxImportRecords {
+				status = http.StatusRequestEntityTooLarge
+				summary.fail(n, fmt.Errorf("at most %d records are imported at once", maxImportRecords))
+				break
+			}
+			var link storage.Link
+			if err == nil {
+				link, err = parseRecord(rec)
+				if err == nil {
+					if ok, wait := shortenLimiter.charge(r, 1); !ok {
+						w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+						status = http.StatusTooManyRequests
+						summary.fail(n, errors.New("rate limit exceeded"))
+						break
+					}
+					link.UserID = u.UserID
+					link.Short, err = addImportedLink(urlStorage, link)
+				}
+			}
+			if err != nil {
+				summary.fail(n, err)
+				continue
+			}
+			recordLinkEvent(r, urlStorage, audit.ActionCreate, link.Short, nil)
+			summary.Imported++
+		}
+
+		b, err := json.Marshal(summary)
+		if err != nil {
+			http.Error(w, "500 marshalling error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(status)
+		w.Write(b)
+	}
+}
+
+// ExportUserURLs streams the links of the user as NDJSON or, with
+// ?format=csv, as CSV in the layout accepted by ImportUserURLs. The export
+// stops at the first error, such as a client that went away; the response
+// is then cut short, its status has already been sent.
+func ExportUserURLs(urlStorage storage.URLStorage, baseURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = formatNDJSON
+		}
+		if format != formatCSV && format != formatNDJSON {
+			http.Error(w, "400 unsupported format", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="links.%s"`, format))
+		var write func(LinkRecord) error
+		if format == formatCSV {
+			w.Header().Set("content-type", "text/csv; charset=utf-8")
+			cw := csv.NewWriter(w)
+			defer cw.Flush()
+			write = func(rec LinkRecord) error {
+				return cw.Write([]string{rec.ShortURL, rec.OriginalURL, rec.Alias,
+					strings.Join(rec.Tags, tagSeparator), rec.ExpiresAt, rec.CreatedAt})
+			}
+			if err := cw.Write(csvColumns); err != nil {
+				return
+			}
+		} else {
+			w.Header().Set("content-type", "application/x-ndjson")
+			enc := json.NewEncoder(w)
+			write = func(rec LinkRecord) error {
+				return enc.Encode(rec)
+			}
+		}
+
+		err := urlStorage.EachUserLink(r.Context(), u.UserID, func(link storage.Link) error {
+			rec := LinkRecord{
+				ShortURL:    fullShortURL(r, baseURL, link.Short),
+				OriginalURL: link.Long,
+				Alias:       link.Short,
+				Tags:        link.Tags,
+				CreatedAt:   link.CreatedAt.Format(time.RFC3339),
+			}
+			if !link.ExpiresAt.IsZero() {
+				rec.ExpiresAt = link.ExpiresAt.Format(time.RFC3339)
+			}
+			return write(rec)
+		})
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("export of the links of %s: %v", u.UserID, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportExport(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	r := newTestRouter(t, urlStorage, config.Cfg{BaseURL: "http://short.ru"})
+	ck := userCookie(t, uuid.New())
+	do := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.AddCookie(ck)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	importURLs := func(contentType, body string) ImportSummary {
+		w := do("POST", "/api/user/urls/import", contentType, body)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var summary ImportSummary
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &summary))
+		return summary
+	}
+
+	summary := importURLs("text/csv", "original_url,alias,tags,expires_at\n"+
+		"https://a.ru,old-a,news;promo,\n"+
+		"https://b.ru,,,2000-01-01T00:00:00Z\n"+
+		"not a url,,,\n"+
+		"https://c.ru,old-a,,\n")
+	assert.Equal(t, 2, summary.Imported)
+	assert.Equal(t, 2, summary.Failed)
+	require.Len(t, summary.Errors, 2)
+	assert.Equal(t, 3, summary.Errors[0].Record)
+	assert.Equal(t, 4, summary.Errors[1].Record)
+
+	summary = importURLs("application/x-ndjson", `{"original_url":"https://d.ru","alias":"old-d","tags":["x"],"created_at":"2020-05-01T10:00:00Z"}
+{"original_url":"https://e.ru","expires_at":"tomorrow"}
+{"original_url":"https://f.ru","created_at":"2999-01-01T00:00:00Z"}
+{"original_url":"https://g.ru","tags":["`+strings.Repeat(`t","`, maxTags)+`t"]}
+`)
+	assert.Equal(t, 1, summary.Imported)
+	assert.Equal(t, 3, summary.Failed)
+
+	w := do("POST", "/api/user/urls/import", "application/json", `[]`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	link, ok := urlStorage.GetLink("old-a")
+	require.True(t, ok)
+	assert.Equal(t, []string{"news", "promo"}, link.Tags)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/old-a", nil))
+	assert.Equal(t, "https://a.ru", w.Header().Get("Location"))
+
+	w = do("GET", "/api/user/urls/export?format=csv", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 4)
+	assert.Equal(t, csvColumns, rows[0])
+
+	w = do("GET", "/api/user/urls/export", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 3)
+	exported := map[string]LinkRecord{}
+	for _, line := range lines {
+		var rec LinkRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		exported[rec.OriginalURL] = rec
+	}
+	assert.Equal(t, "http://short.ru/old-d", exported["https://d.ru"].ShortURL)
+	assert.Equal(t, "2000-01-01T00:00:00Z", exported["https://b.ru"].ExpiresAt)
+	assert.Equal(t, "2020-05-01T10:00:00Z", exported["https://d.ru"].CreatedAt)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/"+exported["https://b.ru"].Alias, nil))
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	other := storage.NewDataStorage()
+	r = newTestRouter(t, other, config.Cfg{})
+	summary = importURLs("application/x-ndjson", strings.Join(lines, "\n"))
+	assert.Equal(t, 3, summary.Imported)
+	link, ok = other.GetLink("old-d")
+	require.True(t, ok)
+	assert.True(t, time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC).Equal(link.CreatedAt), "imports keep the creation time")
+}
+
+func TestImportIsRateLimited(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	r := newTestRouter(t, urlStorage, config.Cfg{ShortenRateLimit: 2})
+	req := httptest.NewRequest("POST", "/api/user/urls/import", strings.NewReader("original_url\nhttps://a.ru\nhttps://b.ru\nhttps://c.ru\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	req.AddCookie(userCookie(t, uuid.New()))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	var summary ImportSummary
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &summary))
+	assert.Equal(t, 2, summary.Imported)
+	n, err := urlStorage.CountURLs()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
@@ -2,11 +2,25 @@ package app
 
 import (
 	"compress/gzip"
+	"context"
+	"crypto/subtle"
 	"github.com/Antony8720/url-shortener/internal/user"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
+type contextKey string
+
+const newUserKey contextKey = "newUser"
+
+const (
+	// authCookieName is the cookie holding the encrypted user.
+	authCookieName = "Authorization"
+	authCookieTTL  = 30 * 24 * time.Hour
+)
+
 func checkingCompressionMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Content-Encoding") == "gzip" {
@@ -22,38 +36,129 @@ func checkingCompressionMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// CookieAuthorization makes sure every request has a user. Clients without
+// a valid Authorization cookie are issued a new user, whose cookie is added
+// to the request and the response.
 func CookieAuthorization(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		expires := time.Now().AddDate(0, 1, 0)
-		rck, err := r.Cookie("Authorization")
+		rck, err := r.Cookie(authCookieName)
 		if err != nil && err != http.ErrNoCookie {
 			http.Error(w, "400 cookie error", http.StatusBadRequest)
 			return
 		}
 
-		if err == nil {
-			rck.Expires = expires
+		var u user.User
+		if err == nil && u.UserDecryptDecodeFromString(rck.Value) == nil {
+			rck.Path = "/"
+			rck.Expires = time.Now().Add(authCookieTTL)
 			http.SetCookie(w, rck)
 			next.ServeHTTP(w, r)
 			return
 		}
-
-		ck := http.Cookie{
-			Name:    "Authorization",
-			Path:    "/",
-			Expires: expires,
+		if err == nil {
+			dropCookie(r, authCookieName)
+			if u.LegacyDecodeFromString(rck.Value) == nil {
+				// an unsigned cookie of an earlier release: keep the user,
+				// sign the cookie
+				ck, err := setUserCookie(w, u)
+				if err != nil {
+					http.Error(w, "400 encoding error", http.StatusBadRequest)
+					return
+				}
+				r.AddCookie(ck)
+				next.ServeHTTP(w, r)
+				return
+			}
 		}
 
-		u := user.New()
-		enu, err := u.UserEncryptEncodeToString()
+		u = user.New()
+		ck, err := setUserCookie(w, u)
 		if err != nil {
 			http.Error(w, "400 encoding error", http.StatusBadRequest)
 			return
 		}
-
-		ck.Value = enu
-		r.AddCookie(&ck)
-		http.SetCookie(w, &ck)
+		r.AddCookie(ck)
+		r = r.WithContext(context.WithValue(r.Context(), newUserKey, true))
 		next.ServeHTTP(w, r)
 	})
 }
+
+// setUserCookie makes u the user of the client, replacing the
+// Authorization cookie already set on w, if any.
+func setUserCookie(w http.ResponseWriter, u user.User) (*http.Cookie, error) {
+	enu, err := u.UserEncryptEncodeToString()
+	if err != nil {
+		return nil, err
+	}
+	ck := &http.Cookie{
+		Name:    authCookieName,
+		Value:   enu,
+		Path:    "/",
+		Expires: time.Now().Add(authCookieTTL),
+	}
+
+	header := w.Header()
+	var kept []string
+	for _, line := range header.Values("Set-Cookie") {
+		if !strings.HasPrefix(line, authCookieName+"=") {
+			kept = append(kept, line)
+		}
+	}
+	header.Del("Set-Cookie")
+	for _, line := range kept {
+		header.Add("Set-Cookie", line)
+	}
+	http.SetCookie(w, ck)
+	return ck, nil
+}
+
+// dropCookie removes the cookies called name from the request.
+func dropCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// isNewUser reports whether the request's user was issued by
+// CookieAuthorization during this request.
+func isNewUser(r *http.Request) bool {
+	isNew, _ := r.Context().Value(newUserKey).(bool)
+	return isNew
+}
+
+// TrustedSubnet allows only clients whose address, as set by
+// middleware.RealIP from X-Real-IP, belongs to cidr. An empty or invalid
+// cidr denies everyone.
+func TrustedSubnet(cidr string) func(http.Handler) http.Handler {
+	_, subnet, err := net.ParseCIDR(cidr)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := net.ParseIP(clientIP(r))
+			if err != nil || ip == nil || !subnet.Contains(ip) {
+				http.Error(w, "403 forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AdminToken allows only requests carrying token as a bearer token in the
+// Authorization header. An empty token denies everyone.
+func AdminToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if token == "" || !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
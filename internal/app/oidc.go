@@ -0,0 +1,245 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcCallbackPath = "/api/auth/oidc/callback"
+	// oidcStateCookie keeps the state, nonce, PKCE verifier and return
+	// path of a login in progress.
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// OIDC signs users in with an OpenID Connect provider using the
+// authorization code flow. The subject of the provider is mapped to a
+// user, which becomes the user of the client.
+type OIDC struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	baseURL      string
+
+	// The provider is discovered on first use, so that the server starts
+	// while the provider is down.
+	mu         sync.Mutex
+	provider   *oidc.Provider
+	endSession string
+}
+
+// NewOIDC configures sign-on with the provider of cfg, or returns nil when
+// there is none.
+func NewOIDC(cfg config.Cfg) *OIDC {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+	return &OIDC{
+		issuer:       cfg.OIDCIssuer,
+		clientID:     cfg.OIDCClientID,
+		clientSecret: cfg.OIDCClientSecret,
+		baseURL:      strings.TrimSuffix(cfg.BaseURL, "/"),
+	}
+}
+
+func (o *OIDC) discover(ctx context.Context) (*oidc.Provider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	provider, err := oidc.NewProvider(ctx, o.issuer)
+	if err != nil {
+		return nil, err
+	}
+	var claims struct {
+		EndSession string `json:"end_session_endpoint"`
+	}
+	provider.Claims(&claims)
+	o.provider, o.endSession = provider, claims.EndSession
+	return provider, nil
+}
+
+func (o *OIDC) oauthConfig(provider *oidc.Provider) oauth2.Config {
+	return oauth2.Config{
+		ClientID:     o.clientID,
+		ClientSecret: o.clientSecret,
+		RedirectURL:  o.baseURL + oidcCallbackPath,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID},
+	}
+}
+
+// oidcUserID maps a subject of the issuer to a user. The mapping is
+// stable, so a user gets the same links on every sign-on.
+func oidcUserID(issuer, subject string) uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(issuer+"#"+subject))
+}
+
+// loginState is the content of the state cookie, its parts are joined by
+// dots.
+type loginState struct {
+	state, nonce, verifier, returnTo string
+}
+
+func (s loginState) String() string {
+	return strings.Join([]string{s.state, s.nonce, s.verifier, base64.RawURLEncoding.EncodeToString([]byte(s.returnTo))}, ".")
+}
+
+func parseLoginState(value string) (loginState, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 {
+		return loginState{}, false
+	}
+	returnTo, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return loginState{}, false
+	}
+	return loginState{state: parts[0], nonce: parts[1], verifier: parts[2], returnTo: string(returnTo)}, true
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// safeReturnPath accepts only paths on this server as the page to return to
+// after sign-on.
+func safeReturnPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return ""
+	}
+	return path
+}
+
+func setStateCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/api/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Login sends the client to the provider. The optional redirect query
+// parameter is the path to return to after signing in.
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request) {
+	provider, err := o.discover(r.Context())
+	if err != nil {
+		http.Error(w, "502 identity provider is not available", http.StatusBadGateway)
+		return
+	}
+	state := loginState{
+		state:    randomToken(),
+		nonce:    randomToken(),
+		verifier: oauth2.GenerateVerifier(),
+		returnTo: safeReturnPath(r.URL.Query().Get("redirect")),
+	}
+	setStateCookie(w, state.String(), int(oidcStateTTL.Seconds()))
+	cfg := o.oauthConfig(provider)
+	http.Redirect(w, r, cfg.AuthCodeURL(state.state, oidc.Nonce(state.nonce), oauth2.S256ChallengeOption(state.verifier)), http.StatusFound)
+}
+
+// Callback completes the sign-on started by Login and issues the
+// Authorization cookie of the user of the subject.
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+	ck, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, "400 no sign-on in progress", http.StatusBadRequest)
+		return
+	}
+	state, ok := parseLoginState(ck.Value)
+	query := r.URL.Query()
+	if !ok || subtle.ConstantTimeCompare([]byte(state.state), []byte(query.Get("state"))) != 1 {
+		http.Error(w, "400 invalid state", http.StatusBadRequest)
+		return
+	}
+	setStateCookie(w, "", -1)
+	if query.Get("error") != "" {
+		http.Error(w, "401 sign-on failed: "+query.Get("error"), http.StatusUnauthorized)
+		return
+	}
+
+	provider, err := o.discover(r.Context())
+	if err != nil {
+		http.Error(w, "502 identity provider is not available", http.StatusBadGateway)
+		return
+	}
+	cfg := o.oauthConfig(provider)
+	token, err := cfg.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(state.verifier))
+	if err != nil {
+		http.Error(w, "401 sign-on failed", http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		http.Error(w, "401 sign-on failed: no ID token", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: o.clientID}).Verify(r.Context(), rawIDToken)
+	if err != nil {
+		http.Error(w, "401 sign-on failed: invalid ID token", http.StatusUnauthorized)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(state.nonce)) != 1 {
+		http.Error(w, "401 sign-on failed: invalid nonce", http.StatusUnauthorized)
+		return
+	}
+
+	u := user.User{UserID: oidcUserID(idToken.Issuer, idToken.Subject)}
+	if _, err := setUserCookie(w, u); err != nil {
+		http.Error(w, "500 encoding error", http.StatusInternalServerError)
+		return
+	}
+	if state.returnTo != "" {
+		http.Redirect(w, r, state.returnTo, http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, struct {
+		Subject string `json:"subject"`
+	}{idToken.Subject})
+}
+
+// Logout replaces the user of the client by a new one and, when the
+// provider supports it, sends the client to the provider to end the
+// session there too.
+func (o *OIDC) Logout(w http.ResponseWriter, r *http.Request) {
+	if _, err := setUserCookie(w, user.New()); err != nil {
+		http.Error(w, "500 encoding error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := o.discover(r.Context()); err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	o.mu.Lock()
+	endSession := o.endSession
+	o.mu.Unlock()
+	u, err := url.Parse(endSession)
+	if endSession == "" || err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	q := u.Query()
+	q.Set("client_id", o.clientID)
+	q.Set("post_logout_redirect_uri", o.baseURL+"/")
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
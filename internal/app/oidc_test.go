@@ -0,0 +1,122 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/coreos/go-oidc/v3/oidc/oidctest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubIdP is an OpenID Connect provider issuing an ID token for subject
+// "alice" in exchange for the code "good-code".
+type stubIdP struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	nonce string
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	idp := &stubIdP{key: key}
+	discovery := &oidctest.Server{
+		PublicKeys: []oidctest.PublicKey{{PublicKey: key.Public(), KeyID: "test", Algorithm: oidc.RS256}},
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", discovery)
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "good-code" || r.PostFormValue("code_verifier") == "" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims := fmt.Sprintf(`{"iss":%q,"aud":"shortener","sub":"alice","nonce":%q,"exp":%d}`,
+			idp.URL, idp.nonce, time.Now().Add(time.Hour).Unix())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     oidctest.SignIDToken(key, "test", oidc.RS256, claims),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	discovery.SetIssuer(idp.URL)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newStubIdP(t)
+	r := newTestRouter(t, storage.NewDataStorage(), config.Cfg{
+		BaseURL:      "http://short.test",
+		OIDCIssuer:   idp.URL,
+		OIDCClientID: "shortener",
+	})
+	do := func(method, path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	cookie := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		t.Fatalf("no %s cookie", name)
+		return nil
+	}
+
+	login := func() (*http.Cookie, url.Values) {
+		w := do("GET", "/api/auth/oidc/login?redirect=/api/user/urls")
+		require.Equal(t, http.StatusFound, w.Code)
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		query := location.Query()
+		assert.Equal(t, "http://short.test/api/auth/oidc/callback", query.Get("redirect_uri"))
+		assert.Equal(t, "S256", query.Get("code_challenge_method"))
+		idp.nonce = query.Get("nonce")
+		return cookie(w, oidcStateCookie), query
+	}
+
+	state, query := login()
+	w := do("GET", "/api/auth/oidc/callback?code=good-code&state=forged", state)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do("GET", "/api/auth/oidc/callback?code=bad-code&state="+query.Get("state"), state)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	state, query = login()
+	w = do("GET", "/api/auth/oidc/callback?code=good-code&state="+query.Get("state"), state)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/api/user/urls", w.Header().Get("Location"))
+	var u user.User
+	require.NoError(t, u.UserDecryptDecodeFromString(cookie(w, "Authorization").Value))
+	assert.Equal(t, oidcUserID(idp.URL, "alice"), u.UserID)
+
+	state, query = login()
+	idp.nonce = "replayed"
+	w = do("GET", "/api/auth/oidc/callback?code=good-code&state="+query.Get("state"), state)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = do("POST", "/api/auth/oidc/logout", cookie(w, "Authorization"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	var after user.User
+	require.NoError(t, after.UserDecryptDecodeFromString(cookie(w, "Authorization").Value))
+	assert.NotEqual(t, u.UserID, after.UserID)
+}
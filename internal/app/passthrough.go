@@ -0,0 +1,56 @@
+package app
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/Antony8720/url-shortener/internal/storage"
+)
+
+func validQueryPassthrough(policy string) bool {
+	switch policy {
+	case "", storage.QueryPassthroughKeep, storage.QueryPassthroughOverride, storage.QueryPassthroughAppend:
+		return true
+	}
+	return false
+}
+
+// passthroughURL builds the destination of a visit from the link, the query
+// of the visit and the path that followed the short identifier. The query
+// is merged as the QueryPassthrough option of the link says, the path is
+// only appended for links with PathPassthrough.
+func passthroughURL(link storage.Link, query url.Values, extraPath string) (string, error) {
+	mergeQuery := link.QueryPassthrough != "" && len(query) > 0
+	appendPath := link.PathPassthrough && extraPath != ""
+	if !mergeQuery && !appendPath {
+		return link.Long, nil
+	}
+
+	dest, err := url.Parse(link.Long)
+	if err != nil {
+		return "", err
+	}
+
+	if appendPath {
+		dest = dest.JoinPath(strings.Split(extraPath, "/")...)
+	}
+
+	if mergeQuery {
+		q := dest.Query()
+		for key, values := range query {
+			switch link.QueryPassthrough {
+			case storage.QueryPassthroughKeep:
+				if !q.Has(key) {
+					q[key] = values
+				}
+			case storage.QueryPassthroughOverride:
+				q[key] = values
+			case storage.QueryPassthroughAppend:
+				q[key] = append(q[key], values...)
+			}
+		}
+		dest.RawQuery = q.Encode()
+	}
+
+	return dest.String(), nil
+}
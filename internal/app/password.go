@@ -0,0 +1,149 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// linkAccessTTL is how long a correct password grants access to a link.
+	linkAccessTTL = 15 * time.Minute
+	// passwordAttemptsPerMinute limits password attempts per link and
+	// client IP.
+	passwordAttemptsPerMinute = 5
+)
+
+var passwordTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Password required</title>
+</head>
+<body>
+<h1>{{if .Title}}{{.Title}}{{else}}This link is protected{{end}}</h1>
+{{if .Failed}}<p>The password is incorrect.</p>{{end}}
+<form method="post" action="{{.Action}}">
+<label>Password <input type="password" name="password" autofocus></label>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// LinkGuard protects links with passwords. A correct password is exchanged
+// for a short-lived cookie signed with the guard's key.
+type LinkGuard struct {
+	key      []byte
+	attempts *RateLimiter
+}
+
+// NewLinkGuard creates a guard signing cookies with secret. An empty secret
+// is replaced by a random one, which invalidates cookies on restart.
+func NewLinkGuard(secret string) *LinkGuard {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &LinkGuard{key: key, attempts: NewRateLimiter(passwordAttemptsPerMinute)}
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func accessCookieName(short string) string {
+	return "link_" + short
+}
+
+func (g *LinkGuard) sign(short string, expires int64) string {
+	mac := hmac.New(sha256.New, g.key)
+	fmt.Fprintf(mac, "%s.%d", short, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hasAccess reports whether the request carries a valid access cookie for
+// the link.
+func (g *LinkGuard) hasAccess(r *http.Request, short string) bool {
+	ck, err := r.Cookie(accessCookieName(short))
+	if err != nil {
+		return false
+	}
+	exp, sig, ok := strings.Cut(ck.Value, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(g.sign(short, expires)))
+}
+
+func (g *LinkGuard) grantAccess(w http.ResponseWriter, short string) {
+	expires := time.Now().Add(linkAccessTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessCookieName(short),
+		Value:    fmt.Sprintf("%d.%s", expires.Unix(), g.sign(short, expires.Unix())),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// writePasswordForm asks for the password of a protected link, which is
+// sent to UnlockURL. Visits of such links need the access cookie checked
+// by hasAccess.
+func writePasswordForm(w http.ResponseWriter, r *http.Request, link storage.Link, failed bool) {
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	passwordTemplate.Execute(w, struct {
+		Title  string
+		Action string
+		Failed bool
+	}{link.Title, r.URL.RequestURI(), failed})
+}
+
+// UnlockURL checks the password submitted by the form of a protected link
+// and sends the visitor back to the link with an access cookie.
+func UnlockURL(storage storage.URLStorage, guard *LinkGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		short := strings.TrimSuffix(chi.URLParam(r, "url"), "+")
+		link, ok := storage.GetLink(short)
+		if !ok || link.PasswordHash == "" {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+
+		if ok, _, wait := guard.attempts.take(1, short+"|"+clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "429 too many attempts", http.StatusTooManyRequests)
+			return
+		}
+
+		password := r.PostFormValue("password")
+		if bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) != nil {
+			writePasswordForm(w, r, link, true)
+			return
+		}
+
+		guard.grantAccess(w, short)
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+	}
+}
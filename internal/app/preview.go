@@ -0,0 +1,34 @@
+package app
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/Antony8720/url-shortener/internal/storage"
+)
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>{{if .Title}}{{.Title}}{{else}}Link preview{{end}}</title>
+</head>
+<body>
+<h1>{{if .Title}}{{.Title}}{{else}}You are leaving this site{{end}}</h1>
+<p>This link leads to:</p>
+<p><code>{{.Long}}</code></p>
+{{if not .CreatedAt.IsZero}}<p>Created on {{.CreatedAt.Format "2006-01-02"}}</p>{{end}}
+<p><a href="{{.Long}}" rel="noopener noreferrer">Continue to the destination</a></p>
+</body>
+</html>
+`))
+
+// writePreview renders the page that shows where a link leads instead of
+// redirecting to it.
+func writePreview(w http.ResponseWriter, link storage.Link) {
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	previewTemplate.Execute(w, link)
+}
@@ -0,0 +1,237 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/google/uuid"
+)
+
+// RateLimiter is a token-bucket limiter keyed by client. Every client gets
+// a bucket holding up to limit tokens that refills at limit tokens per minute.
+type RateLimiter struct {
+	sync.Mutex
+	limit   float64
+	rate    float64
+	buckets map[string]*bucket
+	now     func() time.Time
+	calls   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiters are the rate limits of the API. The gRPC API charges the
+// same limiters as the HTTP API, so that a client cannot double its quota
+// by using both.
+type RateLimiters struct {
+	Shorten  *RateLimiter
+	Batch    *RateLimiter
+	Redirect *RateLimiter
+}
+
+// NewRateLimiters creates the rate limiters configured by cfg.
+func NewRateLimiters(cfg config.Cfg) RateLimiters {
+	return RateLimiters{
+		Shorten:  NewRateLimiter(cfg.ShortenRateLimit),
+		Batch:    NewRateLimiter(cfg.BatchRateLimit),
+		Redirect: NewRateLimiter(cfg.RedirectRateLimit),
+	}
+}
+
+// cleanupEvery controls how often idle, fully refilled buckets are dropped.
+const cleanupEvery = 1024
+
+func NewRateLimiter(perMinute int) *RateLimiter {
+	return &RateLimiter{
+		limit:   float64(perMinute),
+		rate:    float64(perMinute) / 60,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// take removes n tokens from the buckets of all keys, or from none of them.
+// It reports whether the tokens were available, how many remain in the
+// emptiest bucket and how long the caller has to wait until n tokens would
+// be available in all of them.
+func (rl *RateLimiter) take(n float64, keys ...string) (ok bool, remaining float64, wait time.Duration) {
+	rl.Lock()
+	defer rl.Unlock()
+	now := rl.now()
+	rl.calls++
+	if rl.calls%cleanupEvery == 0 {
+		rl.cleanup(now)
+	}
+
+	buckets := make([]*bucket, len(keys))
+	remaining = rl.limit
+	for i, key := range keys {
+		b, found := rl.buckets[key]
+		if !found {
+			b = &bucket{tokens: rl.limit, last: now}
+			rl.buckets[key] = b
+		}
+		b.tokens = math.Min(rl.limit, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+		b.last = now
+		buckets[i] = b
+		remaining = math.Min(remaining, b.tokens)
+	}
+
+	if remaining < n {
+		wait = time.Duration((n - remaining) / rl.rate * float64(time.Second))
+		return false, remaining, wait
+	}
+	for _, b := range buckets {
+		b.tokens -= n
+	}
+	return true, remaining - n, 0
+}
+
+func (rl *RateLimiter) cleanup(now time.Time) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.limit {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Handler limits every request to one token.
+func (rl *RateLimiter) Handler(next http.Handler) http.Handler {
+	return rl.WeightedHandler(nil)(next)
+}
+
+// WeightedHandler limits requests to a number of tokens computed by weight.
+// A nil weight charges one token per request.
+func (rl *RateLimiter) WeightedHandler(weight func(r *http.Request) (int, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rl == nil || rl.limit <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			n := 1
+			if weight != nil {
+				var err error
+				n, err = weight(r)
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					http.Error(w, "413 request body too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				if err != nil {
+					http.Error(w, "400 bad request", http.StatusBadRequest)
+					return
+				}
+			}
+			if float64(n) > rl.limit {
+				http.Error(w, "413 request exceeds rate limit", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			ok, remaining, wait := rl.take(float64(n), rateLimitKeys(r)...)
+			reset := (rl.limit - remaining) / rl.rate
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(int(rl.limit)))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset))))
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "429 too many requests", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// charge takes n tokens from the buckets of the client of r outside of a
+// handler chain, for requests that create several links. A nil or disabled
+// limiter allows everything.
+func (rl *RateLimiter) charge(r *http.Request, n float64) (ok bool, wait time.Duration) {
+	if rl == nil || rl.limit <= 0 {
+		return true, 0
+	}
+	ok, _, wait = rl.take(n, rateLimitKeys(r)...)
+	return ok, wait
+}
+
+// Allow takes n tokens from the buckets of all keys, made with IPKey and
+// UserKey, for requests that do not come through the HTTP API. A nil or
+// disabled limiter allows everything. More tokens than the limit are never
+// allowed, which is reported with a zero wait.
+func (rl *RateLimiter) Allow(n int, keys ...string) (ok bool, wait time.Duration) {
+	if rl == nil || rl.limit <= 0 {
+		return true, 0
+	}
+	if float64(n) > rl.limit {
+		return false, 0
+	}
+	ok, _, wait = rl.take(float64(n), keys...)
+	return ok, wait
+}
+
+// IPKey and UserKey name the buckets of a client IP address and of a user.
+func IPKey(ip string) string { return "ip:" + ip }
+
+func UserKey(userID uuid.UUID) string { return "user:" + userID.String() }
+
+// rateLimitKeys identifies the client by its IP address and, if the request
+// carried a valid Authorization cookie, also by its user. Requests are
+// charged to both, so that neither dropping nor cycling cookies gives a
+// client a fresh bucket.
+func rateLimitKeys(r *http.Request) []string {
+	keys := []string{IPKey(clientIP(r))}
+	if !isNewUser(r) {
+		if u, ok := GetRequestUser(r); ok {
+			keys = append(keys, UserKey(u.UserID))
+		}
+	}
+	return keys
+}
+
+// clientIP returns the host part of RemoteAddr, which middleware.RealIP
+// may have replaced with a bare address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// maxBatchBody bounds the body of a batch request, which batchWeight reads
+// before any limit applies.
+const maxBatchBody = 1 << 20
+
+// batchWeight counts the items of a batch request. The body is buffered and
+// put back so that SaveBatch can read it again.
+func batchWeight(r *http.Request) (int, error) {
+	b, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBatchBody))
+	if err != nil {
+		return 0, err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(b))
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(b, &items); err != nil {
+		return 0, err
+	}
+	if len(items) == 0 {
+		return 1, nil
+	}
+	return len(items), nil
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShortenRateLimit(t *testing.T) {
+	r := newTestRouter(t, storage.NewDataStorage(), config.Cfg{ShortenRateLimit: 2})
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("https://ya.ru"))
+		req.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.NotEqual(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader("https://ya.ru"))
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader("https://ya.ru"))
+	req.RemoteAddr = "10.0.0.2:1234"
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.NotEqual(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestBatchRateLimitIsWeighted(t *testing.T) {
+	r := newTestRouter(t, storage.NewDataStorage(), config.Cfg{BatchRateLimit: 3})
+	body := `[{"correlation_id":"1","original_url":"https://a.ru"},{"correlation_id":"2","original_url":"https://b.ru"}]`
+
+	req := httptest.NewRequest("POST", "/api/shorten/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), "correlation_id")
+
+	req = httptest.NewRequest("POST", "/api/shorten/batch", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestWorkspaceBatchIsRateLimited(t *testing.T) {
+	r := newTestRouter(t, storage.NewDataStorage(), config.Cfg{BatchRateLimit: 3})
+	u := user.New()
+	value, err := u.UserEncryptEncodeToString()
+	require.NoError(t, err)
+	do := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: value})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := do("/api/workspaces", `{"name":"Marketing"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var ws storage.Membership
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ws))
+
+	body := `[{"correlation_id":"1","original_url":"https://a.ru"},{"correlation_id":"2","original_url":"https://b.ru"}]`
+	path := "/api/workspaces/" + ws.ID.String() + "/shorten/batch"
+	assert.Equal(t, http.StatusCreated, do(path, body).Code)
+	assert.Equal(t, http.StatusTooManyRequests, do(path, body).Code)
+}
+
+func TestRateLimitCyclingCookies(t *testing.T) {
+	r := newTestRouter(t, storage.NewDataStorage(), config.Cfg{ShortenRateLimit: 2})
+	codes := make([]int, 0, 3)
+	for i := 0; i < 3; i++ {
+		u := user.New()
+		value, err := u.UserEncryptEncodeToString()
+		require.NoError(t, err)
+		req := httptest.NewRequest("POST", "/", strings.NewReader("https://ya.ru"))
+		req.RemoteAddr = "10.0.0.3:1234"
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: value})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, codes[2])
+}
+
+func TestBatchBodyIsBounded(t *testing.T) {
+	r := newTestRouter(t, storage.NewDataStorage(), config.Cfg{BatchRateLimit: 3})
+	body := `[{"correlation_id":"` + strings.Repeat("x", maxBatchBody) + `"}]`
+	req := httptest.NewRequest("POST", "/api/shorten/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
@@ -4,13 +4,34 @@ import (
 	"compress/flate"
 	"net/http"
 
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/geoip"
 	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/webhook"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
-func MainRouter(storage storage.URLStorage, baseURL, DBAddress string) chi.Router {
+// MainRouter returns the HTTP API of the shortener. auditLog, hooks and geo
+// are owned by the caller, which closes them once the server is shut down;
+// limits may be shared with the gRPC API. A nil geo disables country
+// targeting.
+func MainRouter(storage storage.URLStorage, cfg config.Cfg, auditLog audit.Log, hooks *webhook.Dispatcher, limits RateLimiters, geo geoip.Resolver) chi.Router {
 	r := chi.NewRouter()
+	baseURL := cfg.BaseURL
+	DBAddress := cfg.DBAddress
+	shortenLimiter := limits.Shorten
+	batchLimiter := limits.Batch
+	redirectLimiter := limits.Redirect
+	loginAttempts := NewRateLimiter(loginAttemptsPerMinute)
+	registrations := NewRateLimiter(registrationsPerMinute)
+	sso := NewOIDC(cfg)
+	guard := NewLinkGuard(cfg.LinkAccessSecret)
+	redirectStatus := cfg.RedirectStatus
+	if redirectStatus == 0 {
+		redirectStatus = http.StatusTemporaryRedirect
+	}
 
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
@@ -21,6 +42,8 @@ func MainRouter(storage storage.URLStorage, baseURL, DBAddress string) chi.Route
 	r.Use(compressor.Handler)
 	r.Use(checkingCompressionMiddleware)
 	r.Use(CookieAuthorization)
+	r.Use(AuditTrail(auditLog))
+	r.Use(Webhooks(hooks))
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(404)
 		w.Write([]byte("404 page not found"))
@@ -31,19 +54,53 @@ func MainRouter(storage storage.URLStorage, baseURL, DBAddress string) chi.Route
 	})
 
 	r.Route("/", func(r chi.Router) {
-		r.Post("/", SaveLongURL(storage, baseURL))
+		r.With(shortenLimiter.Handler).Post("/", SaveLongURL(storage, baseURL))
 		r.Get("/ping", Ping(DBAddress))
 
 		r.Route("/api", func(r chi.Router) {
 			r.Route("/shorten", func(r chi.Router) {
-				r.Post("/", SaveJSONLongURL(storage, baseURL))
-				r.Post("/batch", SaveBatch(storage, baseURL))
+				r.With(shortenLimiter.Handler).Post("/", SaveJSONLongURL(storage, baseURL))
+				r.With(batchLimiter.WeightedHandler(batchWeight)).Post("/batch", SaveBatch(storage, baseURL))
 			})
 			r.Get("/user/urls", GetUserURLs(storage, baseURL))
+			r.Delete("/user/urls", DeleteUserURLs(storage))
+			r.Route("/workspaces", WorkspaceRoutes(storage, baseURL, hooks, shortenLimiter, batchLimiter))
+			r.Route("/user/webhooks", WebhookRoutes(storage, hooks))
+			r.Post("/user/merge", MergeUserURLs(storage))
+			r.Post("/user/register", RegisterUser(storage, registrations))
+			r.Post("/user/login", LoginUser(storage, loginAttempts))
+			if sso != nil {
+				r.Route("/auth/oidc", func(r chi.Router) {
+					r.Get("/login", sso.Login)
+					r.Get("/callback", sso.Callback)
+					r.Post("/logout", sso.Logout)
+				})
+			}
+			r.Post("/user/urls/import", ImportUserURLs(storage, shortenLimiter))
+			r.Get("/user/urls/export", ExportUserURLs(storage, baseURL))
+			r.Patch("/user/urls/{url}", UpdateUserURL(storage, baseURL))
+			r.Route("/user/urls/{url}/rules", func(r chi.Router) {
+				r.Get("/", GetURLRules(storage))
+				r.Put("/", SetURLRules(storage))
+				r.Delete("/", DeleteURLRules(storage))
+			})
+			r.Route("/user/urls/{url}/variants", func(r chi.Router) {
+				r.Get("/", GetURLVariants(storage))
+				r.Put("/", SetURLVariants(storage))
+				r.Delete("/", DeleteURLVariants(storage))
+			})
+			r.Get("/user/urls/{url}/clicks", GetURLClicks(storage))
+			r.With(TrustedSubnet(cfg.TrustedSubnet)).Get("/internal/stats", GetStats(storage))
+			r.With(AdminToken(cfg.AdminToken)).Get("/admin/backup", GetBackup(storage))
+			r.With(AdminToken(cfg.AdminToken)).Get("/admin/audit", GetAuditLog(auditLog))
 		})
 
 		r.Route("/{url}", func(r chi.Router) {
-			r.Get("/", RedirectToOriginalURL(storage))
+			r.With(redirectLimiter.Handler).Get("/", RedirectToOriginalURL(storage, redirectStatus, guard, geo))
+			r.Post("/", UnlockURL(storage, guard))
+			r.Get("/qr", GetQRCode(storage, baseURL))
+			r.With(redirectLimiter.Handler).Get("/*", RedirectToOriginalURL(storage, redirectStatus, guard, geo))
+			r.Post("/*", UnlockURL(storage, guard))
 		})
 	})
 
@@ -0,0 +1,259 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/geoip"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/text/language"
+)
+
+const (
+	// maxRules limits the number of targeting rules per link.
+	maxRules = 50
+	// maxRulesBody bounds the body of a rules request.
+	maxRulesBody = 64 << 10
+)
+
+var (
+	knownDevices = []string{"mobile", "tablet", "desktop"}
+	knownOS      = []string{"ios", "android", "windows", "macos", "linux"}
+)
+
+// visitor is what targeting rules are matched against.
+type visitor struct {
+	device   string
+	os       string
+	language language.Tag
+	location geoip.Location
+}
+
+func newVisitor(r *http.Request, geo geoip.Resolver) visitor {
+	ua := r.UserAgent()
+	v := visitor{device: deviceClass(ua), os: osClass(ua)}
+	if tags, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language")); err == nil && len(tags) > 0 {
+		v.language = tags[0]
+	}
+	if geo != nil {
+		v.location = geo.Lookup(net.ParseIP(clientIP(r)))
+	}
+	return v
+}
+
+func deviceClass(ua string) string {
+	switch {
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") ||
+		(strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile")):
+		return "tablet"
+	case strings.Contains(ua, "Mobi") || strings.Contains(ua, "iPhone") || strings.Contains(ua, "Android"):
+		return "mobile"
+	}
+	return "desktop"
+}
+
+func osClass(ua string) string {
+	switch {
+	case strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad") || strings.Contains(ua, "iPod"):
+		return "ios"
+	case strings.Contains(ua, "Android"):
+		return "android"
+	case strings.Contains(ua, "Windows"):
+		return "windows"
+	case strings.Contains(ua, "Mac OS X") || strings.Contains(ua, "Macintosh"):
+		return "macos"
+	case strings.Contains(ua, "Linux"):
+		return "linux"
+	}
+	return ""
+}
+
+func anyEqualFold(values []string, v string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v visitor) matches(rule storage.Rule) bool {
+	if len(rule.Devices) > 0 && !anyEqualFold(rule.Devices, v.device) {
+		return false
+	}
+	if len(rule.OS) > 0 && !anyEqualFold(rule.OS, v.os) {
+		return false
+	}
+	if len(rule.Languages) > 0 && !v.speaks(rule.Languages) {
+		return false
+	}
+	if len(rule.Countries) > 0 {
+		inEU := v.location.InEU && anyEqualFold(rule.Countries, "EU")
+		if !inEU && (v.location.Country == "" || !anyEqualFold(rule.Countries, v.location.Country)) {
+			return false
+		}
+	}
+	return true
+}
+
+// speaks reports whether the preferred language of the visitor is one of
+// languages or a variant of one, so that "en" matches visitors preferring
+// "en-US" but "en-US" does not match "en-GB".
+func (v visitor) speaks(languages []string) bool {
+	for _, l := range languages {
+		tag, err := language.Parse(l)
+		if err != nil {
+			continue
+		}
+		for t := v.language; ; t = t.Parent() {
+			if t == tag {
+				return true
+			}
+			if t.IsRoot() {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// targetDestination returns the destination of the first rule matching the
+// visitor, if any. Countries are resolved by geo; with a nil geo rules with
+// countries never match.
+func targetDestination(link storage.Link, r *http.Request, geo geoip.Resolver) (string, bool) {
+	if len(link.Rules) == 0 {
+		return "", false
+	}
+	v := newVisitor(r, geo)
+	for _, rule := range link.Rules {
+		if v.matches(rule) {
+			return rule.Destination, true
+		}
+	}
+	return "", false
+}
+
+func validateRules(rules []storage.Rule) error {
+	if len(rules) > maxRules {
+		return fmt.Errorf("at most %d rules are allowed", maxRules)
+	}
+	for i, rule := range rules {
+		if len(rule.Devices)+len(rule.OS)+len(rule.Languages)+len(rule.Countries) == 0 {
+			return fmt.Errorf("rule %d has no conditions", i)
+		}
+		for _, d := range rule.Devices {
+			if !anyEqualFold(knownDevices, d) {
+				return fmt.Errorf("rule %d: unknown device %q", i, d)
+			}
+		}
+		for _, os := range rule.OS {
+			if !anyEqualFold(knownOS, os) {
+				return fmt.Errorf("rule %d: unknown os %q", i, os)
+			}
+		}
+		for _, l := range rule.Languages {
+			if _, err := language.Parse(l); err != nil {
+				return fmt.Errorf("rule %d: language %q is not a BCP 47 tag", i, l)
+			}
+		}
+		for _, c := range rule.Countries {
+			if len(c) != 2 {
+				return fmt.Errorf("rule %d: country %q is not a two letter code", i, c)
+			}
+		}
+		u, err := url.Parse(rule.Destination)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("rule %d: destination must be an absolute http(s) URL", i)
+		}
+	}
+	return nil
+}
+
+// ownLink returns the link named by the url parameter if it belongs to the
+// user of the request, writing an error response otherwise.
+func ownLink(w http.ResponseWriter, r *http.Request, urlStorage storage.URLStorage) (storage.Link, bool) {
+	u, ok := GetRequestUser(r)
+	if !ok {
+		http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+		return storage.Link{}, false
+	}
+	link, ok := urlStorage.GetLink(chi.URLParam(r, "url"))
+	if !ok || link.UserID != u.UserID {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return storage.Link{}, false
+	}
+	return link, true
+}
+
+func writeRules(w http.ResponseWriter, rules []storage.Rule) {
+	if rules == nil {
+		rules = []storage.Rule{}
+	}
+	writeJSON(w, rules)
+}
+
+func GetURLRules(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, ok := ownLink(w, r, urlStorage)
+		if !ok {
+			return
+		}
+		writeRules(w, link.Rules)
+	}
+}
+
+// SetURLRules replaces the targeting rules of a link with the JSON array in
+// the request body.
+func SetURLRules(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, ok := ownLink(w, r, urlStorage)
+		if !ok {
+			return
+		}
+
+		var rules []storage.Rule
+		r.Body = http.MaxBytesReader(w, r.Body, maxRulesBody)
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return
+		}
+		if err := validateRules(rules); err != nil {
+			http.Error(w, "400 "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := urlStorage.SetRules(link.UserID, link.Short, rules); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, "404 page not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		recordLinkEvent(r, urlStorage, audit.ActionUpdate, link.Short, &link)
+		writeRules(w, rules)
+	}
+}
+
+func DeleteURLRules(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, ok := ownLink(w, r, urlStorage)
+		if !ok {
+			return
+		}
+		if err := urlStorage.SetRules(link.UserID, link.Short, nil); err != nil {
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		recordLinkEvent(r, urlStorage, audit.ActionUpdate, link.Short, &link)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/geoip"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver map[string]geoip.Location
+
+func (f fakeResolver) Lookup(ip net.IP) geoip.Location {
+	return f[ip.String()]
+}
+
+const iPhoneUA = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148"
+
+func TestURLRules(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	userID := uuid.New()
+	require.NoError(t, urlStorage.Set(userID, "abc", "https://site.ru"))
+	r := newTestRouter(t, urlStorage, config.Cfg{})
+	do := func(method, path, body string, userID uuid.UUID) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(userCookie(t, userID))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("PUT", "/api/user/urls/abc/rules", `[{"devices":["phone"],"destination":"https://m.site.ru"}]`, userID)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do("PUT", "/api/user/urls/abc/rules", `[{"destination":"https://m.site.ru"}]`, userID)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do("PUT", "/api/user/urls/abc/rules", `[{"languages":["german"],"destination":"https://site.de"}]`, userID)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do("PUT", "/api/user/urls/abc/rules", `[{"languages":["de"],"destination":"https://site.de/`+strings.Repeat("a", maxRulesBody)+`"}]`, userID)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do("PUT", "/api/user/urls/abc/rules", `[{"os":["ios"],"destination":"https://m.site.ru"}]`, uuid.New())
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = do("PUT", "/api/user/urls/abc/rules", `[{"os":["ios"],"destination":"https://apps.apple.com/app"},{"languages":["de"],"destination":"https://site.de"}]`, userID)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = do("GET", "/api/user/urls/abc/rules", "", userID)
+	assert.JSONEq(t, `[{"os":["ios"],"destination":"https://apps.apple.com/app"},{"languages":["de"],"destination":"https://site.de"}]`, w.Body.String())
+
+	redirect := func(header http.Header) string {
+		req := httptest.NewRequest("GET", "/abc", nil)
+		req.Header = header
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Header().Get("Location")
+	}
+	assert.Equal(t, "https://apps.apple.com/app", redirect(http.Header{"User-Agent": {iPhoneUA}}))
+	assert.Equal(t, "https://site.de", redirect(http.Header{"Accept-Language": {"de-AT,de;q=0.9,en;q=0.5"}}))
+	assert.Equal(t, "https://site.ru", redirect(http.Header{"Accept-Language": {"en-US"}}))
+
+	w = do("PUT", "/api/user/urls/abc/rules", `[{"languages":["pt-BR"],"destination":"https://site.br"}]`, userID)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://site.br", redirect(http.Header{"Accept-Language": {"pt-BR"}}))
+	assert.Equal(t, "https://site.ru", redirect(http.Header{"Accept-Language": {"pt-PT"}}))
+	w = do("PUT", "/api/user/urls/abc/rules", `[{"os":["ios"],"destination":"https://apps.apple.com/app"},{"languages":["de"],"destination":"https://site.de"}]`, userID)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = do("PATCH", "/api/user/urls/abc", `{"redirect_type":301}`, userID)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/abc", nil))
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Cache-Control"), "private, "))
+	assert.Equal(t, "User-Agent, Accept-Language", w.Header().Get("Vary"))
+
+	w = do("DELETE", "/api/user/urls/abc/rules", "", userID)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://site.ru", redirect(http.Header{"User-Agent": {iPhoneUA}}))
+}
+
+func TestCountryRules(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	userID := uuid.New()
+	require.NoError(t, urlStorage.Set(userID, "abc", "https://site.com"))
+	require.NoError(t, urlStorage.SetRules(userID, "abc", []storage.Rule{
+		{Countries: []string{"RU"}, Destination: "https://site.ru"},
+		{Countries: []string{"EU"}, Devices: []string{"desktop"}, Destination: "https://site.eu"},
+	}))
+	geo := fakeResolver{
+		"10.0.0.1": {Country: "RU"},
+		"10.0.0.2": {Country: "FR", InEU: true},
+	}
+	r := chi.NewRouter()
+	r.Get("/{url}", RedirectToOriginalURL(urlStorage, http.StatusFound, NewLinkGuard(""), geo))
+
+	for ip, want := range map[string]string{
+		"10.0.0.1": "https://site.ru",
+		"10.0.0.2": "https://site.eu",
+		"10.0.0.3": "https://site.com",
+	} {
+		req := httptest.NewRequest("GET", "/abc", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, want, w.Header().Get("Location"), ip)
+	}
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/storage"
+)
+
+const (
+	// maxVariants limits the number of destinations of a link.
+	maxVariants = 20
+	// maxVariantsBody bounds the body of a variants request.
+	maxVariantsBody = 64 << 10
+	// maxVariantWeight bounds weights, so that their sum cannot overflow.
+	maxVariantWeight = 10000
+	// variantCookieTTL is how long a sticky variant is remembered.
+	variantCookieTTL = 30 * 24 * time.Hour
+)
+
+// variantNamePattern keeps variant names safe to store in the sticky
+// variant cookie.
+var variantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// VariantsJSON is the body of the variants endpoints.
+type VariantsJSON struct {
+	Sticky   bool              `json:"sticky"`
+	Variants []storage.Variant `json:"variants"`
+}
+
+func validateVariants(variants []storage.Variant) error {
+	if len(variants) > maxVariants {
+		return fmt.Errorf("at most %d variants are allowed", maxVariants)
+	}
+	names := make(map[string]struct{}, len(variants))
+	for i, v := range variants {
+		if v.Name == "" {
+			return fmt.Errorf("variant %d has no name", i)
+		}
+		if !variantNamePattern.MatchString(v.Name) {
+			return fmt.Errorf("variant %d: name %q must be up to 32 letters, digits, '.', '_' or '-'", i, v.Name)
+		}
+		if _, ok := names[v.Name]; ok {
+			return fmt.Errorf("variant name %q is not unique", v.Name)
+		}
+		names[v.Name] = struct{}{}
+		if v.Weight <= 0 || v.Weight > maxVariantWeight {
+			return fmt.Errorf("variant %q must have a weight between 1 and %d", v.Name, maxVariantWeight)
+		}
+		u, err := url.Parse(v.Destination)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("variant %q: destination must be an absolute http(s) URL", v.Name)
+		}
+	}
+	return nil
+}
+
+func variantCookieName(short string) string {
+	return "variant_" + short
+}
+
+// chooseVariant picks a variant of the link at random in proportion to the
+// weights. Sticky links reuse the variant remembered in a cookie and
+// remember the chosen one.
+func chooseVariant(w http.ResponseWriter, r *http.Request, link storage.Link) storage.Variant {
+	if link.StickyVariants {
+		if ck, err := r.Cookie(variantCookieName(link.Short)); err == nil {
+			for _, v := range link.Variants {
+				if v.Name == ck.Value {
+					return v
+				}
+			}
+		}
+	}
+
+	total := 0
+	for _, v := range link.Variants {
+		total += v.Weight
+	}
+	// Variants restored from elsewhere may not have been validated.
+	if total <= 0 {
+		return link.Variants[0]
+	}
+	n := rand.IntN(total)
+	chosen := link.Variants[len(link.Variants)-1]
+	for _, v := range link.Variants {
+		if n < v.Weight {
+			chosen = v
+			break
+		}
+		n -= v.Weight
+	}
+
+	if link.StickyVariants {
+		http.SetCookie(w, &http.Cookie{
+			Name:     variantCookieName(link.Short),
+			Value:    chosen.Name,
+			Path:     "/",
+			MaxAge:   int(variantCookieTTL.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return chosen
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "500 marshalling error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func GetURLVariants(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, ok := ownLink(w, r, urlStorage)
+		if !ok {
+			return
+		}
+		variants := link.Variants
+		if variants == nil {
+			variants = []storage.Variant{}
+		}
+		writeJSON(w, VariantsJSON{Sticky: link.StickyVariants, Variants: variants})
+	}
+}
+
+// SetURLVariants replaces the destinations visitors of a link are split
+// between.
+func SetURLVariants(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, ok := ownLink(w, r, urlStorage)
+		if !ok {
+			return
+		}
+
+		var req VariantsJSON
+		r.Body = http.MaxBytesReader(w, r.Body, maxVariantsBody)
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return
+		}
+		if err := validateVariants(req.Variants); err != nil {
+			http.Error(w, "400 "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := urlStorage.SetVariants(link.UserID, link.Short, req.Variants, req.Sticky); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, "404 page not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		recordLinkEvent(r, urlStorage, audit.ActionUpdate, link.Short, &link)
+		if req.Variants == nil {
+			req.Variants = []storage.Variant{}
+		}
+		writeJSON(w, req)
+	}
+}
+
+func DeleteURLVariants(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, ok := ownLink(w, r, urlStorage)
+		if !ok {
+			return
+		}
+		if err := urlStorage.SetVariants(link.UserID, link.Short, nil, false); err != nil {
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		recordLinkEvent(r, urlStorage, audit.ActionUpdate, link.Short, &link)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GetURLClicks returns the number of visits of a link, in total and per
+// variant.
+func GetURLClicks(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, ok := ownLink(w, r, urlStorage)
+		if !ok {
+			return
+		}
+		stats, err := urlStorage.GetClickStats(link.Short)
+		if err != nil {
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, stats)
+	}
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestURLVariants(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	userID := uuid.New()
+	require.NoError(t, urlStorage.Set(userID, "abc", "https://site.ru"))
+	r := newTestRouter(t, urlStorage, config.Cfg{})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(userCookie(t, userID))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("PUT", "/api/user/urls/abc/variants", `{"variants":[{"name":"a","destination":"https://a.ru","weight":0}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do("PUT", "/api/user/urls/abc/variants", `{"variants":[{"name":"a","destination":"https://a.ru","weight":9223372036854775807},{"name":"b","destination":"https://b.ru","weight":1}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do("PUT", "/api/user/urls/abc/variants", `{"variants":[{"name":"a","destination":"https://a.ru","weight":1},{"name":"a","destination":"https://b.ru","weight":1}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do("PUT", "/api/user/urls/abc/variants", `{"variants":[{"name":"a; b","destination":"https://a.ru","weight":1}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = do("PUT", "/api/user/urls/abc/variants", `{"variants":[{"name":"a","destination":"https://a.ru","weight":3},{"name":"b","destination":"https://b.ru","weight":1}]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	served := map[string]int{}
+	for i := 0; i < 400; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/abc", nil))
+		served[w.Header().Get("Location")]++
+	}
+	assert.Len(t, served, 2)
+	assert.Greater(t, served["https://a.ru"], served["https://b.ru"])
+
+	w = do("GET", "/api/user/urls/abc/clicks", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var stats storage.ClickStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, 400, stats.Total)
+	assert.Equal(t, served["https://a.ru"], stats.Variants["a"])
+	assert.Equal(t, served["https://b.ru"], stats.Variants["b"])
+
+	w = do("DELETE", "/api/user/urls/abc/variants", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/abc", nil))
+	assert.Equal(t, "https://site.ru", w.Header().Get("Location"))
+}
+
+func TestStickyVariants(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	userID := uuid.New()
+	require.NoError(t, urlStorage.Set(userID, "abc", "https://site.ru"))
+	require.NoError(t, urlStorage.SetVariants(userID, "abc", []storage.Variant{
+		{Name: "a", Destination: "https://a.ru", Weight: 1},
+		{Name: "b", Destination: "https://b.ru", Weight: 1},
+	}, true))
+	r := newTestRouter(t, urlStorage, config.Cfg{})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/abc", nil))
+	first := w.Header().Get("Location")
+	cookies := w.Result().Cookies()
+	require.NotEmpty(t, cookies)
+
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/abc", nil)
+		for _, ck := range cookies {
+			req.AddCookie(ck)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, first, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,238 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/webhook"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const webhooksKey contextKey = "webhooks"
+
+const maxWebhooksPerUser = 10
+
+// WebhookRoutes mounts the webhook API of the user of the request.
+func WebhookRoutes(urlStorage storage.URLStorage, hooks *webhook.Dispatcher) func(chi.Router) {
+	return func(r chi.Router) {
+		r.Post("/", CreateWebhook(urlStorage, hooks))
+		r.Get("/", GetWebhooks(urlStorage))
+		r.Get("/dead-letters", GetDeadLetters(hooks))
+		r.Post("/dead-letters/{delivery}/retry", RetryDeadLetter(hooks))
+		r.Delete("/{webhook}", DeleteWebhook(urlStorage, hooks))
+		r.Get("/{webhook}/deliveries", GetWebhookDeliveries(urlStorage, hooks))
+	}
+}
+
+// Webhooks makes handlers notify hooks of the events of links.
+func Webhooks(hooks *webhook.Dispatcher) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), webhooksKey, hooks)))
+		})
+	}
+}
+
+// notifyWebhooks queues event of link for the webhooks of its owner.
+func notifyWebhooks(r *http.Request, event string, link storage.Link, variant string) {
+	if hooks, ok := r.Context().Value(webhooksKey).(*webhook.Dispatcher); ok {
+		hooks.Notify(event, link, variant)
+	}
+}
+
+type WebhookRequestJSON struct {
+	URL string `json:"url"`
+	// Events defaults to all events.
+	Events []string `json:"events,omitempty"`
+}
+
+// CreateWebhook subscribes a URL to events of the links of the user. The
+// URL must resolve to public addresses only. The secret signing the
+// deliveries is only returned here.
+func CreateWebhook(urlStorage storage.URLStorage, hooks *webhook.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req WebhookRequestJSON
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return
+		}
+		target, err := url.Parse(req.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			http.Error(w, "400 url must be an absolute http or https URL", http.StatusBadRequest)
+			return
+		}
+		events := req.Events
+		if len(events) == 0 {
+			events = webhook.Events
+		}
+		for _, e := range events {
+			if !webhook.ValidEvent(e) {
+				http.Error(w, "400 unknown event "+e, http.StatusBadRequest)
+				return
+			}
+		}
+		if err := hooks.CheckDestination(r.Context(), target.String()); err != nil {
+			if errors.Is(err, webhook.ErrForbiddenDestination) {
+				http.Error(w, "400 url must point to a public address", http.StatusBadRequest)
+			} else {
+				http.Error(w, "400 url host cannot be resolved", http.StatusBadRequest)
+			}
+			return
+		}
+
+		hooks, err := urlStorage.GetWebhooks(u.UserID)
+		if err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		if len(hooks) >= maxWebhooksPerUser {
+			http.Error(w, "409 too many webhooks", http.StatusConflict)
+			return
+		}
+		hook := storage.Webhook{
+			ID:        uuid.New(),
+			UserID:    u.UserID,
+			URL:       target.String(),
+			Secret:    randomToken(),
+			Events:    events,
+			CreatedAt: time.Now(),
+		}
+		if err := urlStorage.AddWebhook(hook); err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		b, _ := json.Marshal(hook)
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}
+}
+
+// GetWebhooks lists the webhooks of the user without their secrets.
+func GetWebhooks(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		hooks, err := urlStorage.GetWebhooks(u.UserID)
+		if err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		if hooks == nil {
+			hooks = []storage.Webhook{}
+		}
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		writeJSON(w, hooks)
+	}
+}
+
+// DeleteWebhook unsubscribes a webhook and drops its pending deliveries.
+func DeleteWebhook(urlStorage storage.URLStorage, hooks *webhook.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(chi.URLParam(r, "webhook"))
+		if err != nil {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		err = urlStorage.DeleteWebhook(u.UserID, id)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		hooks.Forget(u.UserID, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GetWebhookDeliveries returns the latest deliveries to a webhook of the
+// user, newest first.
+func GetWebhookDeliveries(urlStorage storage.URLStorage, hooks *webhook.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(chi.URLParam(r, "webhook"))
+		if err != nil {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		owned, err := urlStorage.GetWebhooks(u.UserID)
+		if err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		for _, hook := range owned {
+			if hook.ID == id {
+				writeJSON(w, hooks.History(id))
+				return
+			}
+		}
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	}
+}
+
+// GetDeadLetters returns the deliveries to webhooks of the user that failed
+// all their attempts, newest first.
+func GetDeadLetters(hooks *webhook.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, hooks.DeadLetters(u.UserID))
+	}
+}
+
+// RetryDeadLetter queues a dead letter of the user again.
+func RetryDeadLetter(hooks *webhook.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetRequestUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(chi.URLParam(r, "delivery"))
+		if err != nil {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		err = hooks.Retry(u.UserID, id)
+		if errors.Is(err, webhook.ErrQueueFull) {
+			http.Error(w, "429 too many pending deliveries", http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
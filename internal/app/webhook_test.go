@@ -0,0 +1,175 @@
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/Antony8720/url-shortener/internal/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhooks(t *testing.T) {
+	type delivery struct {
+		event   string
+		payload webhook.Payload
+	}
+	secret := make(chan string, 1)
+	received := make(chan delivery, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s := <-secret
+		secret <- s
+		if !webhook.Verify(s, r.Header.Get(webhook.TimestampHeader), body, r.Header.Get(webhook.SignatureHeader)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var p webhook.Payload
+		require.NoError(t, json.Unmarshal(body, &p))
+		received <- delivery{event: r.Header.Get(webhook.EventHeader), payload: p}
+	}))
+	defer receiver.Close()
+
+	urlStorage := storage.NewDataStorage()
+	// the receiver listens on a loopback address
+	hooks := webhook.NewDispatcher(urlStorage, webhook.Options{AllowPrivate: true})
+	defer hooks.Close()
+	r := MainRouter(urlStorage, config.Cfg{BaseURL: "http://short.test"}, audit.NewMemoryLog(), hooks, RateLimiters{}, nil)
+	u := user.New()
+	value, err := u.UserEncryptEncodeToString()
+	require.NoError(t, err)
+	cookie := &http.Cookie{Name: "Authorization", Value: value}
+	do := func(method, path, body string, c *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if c != nil {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	next := func() delivery {
+		select {
+		case d := <-received:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatal("delivery not received")
+			return delivery{}
+		}
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/user/webhooks", `{"url":"ftp://crm.test"}`, cookie).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/user/webhooks", `{"url":"https://crm.test","events":["link.updated"]}`, cookie).Code)
+	w := do("POST", "/api/user/webhooks", `{"url":"`+receiver.URL+`"}`, cookie)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var hook storage.Webhook
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &hook))
+	require.NotEmpty(t, hook.Secret)
+	assert.Equal(t, webhook.Events, hook.Events)
+	secret <- hook.Secret
+
+	w = do("GET", "/api/user/webhooks", "", cookie)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), hook.ID.String())
+	assert.NotContains(t, w.Body.String(), hook.Secret)
+
+	w = do("POST", "/api/shorten", `{"url":"https://crm-campaign.ru"}`, cookie)
+	require.Equal(t, http.StatusCreated, w.Code)
+	created := next()
+	assert.Equal(t, webhook.EventCreated, created.event)
+	assert.Equal(t, "https://crm-campaign.ru", created.payload.Link.Long)
+	short := created.payload.Link.Short
+
+	require.Equal(t, http.StatusTemporaryRedirect, do("GET", "/"+short, "", nil).Code)
+	clicked := next()
+	assert.Equal(t, webhook.EventClicked, clicked.event)
+	assert.Equal(t, short, clicked.payload.Link.Short)
+
+	require.Equal(t, http.StatusAccepted, do("DELETE", "/api/user/urls", `["`+short+`"]`, cookie).Code)
+	deleted := next()
+	assert.Equal(t, webhook.EventDeleted, deleted.event)
+
+	require.Eventually(t, func() bool {
+		w := do("GET", "/api/user/webhooks/"+hook.ID.String()+"/deliveries", "", cookie)
+		var history []webhook.Delivery
+		json.Unmarshal(w.Body.Bytes(), &history)
+		return len(history) == 3 && history[0].Event == webhook.EventDeleted && history[0].Status == webhook.StatusDelivered
+	}, time.Second, 10*time.Millisecond)
+
+	stranger := user.New()
+	value, err = stranger.UserEncryptEncodeToString()
+	require.NoError(t, err)
+	strangerCookie := &http.Cookie{Name: "Authorization", Value: value}
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/user/webhooks/"+hook.ID.String()+"/deliveries", "", strangerCookie).Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/api/user/webhooks/"+hook.ID.String(), "", strangerCookie).Code)
+	w = do("GET", "/api/user/webhooks/dead-letters", "", cookie)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/user/webhooks/"+hook.ID.String(), "", cookie).Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/user/webhooks/"+hook.ID.String()+"/deliveries", "", cookie).Code)
+}
+
+func TestWebhookMustBePublic(t *testing.T) {
+	r := newTestRouter(t, storage.NewDataStorage(), config.Cfg{})
+	for _, target := range []string{"http://127.0.0.1:8080/hook", "http://169.254.169.254/latest", "http://10.0.0.1/hook"} {
+		req := httptest.NewRequest("POST", "/api/user/webhooks", strings.NewReader(`{"url":"`+target+`"}`))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, target)
+		assert.Contains(t, w.Body.String(), "public address", target)
+	}
+}
+
+func TestWorkspaceWebhooks(t *testing.T) {
+	received := make(chan webhook.Payload, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p webhook.Payload
+		json.NewDecoder(r.Body).Decode(&p)
+		received <- p
+	}))
+	defer receiver.Close()
+
+	urlStorage := storage.NewDataStorage()
+	hooks := webhook.NewDispatcher(urlStorage, webhook.Options{AllowPrivate: true})
+	defer hooks.Close()
+	r := MainRouter(urlStorage, config.Cfg{BaseURL: "http://short.test"}, audit.NewMemoryLog(), hooks, RateLimiters{}, nil)
+	do := func(method, path, body string, c *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.AddCookie(c)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	owner, editor := user.New(), user.New()
+	ownerCookie, editorCookie := userCookie(t, owner.UserID), userCookie(t, editor.UserID)
+
+	w := do("POST", "/api/workspaces", `{"name":"Marketing"}`, ownerCookie)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var ws storage.Membership
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ws))
+	base := "/api/workspaces/" + ws.ID.String()
+	require.Equal(t, http.StatusOK, do("PUT", base+"/members", `{"user_id":"`+editor.UserID.String()+`","role":"editor"}`, ownerCookie).Code)
+
+	assert.Equal(t, http.StatusForbidden, do("POST", base+"/webhooks", `{"url":"`+receiver.URL+`"}`, editorCookie).Code)
+	require.Equal(t, http.StatusCreated, do("POST", base+"/webhooks", `{"url":"`+receiver.URL+`"}`, ownerCookie).Code)
+	w = do("GET", "/api/user/webhooks", "", ownerCookie)
+	assert.JSONEq(t, `[]`, w.Body.String(), "workspace webhooks are not the owner's")
+
+	require.Equal(t, http.StatusCreated, do("POST", base+"/shorten", `{"url":"https://campaign.ru"}`, editorCookie).Code)
+	select {
+	case p := <-received:
+		assert.Equal(t, "https://campaign.ru", p.Link.Long)
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery not received")
+	}
+}
@@ -0,0 +1,330 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Antony8720/url-shortener/internal/audit"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/Antony8720/url-shortener/internal/webhook"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const workspaceKey contextKey = "workspace"
+
+const (
+	maxWorkspaceName = 100
+	// maxWorkspaceBody bounds the body of workspace and member requests.
+	maxWorkspaceBody = 4 << 10
+)
+
+// WorkspaceRoutes mounts the workspace API. The link endpoints of a
+// workspace are the user link endpoints acting as the workspace, guarded by
+// the role they need and limited by the shortening and batch limiters. The
+// webhooks of a workspace, which receive the events of its links, are
+// managed by its owners.
+func WorkspaceRoutes(urlStorage storage.URLStorage, baseURL string, hooks *webhook.Dispatcher, shortenLimiter, batchLimiter *RateLimiter) func(chi.Router) {
+	viewer := WorkspaceRole(urlStorage, storage.RoleViewer)
+	editor := WorkspaceRole(urlStorage, storage.RoleEditor)
+	owner := WorkspaceRole(urlStorage, storage.RoleOwner)
+	shortenLimit := shortenLimiter.Handler
+	batchLimit := batchLimiter.WeightedHandler(batchWeight)
+	return func(r chi.Router) {
+		r.Post("/", CreateWorkspace(urlStorage))
+		r.Get("/", GetWorkspaces(urlStorage))
+		r.Route("/{workspace}", func(r chi.Router) {
+			r.With(viewer).Get("/members", GetWorkspaceMembers(urlStorage))
+			r.With(owner).Put("/members", SetWorkspaceMember(urlStorage))
+			r.With(viewer).Delete("/members/{user}", RemoveWorkspaceMember(urlStorage))
+
+			r.With(editor, shortenLimit).Post("/shorten", SaveJSONLongURL(urlStorage, baseURL))
+			r.With(editor, batchLimit).Post("/shorten/batch", SaveBatch(urlStorage, baseURL))
+			r.With(viewer).Get("/urls", GetUserURLs(urlStorage, baseURL))
+			r.With(editor).Delete("/urls", DeleteUserURLs(urlStorage))
+			r.With(editor).Patch("/urls/{url}", UpdateUserURL(urlStorage, baseURL))
+			r.With(viewer).Get("/urls/{url}/clicks", GetURLClicks(urlStorage))
+			r.With(editor).Post("/urls/import", ImportUserURLs(urlStorage, shortenLimiter))
+			r.With(viewer).Get("/urls/export", ExportUserURLs(urlStorage, baseURL))
+			r.Route("/urls/{url}/rules", func(r chi.Router) {
+				r.With(viewer).Get("/", GetURLRules(urlStorage))
+				r.With(editor).Put("/", SetURLRules(urlStorage))
+				r.With(editor).Delete("/", DeleteURLRules(urlStorage))
+			})
+			r.Route("/urls/{url}/variants", func(r chi.Router) {
+				r.With(viewer).Get("/", GetURLVariants(urlStorage))
+				r.With(editor).Put("/", SetURLVariants(urlStorage))
+				r.With(editor).Delete("/", DeleteURLVariants(urlStorage))
+			})
+			r.With(owner).Route("/webhooks", WebhookRoutes(urlStorage, hooks))
+		})
+	}
+}
+
+// WorkspaceRole allows only members of the workspace in the URL having at
+// least the role min, and makes the request act as the workspace.
+func WorkspaceRole(urlStorage storage.URLStorage, min storage.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, ok := cookieUser(r)
+			if !ok {
+				http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+				return
+			}
+			id, err := uuid.Parse(chi.URLParam(r, "workspace"))
+			if err != nil {
+				http.Error(w, "404 page not found", http.StatusNotFound)
+				return
+			}
+			members, err := urlStorage.GetMembers(id)
+			role := memberRole(members, u.UserID)
+			if err != nil || role == "" {
+				http.Error(w, "404 page not found", http.StatusNotFound)
+				return
+			}
+			if !role.Allows(min) {
+				http.Error(w, "403 forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), workspaceKey, id)))
+		})
+	}
+}
+
+// requestWorkspace returns the workspace set by WorkspaceRole.
+func requestWorkspace(r *http.Request) uuid.UUID {
+	id, _ := r.Context().Value(workspaceKey).(uuid.UUID)
+	return id
+}
+
+func memberRole(members []storage.Member, userID uuid.UUID) storage.Role {
+	for _, m := range members {
+		if m.UserID == userID {
+			return m.Role
+		}
+	}
+	return ""
+}
+
+func countOwners(members []storage.Member) int {
+	n := 0
+	for _, m := range members {
+		if m.Role == storage.RoleOwner {
+			n++
+		}
+	}
+	return n
+}
+
+type WorkspaceRequestJSON struct {
+	Name string `json:"name"`
+}
+
+// CreateWorkspace creates a workspace owned by the user of the request.
+func CreateWorkspace(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := cookieUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req WorkspaceRequestJSON
+		r.Body = http.MaxBytesReader(w, r.Body, maxWorkspaceBody)
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if name == "" || utf8.RuneCountInString(name) > maxWorkspaceName {
+			http.Error(w, "400 name must be 1 to 100 characters long", http.StatusBadRequest)
+			return
+		}
+
+		ws := storage.Workspace{ID: uuid.New(), Name: name, CreatedAt: time.Now()}
+		if err := urlStorage.CreateWorkspace(ws, u.UserID); err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		recordMemberEvent(r, audit.ActionCreate, ws.ID, nil, &storage.Member{UserID: u.UserID, Role: storage.RoleOwner})
+		b, _ := json.Marshal(storage.Membership{Workspace: ws, Role: storage.RoleOwner})
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}
+}
+
+// GetWorkspaces lists the workspaces of the user with the user's roles.
+func GetWorkspaces(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, ok := cookieUser(r)
+		if !ok {
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		workspaces, err := urlStorage.GetWorkspaces(u.UserID)
+		if err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		if workspaces == nil {
+			workspaces = []storage.Membership{}
+		}
+		writeJSON(w, workspaces)
+	}
+}
+
+func GetWorkspaceMembers(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		members, err := urlStorage.GetMembers(requestWorkspace(r))
+		if err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, members)
+	}
+}
+
+// MemberRequestJSON invites a user to a workspace or changes the role of a
+// member. The user is given by the username of its account or by its ID.
+type MemberRequestJSON struct {
+	Username string       `json:"username,omitempty"`
+	UserID   string       `json:"user_id,omitempty"`
+	Role     storage.Role `json:"role"`
+}
+
+// SetWorkspaceMember adds a member to the workspace or changes its role.
+// The last owner cannot be demoted.
+func SetWorkspaceMember(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req MemberRequestJSON
+		r.Body = http.MaxBytesReader(w, r.Body, maxWorkspaceBody)
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "400 bad request", http.StatusBadRequest)
+			return
+		}
+		if !req.Role.Valid() {
+			http.Error(w, "400 role must be owner, editor or viewer", http.StatusBadRequest)
+			return
+		}
+		var member storage.Member
+		switch {
+		case req.Username != "":
+			account, ok := urlStorage.GetAccount(req.Username)
+			if !ok {
+				http.Error(w, "404 user not found", http.StatusNotFound)
+				return
+			}
+			member.UserID = account.UserID
+		default:
+			id, err := uuid.Parse(req.UserID)
+			if err != nil || id == uuid.Nil {
+				http.Error(w, "400 username or user_id is required", http.StatusBadRequest)
+				return
+			}
+			member.UserID = id
+		}
+		member.Role = req.Role
+
+		workspaceID := requestWorkspace(r)
+		members, err := urlStorage.GetMembers(workspaceID)
+		if err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		role := memberRole(members, member.UserID)
+		if role == storage.RoleOwner && member.Role != storage.RoleOwner && countOwners(members) == 1 {
+			http.Error(w, "409 workspace needs an owner", http.StatusConflict)
+			return
+		}
+		if err := urlStorage.SetMember(workspaceID, member); err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		if role == "" {
+			recordMemberEvent(r, audit.ActionCreate, workspaceID, nil, &member)
+		} else if role != member.Role {
+			recordMemberEvent(r, audit.ActionUpdate, workspaceID, &storage.Member{UserID: member.UserID, Role: role}, &member)
+		}
+		writeJSON(w, member)
+	}
+}
+
+// RemoveWorkspaceMember removes a member from the workspace. Owners can
+// remove anyone, other members only themselves. The last owner cannot be
+// removed.
+func RemoveWorkspaceMember(urlStorage storage.URLStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, _ := cookieUser(r)
+		userID, err := uuid.Parse(chi.URLParam(r, "user"))
+		if err != nil {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+
+		workspaceID := requestWorkspace(r)
+		members, err := urlStorage.GetMembers(workspaceID)
+		if err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		if userID != u.UserID && memberRole(members, u.UserID) != storage.RoleOwner {
+			http.Error(w, "403 forbidden", http.StatusForbidden)
+			return
+		}
+		role := memberRole(members, userID)
+		if role == storage.RoleOwner && countOwners(members) == 1 {
+			http.Error(w, "409 workspace needs an owner", http.StatusConflict)
+			return
+		}
+		err = urlStorage.RemoveMember(workspaceID, userID)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "404 page not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "500 storage error", http.StatusInternalServerError)
+			return
+		}
+		recordMemberEvent(r, audit.ActionDelete, workspaceID, &storage.Member{UserID: userID, Role: role}, nil)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// recordMemberEvent records a change of a membership in the workspace.
+// before is nil for added members and after for removed ones.
+func recordMemberEvent(r *http.Request, action audit.Action, workspaceID uuid.UUID, before, after *storage.Member) {
+	e := audit.Event{Action: action}
+	if before != nil {
+		e.Before = memberState(workspaceID, *before)
+	}
+	if after != nil {
+		e.After = memberState(workspaceID, *after)
+	}
+	recordEvent(r, e)
+}
+
+func memberState(workspaceID uuid.UUID, m storage.Member) json.RawMessage {
+	b, _ := json.Marshal(map[string]any{"workspace_id": workspaceID, "user_id": m.UserID, "role": m.Role})
+	return b
+}
+
+// cookieUser returns the user of the Authorization cookie, also on
+// workspace routes.
+func cookieUser(r *http.Request) (u user.User, ok bool) {
+	ck, err := r.Cookie(authCookieName)
+	if err != nil {
+		return user.User{}, false
+	}
+	if err := u.UserDecryptDecodeFromString(ck.Value); err != nil {
+		return user.User{}, false
+	}
+	return u, true
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkspaces(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	r := newTestRouter(t, urlStorage, config.Cfg{BaseURL: "http://short.test"})
+	do := func(method, path, body string, c *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if c != nil {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	newUser := func() (*http.Cookie, string) {
+		u := user.New()
+		value, err := u.UserEncryptEncodeToString()
+		require.NoError(t, err)
+		return &http.Cookie{Name: "Authorization", Value: value}, u.UserID.String()
+	}
+	owner, ownerID := newUser()
+	editor, editorID := newUser()
+	viewer, viewerID := newUser()
+	stranger, _ := newUser()
+
+	w := do("POST", "/api/workspaces", `{"name":"Marketing"}`, owner)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var ws storage.Membership
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ws))
+	assert.Equal(t, storage.RoleOwner, ws.Role)
+	base := "/api/workspaces/" + ws.ID.String()
+
+	assert.Equal(t, http.StatusNotFound, do("PUT", base+"/members", `{"user_id":"`+editorID+`","role":"editor"}`, stranger).Code)
+	require.Equal(t, http.StatusOK, do("PUT", base+"/members", `{"user_id":"`+editorID+`","role":"editor"}`, owner).Code)
+	require.Equal(t, http.StatusOK, do("PUT", base+"/members", `{"user_id":"`+viewerID+`","role":"viewer"}`, owner).Code)
+	assert.Equal(t, http.StatusBadRequest, do("PUT", base+"/members", `{"user_id":"`+viewerID+`","role":"admin"}`, owner).Code)
+	assert.Equal(t, http.StatusForbidden, do("PUT", base+"/members", `{"user_id":"`+viewerID+`","role":"owner"}`, editor).Code)
+
+	w = do("POST", base+"/shorten", `{"url":"https://campaign.ru"}`, editor)
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, http.StatusForbidden, do("POST", base+"/shorten", `{"url":"https://other.ru"}`, viewer).Code)
+
+	w = do("GET", base+"/urls", "", viewer)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "https://campaign.ru")
+	assert.Equal(t, http.StatusNotFound, do("GET", base+"/urls", "", stranger).Code)
+	assert.Equal(t, http.StatusNoContent, do("GET", "/api/user/urls", "", editor).Code, "workspace links are not personal links")
+
+	links, err := urlStorage.GetUserLinks(ws.ID, storage.LinkFilter{})
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+	short := links[0].Short
+	assert.Equal(t, http.StatusForbidden, do("PATCH", base+"/urls/"+short, `{"title":"x"}`, viewer).Code)
+	assert.Equal(t, http.StatusOK, do("PATCH", base+"/urls/"+short, `{"title":"Spring"}`, editor).Code)
+	assert.Equal(t, http.StatusNotFound, do("PATCH", "/api/user/urls/"+short, `{"title":"x"}`, editor).Code)
+
+	rules := `[{"languages":["de"],"destination":"https://campaign.de"}]`
+	assert.Equal(t, http.StatusForbidden, do("PUT", base+"/urls/"+short+"/rules", rules, viewer).Code)
+	assert.Equal(t, http.StatusOK, do("PUT", base+"/urls/"+short+"/rules", rules, editor).Code)
+	assert.JSONEq(t, rules, do("GET", base+"/urls/"+short+"/rules", "", viewer).Body.String())
+	variants := `{"variants":[{"name":"a","destination":"https://a.campaign.ru","weight":1}]}`
+	assert.Equal(t, http.StatusForbidden, do("PUT", base+"/urls/"+short+"/variants", variants, viewer).Code)
+	assert.Equal(t, http.StatusOK, do("PUT", base+"/urls/"+short+"/variants", variants, editor).Code)
+	w = do("GET", base+"/urls/export", "", viewer)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "https://campaign.ru")
+	assert.Equal(t, http.StatusForbidden, do("POST", base+"/urls/import", "original_url\nhttps://b.ru\n", viewer).Code)
+
+	w = do("GET", "/api/workspaces", "", viewer)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"role":"viewer"`)
+
+	var members []storage.Member
+	require.NoError(t, json.Unmarshal(do("GET", base+"/members", "", viewer).Body.Bytes(), &members))
+	assert.Len(t, members, 3)
+	assert.Equal(t, http.StatusConflict, do("DELETE", base+"/members/"+ownerID, "", owner).Code)
+	assert.Equal(t, http.StatusForbidden, do("DELETE", base+"/members/"+editorID, "", viewer).Code)
+	assert.Equal(t, http.StatusNoContent, do("DELETE", base+"/members/"+viewerID, "", viewer).Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", base+"/urls", "", viewer).Code)
+}
@@ -0,0 +1,103 @@
+// Package audit keeps a trail of who created, changed, deleted or
+// reassigned links and who changed the members of workspaces.
+//
+// Events are kept apart from the links: in the audit_log table when the
+// links are in PostgreSQL, in an append-only file of JSON lines when a file
+// is configured, and in memory otherwise.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Action is what happened to a link or a workspace member.
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+	// ActionReassign moves a link, or with an empty Short all links of a
+	// user, to another owner.
+	ActionReassign Action = "reassign"
+)
+
+// Event is an entry of the audit log. Before and After hold the state of
+// the link as JSON, they are empty for created and deleted links
+// respectively. Events of workspace members have no Short and hold the
+// workspace ID, user ID and role of the member instead.
+type Event struct {
+	Time      time.Time       `json:"time"`
+	Actor     uuid.UUID       `json:"actor"`
+	RequestID string          `json:"request_id,omitempty"`
+	IP        string          `json:"ip,omitempty"`
+	Action    Action          `json:"action"`
+	Short     string          `json:"short,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+}
+
+// Filter selects events. Zero values match everything; Since is inclusive
+// and Until exclusive.
+type Filter struct {
+	Since time.Time
+	Until time.Time
+	Actor uuid.UUID
+	Short string
+	// Limit caps the number of events returned, oldest first.
+	Limit int
+}
+
+func (f Filter) match(e Event) bool {
+	return (f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until)) &&
+		(f.Actor == uuid.Nil || e.Actor == f.Actor) &&
+		(f.Short == "" || e.Short == f.Short)
+}
+
+// Log stores events.
+type Log interface {
+	Record(Event) error
+	Query(context.Context, Filter) ([]Event, error)
+	Close() error
+}
+
+// ErrNotPersistent is returned by New when links are stored in a file but
+// the audit log would only be kept in memory.
+var ErrNotPersistent = errors.New("links are stored in a file but no audit file is configured, set -audit-file / AUDIT_FILE")
+
+// New opens the audit log that goes with the storage configured by cfg.
+// Links kept in a file need an audit file, so that their trail is not lost
+// on restart.
+func New(cfg config.Cfg) (Log, error) {
+	if cfg.DBAddress != "" {
+		return NewDatabaseLog(cfg.DBAddress)
+	}
+	if cfg.AuditFile != "" {
+		return NewFileLog(cfg.AuditFile)
+	}
+	if cfg.Filepath != "" {
+		return nil, ErrNotPersistent
+	}
+	return NewMemoryLog(), nil
+}
+
+// LinkState returns the state of a link to put in an event. Password hashes
+// are masked.
+func LinkState(link storage.Link) json.RawMessage {
+	if link.PasswordHash != "" {
+		link.PasswordHash = "***"
+	}
+	b, err := json.Marshal(link)
+	if err != nil {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/config"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	actor := uuid.New()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	l, err := NewFileLog(path)
+	require.NoError(t, err)
+	for i, action := range []Action{ActionCreate, ActionUpdate, ActionDelete} {
+		require.NoError(t, l.Record(Event{
+			Time:   start.Add(time.Duration(i) * time.Hour),
+			Actor:  actor,
+			Action: action,
+			Short:  "abc",
+			Before: LinkState(storage.Link{Short: "abc"}),
+		}))
+	}
+	require.NoError(t, l.Record(Event{Time: start, Actor: uuid.New(), Action: ActionCreate, Short: "xyz"}))
+	require.NoError(t, l.Close())
+
+	l, err = NewFileLog(path)
+	require.NoError(t, err)
+	defer l.Close()
+	events, err := l.Query(context.Background(), Filter{})
+	require.NoError(t, err)
+	assert.Len(t, events, 4)
+
+	events, err = l.Query(context.Background(), Filter{Since: start.Add(time.Hour), Until: start.Add(2 * time.Hour)})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, ActionUpdate, events[0].Action)
+	assert.Contains(t, string(events[0].Before), `"short":"abc"`)
+
+	events, err = l.Query(context.Background(), Filter{Actor: actor, Limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+	events, err = l.Query(context.Background(), Filter{Short: "xyz"})
+	require.NoError(t, err)
+	assert.Len(t, events, 1)
+}
+
+func TestLinkStateMasksPassword(t *testing.T) {
+	state := LinkState(storage.Link{Short: "abc", LinkOptions: storage.LinkOptions{PasswordHash: "$2a$10$secret"}})
+	assert.NotContains(t, string(state), "secret")
+	assert.Contains(t, string(state), `"password_hash":"***"`)
+}
+
+func TestNewNeedsAuditFileForFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	_, err := New(config.Cfg{Filepath: filepath.Join(dir, "urls.log")})
+	assert.ErrorIs(t, err, ErrNotPersistent)
+
+	l, err := New(config.Cfg{Filepath: filepath.Join(dir, "urls.log"), AuditFile: filepath.Join(dir, "audit.log")})
+	require.NoError(t, err)
+	assert.IsType(t, &FileLog{}, l)
+	require.NoError(t, l.Close())
+
+	_, err = New(config.Cfg{AuditFile: filepath.Join(dir, "missing", "audit.log")})
+	assert.Error(t, err)
+}
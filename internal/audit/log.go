@@ -0,0 +1,209 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// MemoryLog keeps events in memory, they are lost on restart.
+type MemoryLog struct {
+	mu     sync.RWMutex
+	events []Event
+}
+
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{}
+}
+
+func (l *MemoryLog) Record(e Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+	return nil
+}
+
+func (l *MemoryLog) Query(ctx context.Context, f Filter) ([]Event, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var result []Event
+	for _, e := range l.events {
+		if f.Limit > 0 && len(result) == f.Limit {
+			break
+		}
+		if f.match(e) {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+func (l *MemoryLog) Close() error {
+	return nil
+}
+
+// FileLog appends events as JSON lines to a file. Queries read the whole
+// file.
+type FileLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileLog(path string) (*FileLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLog{file: file}, nil
+}
+
+func (l *FileLog) Record(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+func (l *FileLog) Query(ctx context.Context, f Filter) ([]Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sc := bufio.NewScanner(io.NewSectionReader(l.file, 0, 1<<62))
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	var result []Event
+	for sc.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		if f.match(e) {
+			result = append(result, e)
+			if f.Limit > 0 && len(result) == f.Limit {
+				break
+			}
+		}
+	}
+	return result, sc.Err()
+}
+
+func (l *FileLog) Close() error {
+	return l.file.Close()
+}
+
+// DatabaseLog stores events in the audit_log table.
+type DatabaseLog struct {
+	db *pgxpool.Pool
+}
+
+func NewDatabaseLog(DBAddress string) (*DatabaseLog, error) {
+	db, err := pgxpool.Connect(context.Background(), DBAddress)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(context.Background(),
+		`CREATE TABLE IF NOT EXISTS audit_log
+		 (
+		 id bigint NOT NULL GENERATED ALWAYS AS IDENTITY,
+		 at timestamptz NOT NULL,
+		 actor uuid NOT NULL,
+		 request_id text NOT NULL DEFAULT '',
+		 ip text NOT NULL DEFAULT '',
+		 action text NOT NULL,
+		 short_url text NOT NULL DEFAULT '',
+		 before jsonb,
+		 after jsonb,
+		 PRIMARY KEY (id));
+		 CREATE INDEX IF NOT EXISTS audit_log_at_idx on audit_log(at);`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DatabaseLog{db: db}, nil
+}
+
+func (l *DatabaseLog) Record(e Event) error {
+	_, err := l.db.Exec(context.Background(),
+		`INSERT INTO audit_log (at, actor, request_id, ip, action, short_url, before, after)
+		 VALUES ($1::timestamptz, $2::uuid, $3::text, $4::text, $5::text, $6::text, $7::jsonb, $8::jsonb)`,
+		e.Time, e.Actor, e.RequestID, e.IP, string(e.Action), e.Short, nullJSON(e.Before), nullJSON(e.After))
+	return err
+}
+
+func nullJSON(raw json.RawMessage) *string {
+	if len(raw) == 0 {
+		return nil
+	}
+	s := string(raw)
+	return &s
+}
+
+func (l *DatabaseLog) Query(ctx context.Context, f Filter) ([]Event, error) {
+	var limit *int
+	if f.Limit > 0 {
+		limit = &f.Limit
+	}
+	rows, err := l.db.Query(ctx,
+		`SELECT at, actor, request_id, ip, action, short_url, before::text, after::text
+		 FROM audit_log
+		 WHERE ($1::timestamptz IS NULL OR at >= $1::timestamptz)
+		 AND ($2::timestamptz IS NULL OR at < $2::timestamptz)
+		 AND ($3::uuid IS NULL OR actor = $3::uuid)
+		 AND ($4::text = '' OR short_url = $4::text)
+		 ORDER BY at, id
+		 LIMIT $5::integer`,
+		nullTime(f.Since), nullTime(f.Until), nullUUID(f.Actor), f.Short, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Event
+	for rows.Next() {
+		var e Event
+		var action string
+		var before, after *string
+		if err := rows.Scan(&e.Time, &e.Actor, &e.RequestID, &e.IP, &action, &e.Short, &before, &after); err != nil {
+			return nil, err
+		}
+		e.Action = Action(action)
+		if before != nil {
+			e.Before = json.RawMessage(*before)
+		}
+		if after != nil {
+			e.After = json.RawMessage(*after)
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
+
+func (l *DatabaseLog) Close() error {
+	l.db.Close()
+	return nil
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func nullUUID(id uuid.UUID) *uuid.UUID {
+	if id == uuid.Nil {
+		return nil
+	}
+	return &id
+}
@@ -0,0 +1,288 @@
+// Package backup writes and restores point-in-time snapshots of a
+// storage.URLStorage.
+//
+// A backup is a gzip compressed stream of JSON lines: a header with the
+// format version, one line per record, and a trailer with the number of
+// links, accounts, workspaces and webhooks and the SHA-256 checksum of the
+// record lines. A record holds a link with its owner and settings, an
+// account, a workspace with its members or a webhook with its secret.
+// Version 1 backups hold bare links only, version 2 backups no webhooks.
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/storage"
+)
+
+const (
+	// Format identifies backup files.
+	Format = "url-shortener-backup"
+	// Version is the version of the format written by Write.
+	Version = 3
+)
+
+// maxLine bounds a line of a backup, which holds a single record.
+const maxLine = 1 << 20
+
+// ErrNotEmpty is returned by Restore when the target storage has links.
+var ErrNotEmpty = errors.New("restore needs an empty storage")
+
+// Header is the first line of a backup.
+type Header struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Trailer is the last line of a backup. Count is the number of links.
+type Trailer struct {
+	Count      int    `json:"count"`
+	Accounts   int    `json:"accounts,omitempty"`
+	Workspaces int    `json:"workspaces,omitempty"`
+	Webhooks   int    `json:"webhooks,omitempty"`
+	SHA256     string `json:"sha256"`
+}
+
+// Record is a line of a backup between the header and the trailer. Exactly
+// one of its fields is set.
+type Record struct {
+	Link      *storage.Link    `json:"link,omitempty"`
+	Account   *storage.Account `json:"account,omitempty"`
+	Workspace *Workspace       `json:"workspace,omitempty"`
+	Webhook   *storage.Webhook `json:"webhook,omitempty"`
+}
+
+// Workspace is a workspace with its members.
+type Workspace struct {
+	storage.Workspace
+	Members []storage.Member `json:"members"`
+}
+
+func (rec Record) kinds() int {
+	n := 0
+	if rec.Link != nil {
+		n++
+	}
+	if rec.Account != nil {
+		n++
+	}
+	if rec.Workspace != nil {
+		n++
+	}
+	if rec.Webhook != nil {
+		n++
+	}
+	return n
+}
+
+// Write streams a snapshot of the links of s to w, followed by the
+// accounts, the workspaces and the webhooks as of the same point in time,
+// and returns its trailer. Account passwords are kept as bcrypt hashes,
+// webhook secrets as they are, since deliveries are signed with them.
+func Write(ctx context.Context, w io.Writer, s storage.URLStorage) (Trailer, error) {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	if err := enc.Encode(Header{Format: Format, Version: Version, CreatedAt: time.Now().UTC()}); err != nil {
+		return Trailer{}, err
+	}
+
+	sum := sha256.New()
+	records := json.NewEncoder(io.MultiWriter(gz, sum))
+	var trailer Trailer
+	err := s.Snapshot(ctx, storage.Visitor{
+		Link: func(link storage.Link) error {
+			trailer.Count++
+			return records.Encode(Record{Link: &link})
+		},
+		Account: func(account storage.Account) error {
+			trailer.Accounts++
+			return records.Encode(Record{Account: &account})
+		},
+		Workspace: func(ws storage.Workspace, members []storage.Member) error {
+			trailer.Workspaces++
+			return records.Encode(Record{Workspace: &Workspace{Workspace: ws, Members: members}})
+		},
+		Webhook: func(hook storage.Webhook) error {
+			trailer.Webhooks++
+			return records.Encode(Record{Webhook: &hook})
+		},
+	})
+	if err != nil {
+		return Trailer{}, err
+	}
+	trailer.SHA256 = hex.EncodeToString(sum.Sum(nil))
+
+	if err := enc.Encode(trailer); err != nil {
+		return Trailer{}, err
+	}
+	return trailer, gz.Close()
+}
+
+// read decodes a backup, calling fn for every record, and checks the
+// trailer once all records were read.
+func read(r io.Reader, fn func(Record) error) (Trailer, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return Trailer{}, fmt.Errorf("not a backup: %w", err)
+	}
+	defer gz.Close()
+	sc := bufio.NewScanner(gz)
+	sc.Buffer(make([]byte, 64*1024), maxLine)
+
+	if !sc.Scan() {
+		return Trailer{}, fmt.Errorf("not a backup: %w", scanErr(sc))
+	}
+	var header Header
+	if err := json.Unmarshal(sc.Bytes(), &header); err != nil || header.Format != Format {
+		return Trailer{}, errors.New("not a backup: unknown header")
+	}
+	if header.Version < 1 || header.Version > Version {
+		return Trailer{}, fmt.Errorf("unsupported backup version %d", header.Version)
+	}
+
+	sum := sha256.New()
+	var count Trailer
+	var last []byte
+	for sc.Scan() {
+		if last != nil {
+			rec, err := decodeRecord(last, header.Version)
+			if err != nil {
+				return Trailer{}, fmt.Errorf("record %d: %w", count.Count+count.Accounts+count.Workspaces+count.Webhooks+1, err)
+			}
+			sum.Write(last)
+			sum.Write([]byte{'\n'})
+			switch {
+			case rec.Link != nil:
+				count.Count++
+			case rec.Account != nil:
+				count.Accounts++
+			case rec.Workspace != nil:
+				count.Workspaces++
+			default:
+				count.Webhooks++
+			}
+			if err := fn(rec); err != nil {
+				return Trailer{}, err
+			}
+		}
+		last = append(last[:0], sc.Bytes()...)
+	}
+	if err := sc.Err(); err != nil {
+		return Trailer{}, err
+	}
+
+	var trailer Trailer
+	if last == nil || json.Unmarshal(last, &trailer) != nil || trailer.SHA256 == "" {
+		return Trailer{}, errors.New("backup is truncated")
+	}
+	if trailer.Count != count.Count || trailer.Accounts != count.Accounts || trailer.Workspaces != count.Workspaces || trailer.Webhooks != count.Webhooks || trailer.SHA256 != hex.EncodeToString(sum.Sum(nil)) {
+		return Trailer{}, errors.New("backup checksum mismatch")
+	}
+	return trailer, nil
+}
+
+// decodeRecord decodes a record line of a backup of the given version.
+func decodeRecord(line []byte, version int) (Record, error) {
+	if version == 1 {
+		var link storage.Link
+		if err := json.Unmarshal(line, &link); err != nil {
+			return Record{}, err
+		}
+		return Record{Link: &link}, nil
+	}
+	var rec Record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return Record{}, err
+	}
+	if rec.kinds() != 1 {
+		return Record{}, errors.New("unknown record")
+	}
+	return rec, nil
+}
+
+func scanErr(sc *bufio.Scanner) error {
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// Verify checks the format and checksum of a backup without restoring it.
+func Verify(r io.Reader) (Trailer, error) {
+	return read(r, func(Record) error { return nil })
+}
+
+// Restore verifies the backup in r and then writes its links, accounts,
+// workspaces and webhooks into s, which must be empty. Nothing is written
+// if verification fails.
+func Restore(ctx context.Context, r io.ReadSeeker, s storage.URLStorage) (Trailer, error) {
+	empty, err := isEmpty(ctx, s)
+	if err != nil {
+		return Trailer{}, err
+	}
+	if !empty {
+		return Trailer{}, ErrNotEmpty
+	}
+	if _, err := Verify(r); err != nil {
+		return Trailer{}, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return Trailer{}, err
+	}
+	return read(r, func(rec Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch {
+		case rec.Link != nil:
+			if err := s.AddLink(*rec.Link); err != nil {
+				return fmt.Errorf("restoring %s: %w", rec.Link.Short, err)
+			}
+		case rec.Account != nil:
+			if err := s.CreateAccount(*rec.Account); err != nil {
+				return fmt.Errorf("restoring account %s: %w", rec.Account.Username, err)
+			}
+		case rec.Workspace != nil:
+			if err := storage.AddWorkspace(s, rec.Workspace.Workspace, rec.Workspace.Members); err != nil {
+				return fmt.Errorf("restoring workspace %s: %w", rec.Workspace.ID, err)
+			}
+		case rec.Webhook != nil:
+			if err := s.AddWebhook(*rec.Webhook); err != nil {
+				return fmt.Errorf("restoring webhook %s: %w", rec.Webhook.ID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// errStop ends an iteration early.
+var errStop = errors.New("stop")
+
+// isEmpty reports whether s has no links, accounts, workspaces or webhooks.
+func isEmpty(ctx context.Context, s storage.URLStorage) (bool, error) {
+	n, err := s.CountURLs()
+	if err != nil || n > 0 {
+		return false, err
+	}
+	err = s.EachAccount(ctx, func(storage.Account) error { return errStop })
+	if err == nil {
+		err = s.EachWorkspace(ctx, func(storage.Workspace, []storage.Member) error { return errStop })
+	}
+	if err == nil {
+		err = s.EachWebhook(ctx, func(storage.Webhook) error { return errStop })
+	}
+	if errors.Is(err, errStop) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStorage(t *testing.T) *storage.DataStorage {
+	s := storage.NewDataStorage()
+	userID := uuid.New()
+	require.NoError(t, s.AddLink(storage.Link{
+		UserID:          userID,
+		Short:           "a",
+		Long:            "https://a.ru",
+		CreatedAt:       time.Now().UTC().Truncate(time.Second),
+		Tags:            []string{"x"},
+		RemainingClicks: 1,
+		Variants:        []storage.Variant{{Name: "v", Destination: "https://v.ru", Weight: 1}},
+		LinkOptions:     storage.LinkOptions{Title: "A", PasswordHash: "hash", MaxClicks: 3},
+	}))
+	require.NoError(t, s.Set(uuid.Nil, "b", "https://b.ru"))
+	require.NoError(t, s.CreateAccount(storage.Account{Username: "alice", PasswordHash: "bcrypt", UserID: userID, CreatedAt: time.Now().UTC()}))
+	ws := storage.Workspace{ID: uuid.New(), Name: "Marketing", CreatedAt: time.Now().UTC()}
+	require.NoError(t, s.CreateWorkspace(ws, userID))
+	require.NoError(t, s.SetMember(ws.ID, storage.Member{UserID: uuid.New(), Role: storage.RoleViewer}))
+	require.NoError(t, s.AddWebhook(storage.Webhook{ID: uuid.New(), UserID: userID, URL: "https://hooks.example/a", Secret: "whsec", Events: []string{"link.created"}, CreatedAt: time.Now().UTC()}))
+	return s
+}
+
+func TestBackupRestore(t *testing.T) {
+	source := testStorage(t)
+	var buf bytes.Buffer
+	trailer, err := Write(context.Background(), &buf, source)
+	require.NoError(t, err)
+	assert.Equal(t, 2, trailer.Count)
+	assert.Equal(t, 1, trailer.Accounts)
+	assert.Equal(t, 1, trailer.Workspaces)
+	assert.Equal(t, 1, trailer.Webhooks)
+
+	target := storage.NewDataStorage()
+	restored, err := Restore(context.Background(), bytes.NewReader(buf.Bytes()), target)
+	require.NoError(t, err)
+	assert.Equal(t, trailer, restored)
+	for _, short := range []string{"a", "b"} {
+		want, _ := source.GetLink(short)
+		got, ok := target.GetLink(short)
+		require.True(t, ok)
+		assert.Equal(t, want.Long, got.Long)
+		assert.Equal(t, want.UserID, got.UserID)
+		assert.True(t, want.CreatedAt.Equal(got.CreatedAt))
+	}
+	got, _ := target.GetLink("a")
+	assert.Equal(t, "hash", got.PasswordHash)
+	assert.Equal(t, 1, got.RemainingClicks)
+	assert.Len(t, got.Variants, 1)
+	account, ok := target.GetAccount("alice")
+	require.True(t, ok)
+	assert.Equal(t, "bcrypt", account.PasswordHash)
+	assert.Equal(t, got.UserID, account.UserID)
+	memberships, err := target.GetWorkspaces(account.UserID)
+	require.NoError(t, err)
+	require.Len(t, memberships, 1)
+	assert.Equal(t, storage.RoleOwner, memberships[0].Role)
+	members, err := target.GetMembers(memberships[0].ID)
+	require.NoError(t, err)
+	assert.Len(t, members, 2)
+	hooks, err := target.GetWebhooks(account.UserID)
+	require.NoError(t, err)
+	want, _ := source.GetWebhooks(account.UserID)
+	assert.Equal(t, want, hooks)
+	assert.Equal(t, "whsec", hooks[0].Secret)
+
+	_, err = Restore(context.Background(), bytes.NewReader(buf.Bytes()), target)
+	assert.ErrorIs(t, err, ErrNotEmpty)
+}
+
+func TestRestoreRejectsDamagedBackups(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := Write(context.Background(), &buf, testStorage(t))
+	require.NoError(t, err)
+	gz, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	plain, err := io.ReadAll(gz)
+	require.NoError(t, err)
+
+	compress := func(s string) *bytes.Reader {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		gz.Write([]byte(s))
+		gz.Close()
+		return bytes.NewReader(b.Bytes())
+	}
+	lines := strings.SplitAfter(string(plain), "\n")
+
+	for name, backup := range map[string]string{
+		"tampered":  strings.Replace(string(plain), "https://b.ru", "https://evil.ru", 1),
+		"truncated": strings.Join(lines[:len(lines)-2], ""),
+		"dropped":   lines[0] + strings.Join(lines[2:], ""),
+		"version":   strings.Replace(string(plain), `"version":3`, `"version":99`, 1),
+	} {
+		target := storage.NewDataStorage()
+		_, err := Restore(context.Background(), compress(backup), target)
+		assert.Error(t, err, name)
+		n, _ := target.CountURLs()
+		assert.Zero(t, n, name)
+	}
+}
+
+func TestRestoreVersion1(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(`{"format":"url-shortener-backup","version":1,"created_at":"2024-01-01T00:00:00Z"}` + "\n"))
+	link := `{"userID":"00000000-0000-0000-0000-000000000000","short":"a","long":"https://a.ru","created_at":"2024-01-01T00:00:00Z"}` + "\n"
+	gz.Write([]byte(link))
+	sum := sha256.Sum256([]byte(link))
+	gz.Write([]byte(`{"count":1,"sha256":"` + hex.EncodeToString(sum[:]) + `"}` + "\n"))
+	gz.Close()
+
+	target := storage.NewDataStorage()
+	trailer, err := Restore(context.Background(), bytes.NewReader(buf.Bytes()), target)
+	require.NoError(t, err)
+	assert.Equal(t, 1, trailer.Count)
+	long, ok := target.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, "https://a.ru", long)
+}
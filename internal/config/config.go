@@ -1,68 +1,391 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
+// Cfg holds the server settings. Every value is resolved with the
+// precedence flag > environment variable > config file > default.
 type Cfg struct {
-	Filepath  string
-	Address   string
-	BaseURL   string
-	DBAddress string
-}
-
-func New() Cfg {
-	cfg := Cfg{}
-	flag.StringVar(&cfg.Filepath, "f", "", "path to the file fith shortened URLs")
-	flag.StringVar(&cfg.Address, "a", "", "start address of the HTTP server")
-	flag.StringVar(&cfg.BaseURL, "b", "", "base address of the resulting shortened URL")
-	flag.StringVar(&cfg.DBAddress, "d", "", "DB connection address")
-	flag.Parse()
-	cfg.chooseFilepath()
-	cfg.chooseAddress()
+	ConfigPath string `yaml:"-" json:"-"`
+
+	Filepath  string `yaml:"file_storage_path" json:"file_storage_path"`
+	Address   string `yaml:"server_address" json:"server_address"`
+	BaseURL   string `yaml:"base_url" json:"base_url"`
+	DBAddress string `yaml:"database_dsn" json:"database_dsn"`
+
+	// Rate limits are expressed in requests per minute per client.
+	// Zero disables limiting for the corresponding group of routes.
+	ShortenRateLimit  int `yaml:"shorten_rate_limit" json:"shorten_rate_limit"`
+	BatchRateLimit    int `yaml:"batch_rate_limit" json:"batch_rate_limit"`
+	RedirectRateLimit int `yaml:"redirect_rate_limit" json:"redirect_rate_limit"`
+
+	// EnableHTTPS serves TLS on Address. Without TLSCertFile and TLSKeyFile
+	// a self-signed certificate is generated at startup.
+	EnableHTTPS         bool   `yaml:"enable_https" json:"enable_https"`
+	TLSCertFile         string `yaml:"tls_cert_file" json:"tls_cert_file"`
+	TLSKeyFile          string `yaml:"tls_key_file" json:"tls_key_file"`
+	HTTPRedirectAddress string `yaml:"http_redirect_address" json:"http_redirect_address"`
+
+	// GRPCAddress is the listen address of the gRPC API. Empty disables it.
+	GRPCAddress string `yaml:"grpc_address" json:"grpc_address"`
+
+	// TrustedSubnet is the CIDR allowed to query internal endpoints.
+	// Empty denies access to everyone.
+	TrustedSubnet string `yaml:"trusted_subnet" json:"trusted_subnet"`
+
+	// RedirectStatus is the status of redirects for links that do not set
+	// their own redirect type.
+	RedirectStatus int `yaml:"redirect_status" json:"redirect_status"`
+
+	// LinkAccessSecret signs the cookies granting access to password
+	// protected links. Empty uses a random secret per process.
+	LinkAccessSecret string `yaml:"link_access_secret" json:"link_access_secret"`
+
+	// CookieSecret signs the Authorization cookies identifying users.
+	// Empty uses a random secret per process.
+	CookieSecret string `yaml:"cookie_secret" json:"cookie_secret"`
+
+	// GeoIPDatabase is the path to a MaxMind country database used by
+	// country targeting rules. Empty disables country matching.
+	GeoIPDatabase string `yaml:"geoip_database" json:"geoip_database"`
+
+	// AdminToken is the bearer token of the admin endpoints. Empty
+	// disables them.
+	AdminToken string `yaml:"admin_token" json:"admin_token"`
+
+	// OIDCIssuer is the URL of the OpenID Connect provider users sign in
+	// with. Empty disables single sign-on. The redirect URL registered
+	// with the provider is BaseURL + /api/auth/oidc/callback.
+	OIDCIssuer       string `yaml:"oidc_issuer" json:"oidc_issuer"`
+	OIDCClientID     string `yaml:"oidc_client_id" json:"oidc_client_id"`
+	OIDCClientSecret string `yaml:"oidc_client_secret" json:"oidc_client_secret"`
+
+	// AuditFile is the append-only file of the audit log when links are
+	// not stored in PostgreSQL, where the log is a table. Empty keeps the
+	// log in memory.
+	AuditFile string `yaml:"audit_file" json:"audit_file"`
+}
+
+// New loads the configuration from the command line arguments of the
+// process, the environment and the optional config file.
+func New() (Cfg, error) {
+	return Load(os.Args[1:])
+}
+
+// Load resolves the configuration from args, the environment and the config
+// file given by -c or CONFIG, and validates the result.
+func Load(args []string) (Cfg, error) {
+	cfg, _, err := LoadCommand(args, nil)
+	return cfg, err
+}
+
+// LoadCommand is Load for subcommands: bind adds the flags of the
+// subcommand to the set of server flags, and the arguments following the
+// flags are returned.
+func LoadCommand(args []string, bind func(*flag.FlagSet)) (Cfg, []string, error) {
+	newFlagSet := func(cfg *Cfg) *flag.FlagSet {
+		fs := flagSet(cfg)
+		if bind != nil {
+			bind(fs)
+		}
+		return fs
+	}
+
+	probe := defaults()
+	if err := newFlagSet(&probe).Parse(args); err != nil {
+		return Cfg{}, nil, err
+	}
+	path := probe.ConfigPath
+	if path == "" {
+		path = os.Getenv("CONFIG")
+	}
+
+	cfg := defaults()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return Cfg{}, nil, err
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return Cfg{}, nil, err
+	}
+	fs := newFlagSet(&cfg)
+	if err := fs.Parse(args); err != nil {
+		return Cfg{}, nil, err
+	}
+	cfg.ConfigPath = path
 	cfg.chooseBaseURL()
-	cfg.chooseDBAddress()
-	return cfg
+
+	if err := cfg.Validate(); err != nil {
+		return Cfg{}, nil, err
+	}
+	return cfg, fs.Args(), nil
 }
 
-func (cfg *Cfg) chooseFilepath() {
-	if cfg.Filepath != "" {
-		return
+func defaults() Cfg {
+	return Cfg{
+		Address:        ":8080",
+		RedirectStatus: http.StatusTemporaryRedirect,
+	}
+}
+
+// flagSet binds the command line flags to cfg. The current values of cfg
+// are used as defaults, so parsing only overrides explicitly passed flags.
+func flagSet(cfg *Cfg) *flag.FlagSet {
+	fs := flag.NewFlagSet("shortener", flag.ContinueOnError)
+	fs.StringVar(&cfg.ConfigPath, "c", cfg.ConfigPath, "path to the YAML or JSON config file")
+	fs.StringVar(&cfg.Filepath, "f", cfg.Filepath, "path to the file fith shortened URLs")
+	fs.StringVar(&cfg.Address, "a", cfg.Address, "start address of the HTTP server")
+	fs.StringVar(&cfg.BaseURL, "b", cfg.BaseURL, "base address of the resulting shortened URL")
+	fs.StringVar(&cfg.DBAddress, "d", cfg.DBAddress, "DB connection address")
+	fs.IntVar(&cfg.ShortenRateLimit, "shorten-limit", cfg.ShortenRateLimit, "shorten requests per minute per client")
+	fs.IntVar(&cfg.BatchRateLimit, "batch-limit", cfg.BatchRateLimit, "batch items per minute per client")
+	fs.IntVar(&cfg.RedirectRateLimit, "redirect-limit", cfg.RedirectRateLimit, "redirects per minute per client")
+	fs.BoolVar(&cfg.EnableHTTPS, "s", cfg.EnableHTTPS, "serve HTTPS")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert", cfg.TLSCertFile, "path to the TLS certificate")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key", cfg.TLSKeyFile, "path to the TLS private key")
+	fs.StringVar(&cfg.HTTPRedirectAddress, "http-redirect", cfg.HTTPRedirectAddress, "address of the HTTP listener redirecting to HTTPS")
+	fs.StringVar(&cfg.GRPCAddress, "g", cfg.GRPCAddress, "start address of the gRPC server")
+	fs.StringVar(&cfg.TrustedSubnet, "t", cfg.TrustedSubnet, "CIDR allowed to query internal endpoints")
+	fs.StringVar(&cfg.LinkAccessSecret, "link-secret", cfg.LinkAccessSecret, "secret signing access cookies of password protected links")
+	fs.StringVar(&cfg.CookieSecret, "cookie-secret", cfg.CookieSecret, "secret signing the cookies identifying users")
+	fs.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "bearer token of the admin endpoints")
+	fs.StringVar(&cfg.OIDCIssuer, "oidc-issuer", cfg.OIDCIssuer, "URL of the OpenID Connect provider")
+	fs.StringVar(&cfg.OIDCClientID, "oidc-client-id", cfg.OIDCClientID, "OpenID Connect client ID")
+	fs.StringVar(&cfg.OIDCClientSecret, "oidc-client-secret", cfg.OIDCClientSecret, "OpenID Connect client secret")
+	fs.StringVar(&cfg.AuditFile, "audit-file", cfg.AuditFile, "path to the audit log file")
+	fs.StringVar(&cfg.GeoIPDatabase, "geoip", cfg.GeoIPDatabase, "path to the MaxMind country database")
+	fs.IntVar(&cfg.RedirectStatus, "redirect-status", cfg.RedirectStatus, "default redirect status: 301, 302, 307 or 308")
+	return fs
+}
+
+func (cfg *Cfg) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (cfg *Cfg) loadEnv() error {
+	chooseString(&cfg.Filepath, "FILE_STORAGE_PATH")
+	chooseString(&cfg.Address, "SERVER_ADDRESS")
+	chooseString(&cfg.BaseURL, "BASE_URL")
+	chooseString(&cfg.DBAddress, "DATABASE_DSN")
+	chooseString(&cfg.TLSCertFile, "TLS_CERT_FILE")
+	chooseString(&cfg.TLSKeyFile, "TLS_KEY_FILE")
+	chooseString(&cfg.HTTPRedirectAddress, "HTTP_REDIRECT_ADDRESS")
+	chooseString(&cfg.GRPCAddress, "GRPC_ADDRESS")
+	chooseString(&cfg.TrustedSubnet, "TRUSTED_SUBNET")
+	chooseString(&cfg.LinkAccessSecret, "LINK_ACCESS_SECRET")
+	chooseString(&cfg.CookieSecret, "COOKIE_SECRET")
+	chooseString(&cfg.GeoIPDatabase, "GEOIP_DB")
+	chooseString(&cfg.AdminToken, "ADMIN_TOKEN")
+	chooseString(&cfg.AuditFile, "AUDIT_FILE")
+	chooseString(&cfg.OIDCIssuer, "OIDC_ISSUER")
+	chooseString(&cfg.OIDCClientID, "OIDC_CLIENT_ID")
+	chooseString(&cfg.OIDCClientSecret, "OIDC_CLIENT_SECRET")
+	if err := chooseBool(&cfg.EnableHTTPS, "ENABLE_HTTPS"); err != nil {
+		return err
+	}
+	for env, v := range map[string]*int{
+		"SHORTEN_RATE_LIMIT":  &cfg.ShortenRateLimit,
+		"BATCH_RATE_LIMIT":    &cfg.BatchRateLimit,
+		"REDIRECT_RATE_LIMIT": &cfg.RedirectRateLimit,
+		"REDIRECT_STATUS":     &cfg.RedirectStatus,
+	} {
+		if err := chooseInt(v, env); err != nil {
+			return err
+		}
 	}
-	filepath, ok := os.LookupEnv("FILE_STORAGE_PATH")
+	return nil
+}
+
+func chooseString(v *string, env string) {
+	s, ok := os.LookupEnv(env)
 	if !ok {
 		return
 	}
-	cfg.Filepath = filepath
+	*v = s
 }
 
-func (cfg *Cfg) chooseAddress() {
-	if cfg.Address != "" {
-		return
+func chooseInt(v *int, env string) error {
+	s, ok := os.LookupEnv(env)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("%s: %w", env, err)
 	}
-	address, ok := os.LookupEnv("SERVER_ADDRESS")
+	*v = n
+	return nil
+}
+
+func chooseBool(v *bool, env string) error {
+	s, ok := os.LookupEnv(env)
 	if !ok {
-		address = ":8080"
+		return nil
 	}
-	cfg.Address = address
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("%s: %w", env, err)
+	}
+	*v = b
+	return nil
 }
 
+// chooseBaseURL defaults the base URL to localhost on the server port, with
+// the scheme following the TLS setting.
 func (cfg *Cfg) chooseBaseURL() {
 	if cfg.BaseURL != "" {
 		return
 	}
-	bu, ok := os.LookupEnv("BASE_URL")
-	if !ok {
-		bu = "http://localhost:8080"
+	scheme := "http"
+	if cfg.EnableHTTPS {
+		scheme = "https"
+	}
+	port := "8080"
+	if _, p, err := net.SplitHostPort(cfg.Address); err == nil && p != "" {
+		port = p
 	}
-	cfg.BaseURL = bu
+	cfg.BaseURL = fmt.Sprintf("%s://localhost:%s", scheme, port)
 }
 
-func (cfg *Cfg) chooseDBAddress() {
-	if cfg.DBAddress != "" {
-		return
+// Validate checks that the values are usable by the server.
+func (cfg Cfg) Validate() error {
+	u, err := url.Parse(cfg.BaseURL)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("base URL %q must be an absolute URL", cfg.BaseURL)
+	}
+	if err := validateHostPort(cfg.Address); err != nil {
+		return fmt.Errorf("server address %q: %w", cfg.Address, err)
+	}
+	if cfg.ShortenRateLimit < 0 || cfg.BatchRateLimit < 0 || cfg.RedirectRateLimit < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return errors.New("TLS certificate and key must be set together")
+	}
+	if cfg.HTTPRedirectAddress != "" {
+		if !cfg.EnableHTTPS {
+			return errors.New("HTTP redirect listener requires HTTPS")
+		}
+		if u.Scheme != "https" {
+			// the listener redirects to the base URL, which would lead
+			// back to itself
+			return fmt.Errorf("HTTP redirect listener requires an https base URL, not %q", cfg.BaseURL)
+		}
+		if err := validateHostPort(cfg.HTTPRedirectAddress); err != nil {
+			return fmt.Errorf("HTTP redirect address %q: %w", cfg.HTTPRedirectAddress, err)
+		}
+	}
+	if cfg.GRPCAddress != "" {
+		if err := validateHostPort(cfg.GRPCAddress); err != nil {
+			return fmt.Errorf("gRPC address %q: %w", cfg.GRPCAddress, err)
+		}
+	}
+	switch cfg.RedirectStatus {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("redirect status %d is not a redirect", cfg.RedirectStatus)
+	}
+	if cfg.TrustedSubnet != "" {
+		if _, _, err := net.ParseCIDR(cfg.TrustedSubnet); err != nil {
+			return fmt.Errorf("trusted subnet: %w", err)
+		}
+	}
+	if cfg.GeoIPDatabase != "" {
+		if _, err := os.Stat(cfg.GeoIPDatabase); err != nil {
+			return fmt.Errorf("GeoIP database: %w", err)
+		}
+	}
+	if cfg.OIDCIssuer != "" {
+		u, err := url.Parse(cfg.OIDCIssuer)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("OIDC issuer %q must be an absolute URL", cfg.OIDCIssuer)
+		}
+		if cfg.OIDCClientID == "" {
+			return errors.New("OIDC issuer requires a client ID")
+		}
+	}
+	return nil
+}
+
+func validateHostPort(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// Redacted returns a copy of cfg that is safe to print.
+func (cfg Cfg) Redacted() Cfg {
+	cfg.DBAddress = redactDSN(cfg.DBAddress)
+	cfg.LinkAccessSecret = redactSecret(cfg.LinkAccessSecret)
+	cfg.CookieSecret = redactSecret(cfg.CookieSecret)
+	cfg.AdminToken = redactSecret(cfg.AdminToken)
+	cfg.OIDCClientSecret = redactSecret(cfg.OIDCClientSecret)
+	return cfg
+}
+
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "xxxxx"
+}
+
+var dsnPassword = regexp.MustCompile(`(password\s*=\s*)('[^']*'|\S+)`)
+
+// redactDSN hides the password of a URL or key=value PostgreSQL DSN.
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" {
+		return dsnPassword.ReplaceAllString(dsn, "${1}xxxxx")
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+	}
+	q := u.Query()
+	if q.Has("password") {
+		q.Set("password", "xxxxx")
+		u.RawQuery = q.Encode()
 	}
-	dba := os.Getenv("DATABASE_DSN")
-	cfg.DBAddress = dba
+	return u.String()
 }
@@ -0,0 +1,54 @@
+// Package geoip resolves the country of a client address from a local
+// MaxMind DB file such as GeoLite2-Country.mmdb.
+package geoip
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Location is what is known about the origin of an address.
+type Location struct {
+	// Country is the ISO 3166-1 alpha-2 code, empty when unknown.
+	Country string
+	InEU    bool
+}
+
+// Resolver looks up the location of an address.
+type Resolver interface {
+	Lookup(ip net.IP) Location
+}
+
+// DB is a Resolver backed by a MaxMind DB file.
+type DB struct {
+	reader *maxminddb.Reader
+}
+
+func Open(path string) (*DB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{reader: reader}, nil
+}
+
+func (db *DB) Close() error {
+	return db.reader.Close()
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode           string `maxminddb:"iso_code"`
+		IsInEuropeanUnion bool   `maxminddb:"is_in_european_union"`
+	} `maxminddb:"country"`
+}
+
+// Lookup returns an empty Location for addresses missing from the database.
+func (db *DB) Lookup(ip net.IP) Location {
+	var record countryRecord
+	if ip == nil || db.reader.Lookup(ip, &record) != nil {
+		return Location{}
+	}
+	return Location{Country: record.Country.ISOCode, InEU: record.Country.IsInEuropeanUnion}
+}
@@ -0,0 +1,122 @@
+package grpcserver
+
+import (
+	"context"
+	"math"
+	"net"
+	"strconv"
+
+	"github.com/Antony8720/url-shortener/internal/app"
+	pb "github.com/Antony8720/url-shortener/internal/proto"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// authorizationKey is the metadata key carrying the encrypted user, in the
+// same format as the Authorization cookie of the HTTP API.
+const authorizationKey = "authorization"
+
+type userKey struct{}
+
+// newUserKey marks requests whose user was issued by AuthInterceptor.
+type newUserKey struct{}
+
+// AuthInterceptor is the gRPC counterpart of app.CookieAuthorization. It
+// reads the user from the request metadata, issues a new one when the
+// metadata is missing or invalid, and returns the token in the response
+// header metadata.
+func AuthInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	var u user.User
+	var token string
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(authorizationKey)
+	switch {
+	case len(values) > 0 && u.UserDecryptDecodeFromString(values[0]) == nil:
+		token = values[0]
+	case len(values) > 0 && u.LegacyDecodeFromString(values[0]) == nil:
+		// an unsigned token of an earlier release is exchanged for a
+		// signed one of the same user
+		enu, err := u.UserEncryptEncodeToString()
+		if err != nil {
+			return nil, status.Error(codes.Internal, "encoding error")
+		}
+		token = enu
+	default:
+		u = user.New()
+		enu, err := u.UserEncryptEncodeToString()
+		if err != nil {
+			return nil, status.Error(codes.Internal, "encoding error")
+		}
+		token = enu
+		ctx = context.WithValue(ctx, newUserKey{}, true)
+	}
+
+	if err := grpc.SetHeader(ctx, metadata.Pairs(authorizationKey, token)); err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, userKey{}, u), req)
+}
+
+// requestUser returns the user stored by AuthInterceptor.
+func requestUser(ctx context.Context) user.User {
+	u, _ := ctx.Value(userKey{}).(user.User)
+	return u
+}
+
+// RateLimitInterceptor is the gRPC counterpart of the rate limits of the
+// HTTP API and charges the same limiters: Shorten takes a token from
+// limits.Shorten, Resolve one from limits.Redirect and ShortenBatch one per
+// item from limits.Batch. Like the HTTP API it charges both the client IP
+// and, unless it was just issued, the user, so it must run after
+// AuthInterceptor.
+func RateLimitInterceptor(limits app.RateLimiters) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		var rl *app.RateLimiter
+		n := 1
+		switch info.FullMethod {
+		case pb.Shortener_Shorten_FullMethodName:
+			rl = limits.Shorten
+		case pb.Shortener_ShortenBatch_FullMethodName:
+			rl = limits.Batch
+			if batch, ok := req.(*pb.ShortenBatchRequest); ok {
+				n = max(len(batch.GetItems()), 1)
+			}
+		case pb.Shortener_Resolve_FullMethodName:
+			rl = limits.Redirect
+		default:
+			return handler(ctx, req)
+		}
+
+		keys := []string{app.IPKey(peerIP(ctx))}
+		if isNew, _ := ctx.Value(newUserKey{}).(bool); !isNew {
+			keys = append(keys, app.UserKey(requestUser(ctx).UserID))
+		}
+		ok, wait := rl.Allow(n, keys...)
+		if ok {
+			return handler(ctx, req)
+		}
+		if wait == 0 {
+			return nil, status.Error(codes.ResourceExhausted, "request exceeds rate limit")
+		}
+		retryAfter := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", retryAfter))
+		return nil, status.Error(codes.ResourceExhausted, "too many requests, retry after "+retryAfter+"s")
+	}
+}
+
+// peerIP returns the IP address of the client, without the port.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
@@ -0,0 +1,166 @@
+// Package grpcserver implements the gRPC API of the shortener on top of the
+// same storage as the HTTP handlers.
+package grpcserver
+
+//go:generate sh -c "cd ../.. && buf generate"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/app"
+	"github.com/Antony8720/url-shortener/internal/app/helpers"
+	"github.com/Antony8720/url-shortener/internal/app/violationerror"
+	"github.com/Antony8720/url-shortener/internal/audit"
+	pb "github.com/Antony8720/url-shortener/internal/proto"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/webhook"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Server struct {
+	pb.UnimplementedShortenerServer
+	storage  storage.URLStorage
+	baseURL  string
+	auditLog audit.Log
+	hooks    *webhook.Dispatcher
+}
+
+// NewServer creates the shortener service. Changes of links are written to
+// auditLog and sent to the webhooks of their owners through hooks, both
+// owned by the caller.
+func NewServer(storage storage.URLStorage, baseURL string, auditLog audit.Log, hooks *webhook.Dispatcher) *Server {
+	return &Server{storage: storage, baseURL: baseURL, auditLog: auditLog, hooks: hooks}
+}
+
+// New creates a gRPC server with the shortener service and the
+// authorization and rate limit interceptors registered.
+func New(storage storage.URLStorage, baseURL string, auditLog audit.Log, hooks *webhook.Dispatcher, limits app.RateLimiters, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ChainUnaryInterceptor(AuthInterceptor, RateLimitInterceptor(limits)))
+	s := grpc.NewServer(opts...)
+	pb.RegisterShortenerServer(s, NewServer(storage, baseURL, auditLog, hooks))
+	return s
+}
+
+func (s *Server) fullURL(short string) string {
+	return fmt.Sprintf("%s/%s", s.baseURL, short)
+}
+
+// recordLinkEvent writes a creation or deletion of the link short to the
+// audit log and sends it to the webhooks of the owner, like the HTTP
+// handlers do. before is the deleted link, nil for new links. Failures are
+// logged, the change has already happened.
+func (s *Server) recordLinkEvent(ctx context.Context, action audit.Action, short string, before *storage.Link) {
+	e := audit.Event{Time: time.Now().UTC(), Actor: requestUser(ctx).UserID, Action: action, Short: short, IP: peerIP(ctx)}
+	if before != nil {
+		e.Before = audit.LinkState(*before)
+		s.hooks.Notify(webhook.EventDeleted, *before, "")
+	} else if after, ok := s.storage.GetLink(short); ok {
+		e.After = audit.LinkState(after)
+		s.hooks.Notify(webhook.EventCreated, after, "")
+	}
+	if err := s.auditLog.Record(e); err != nil {
+		log.Printf("audit: recording %s of %q: %v", e.Action, e.Short, err)
+	}
+}
+
+func (s *Server) Shorten(ctx context.Context, req *pb.ShortenRequest) (*pb.ShortenResponse, error) {
+	if req.GetUrl() == "" {
+		return nil, status.Error(codes.InvalidArgument, "url is required")
+	}
+	u := requestUser(ctx)
+	encURL, err := helpers.EncodeURL(u.UserID, req.GetUrl(), s.storage)
+	if err != nil {
+		var uve *violationerror.UniqueViolationError
+		if !errors.As(err, &uve) {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &pb.ShortenResponse{Result: s.fullURL(encURL), AlreadyExists: true}, nil
+	}
+	s.recordLinkEvent(ctx, audit.ActionCreate, encURL, nil)
+	return &pb.ShortenResponse{Result: s.fullURL(encURL)}, nil
+}
+
+// maxBatchItems bounds the items of a ShortenBatch request.
+const maxBatchItems = 1000
+
+func (s *Server) ShortenBatch(ctx context.Context, req *pb.ShortenBatchRequest) (*pb.ShortenBatchResponse, error) {
+	if len(req.GetItems()) > maxBatchItems {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d items per batch", maxBatchItems)
+	}
+	u := requestUser(ctx)
+	resp := &pb.ShortenBatchResponse{Items: make([]*pb.BatchResult, 0, len(req.GetItems()))}
+	for _, item := range req.GetItems() {
+		encURL, err := helpers.EncodeURL(u.UserID, item.GetOriginalUrl(), s.storage)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		s.recordLinkEvent(ctx, audit.ActionCreate, encURL, nil)
+		resp.Items = append(resp.Items, &pb.BatchResult{
+			CorrelationId: item.GetCorrelationId(),
+			ShortUrl:      s.fullURL(encURL),
+		})
+	}
+	return resp, nil
+}
+
+// Resolve returns the destination of a link and counts it as a visit, as
+// the HTTP redirect does. Password protected links are only resolved for
+// their owner. Expired links and links out of clicks are not found. Unlike
+// the HTTP redirect, Resolve knows nothing of the browser of the visitor,
+// so targeting rules and A/B variants are not applied: it always returns
+// the default destination.
+func (s *Server) Resolve(ctx context.Context, req *pb.ResolveRequest) (*pb.ResolveResponse, error) {
+	link, ok := s.storage.GetLink(req.GetShortUrl())
+	if !ok {
+		return nil, status.Error(codes.NotFound, "short URL not found")
+	}
+	if link.PasswordHash != "" && link.UserID != requestUser(ctx).UserID {
+		return nil, status.Error(codes.PermissionDenied, "short URL is password protected")
+	}
+	err := helpers.Visit(s.storage, link, "")
+	switch {
+	case errors.Is(err, helpers.ErrExpired):
+		return nil, status.Error(codes.NotFound, "short URL has expired")
+	case errors.Is(err, storage.ErrExhausted):
+		return nil, status.Error(codes.NotFound, "short URL is no longer available")
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.ResolveResponse{OriginalUrl: link.Long}, nil
+}
+
+func (s *Server) ListUserURLs(ctx context.Context, req *pb.ListUserURLsRequest) (*pb.ListUserURLsResponse, error) {
+	u := requestUser(ctx)
+	all, err := s.storage.GetHistory(u.UserID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &pb.ListUserURLsResponse{Urls: make([]*pb.UserURL, 0, len(all))}
+	for short, long := range all {
+		resp.Urls = append(resp.Urls, &pb.UserURL{ShortUrl: s.fullURL(short), OriginalUrl: long})
+	}
+	return resp, nil
+}
+
+func (s *Server) DeleteUserURLs(ctx context.Context, req *pb.DeleteUserURLsRequest) (*pb.DeleteUserURLsResponse, error) {
+	u := requestUser(ctx)
+	var deleted []storage.Link
+	for _, short := range req.GetShortUrls() {
+		if link, ok := s.storage.GetLink(short); ok && link.UserID == u.UserID {
+			deleted = append(deleted, link)
+		}
+	}
+	if err := s.storage.Delete(u.UserID, req.GetShortUrls()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for _, link := range deleted {
+		s.recordLinkEvent(ctx, audit.ActionDelete, link.Short, &link)
+	}
+	return &pb.DeleteUserURLsResponse{}, nil
+}
@@ -0,0 +1,230 @@
+package grpcserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/app"
+	"github.com/Antony8720/url-shortener/internal/audit"
+	pb "github.com/Antony8720/url-shortener/internal/proto"
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/Antony8720/url-shortener/internal/user"
+	"github.com/Antony8720/url-shortener/internal/webhook"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestClient(t *testing.T) pb.ShortenerClient {
+	return newStorageClient(t, storage.NewDataStorage(), audit.NewMemoryLog())
+}
+
+func newStorageClient(t *testing.T, urlStorage storage.URLStorage, auditLog audit.Log) pb.ShortenerClient {
+	hooks := webhook.NewDispatcher(urlStorage, webhook.Options{})
+	t.Cleanup(hooks.Close)
+	return newServerClient(t, urlStorage, auditLog, hooks, app.RateLimiters{})
+}
+
+func newServerClient(t *testing.T, urlStorage storage.URLStorage, auditLog audit.Log, hooks *webhook.Dispatcher, limits app.RateLimiters) pb.ShortenerClient {
+	lis := bufconn.Listen(1024 * 1024)
+	s := New(urlStorage, "http://localhost:8080", auditLog, hooks, limits)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewShortenerClient(conn)
+}
+
+func TestShortenResolveAndDelete(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	var header metadata.MD
+	resp, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "https://ya.ru"}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(resp.GetResult(), "http://localhost:8080/"))
+	token := header.Get(authorizationKey)
+	require.Len(t, token, 1)
+	short := strings.TrimPrefix(resp.GetResult(), "http://localhost:8080/")
+
+	resolved, err := client.Resolve(ctx, &pb.ResolveRequest{ShortUrl: short})
+	require.NoError(t, err)
+	assert.Equal(t, "https://ya.ru", resolved.GetOriginalUrl())
+
+	authCtx := metadata.AppendToOutgoingContext(ctx, authorizationKey, token[0])
+	list, err := client.ListUserURLs(authCtx, &pb.ListUserURLsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, list.GetUrls(), 1)
+
+	_, err = client.DeleteUserURLs(ctx, &pb.DeleteUserURLsRequest{ShortUrls: []string{short}})
+	require.NoError(t, err)
+	_, err = client.Resolve(ctx, &pb.ResolveRequest{ShortUrl: short})
+	require.NoError(t, err, "other users must not delete the link")
+
+	_, err = client.DeleteUserURLs(authCtx, &pb.DeleteUserURLsRequest{ShortUrls: []string{short}})
+	require.NoError(t, err)
+	_, err = client.Resolve(ctx, &pb.ResolveRequest{ShortUrl: short})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestShortenBatch(t *testing.T) {
+	client := newTestClient(t)
+	resp, err := client.ShortenBatch(context.Background(), &pb.ShortenBatchRequest{Items: []*pb.BatchItem{
+		{CorrelationId: "1", OriginalUrl: "https://a.ru"},
+		{CorrelationId: "2", OriginalUrl: "https://b.ru"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, resp.GetItems(), 2)
+	assert.Equal(t, "2", resp.GetItems()[1].GetCorrelationId())
+}
+
+func TestResolveCountsVisits(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	client := newStorageClient(t, urlStorage, audit.NewMemoryLog())
+	ctx := context.Background()
+	userID := uuid.New()
+	require.NoError(t, urlStorage.AddLink(storage.Link{UserID: userID, Short: "once", Long: "https://once.ru", LinkOptions: storage.LinkOptions{MaxClicks: 1}, RemainingClicks: 1}))
+	require.NoError(t, urlStorage.AddLink(storage.Link{UserID: userID, Short: "old", Long: "https://old.ru", ExpiresAt: time.Now().Add(-time.Minute)}))
+
+	resolved, err := client.Resolve(ctx, &pb.ResolveRequest{ShortUrl: "once"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://once.ru", resolved.GetOriginalUrl())
+	_, err = client.Resolve(ctx, &pb.ResolveRequest{ShortUrl: "once"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	stats, err := urlStorage.GetClickStats("once")
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Total)
+
+	_, err = client.Resolve(ctx, &pb.ResolveRequest{ShortUrl: "old"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestChangesAreAudited(t *testing.T) {
+	auditLog := audit.NewMemoryLog()
+	client := newStorageClient(t, storage.NewDataStorage(), auditLog)
+
+	var header metadata.MD
+	resp, err := client.Shorten(context.Background(), &pb.ShortenRequest{Url: "https://ya.ru"}, grpc.Header(&header))
+	require.NoError(t, err)
+	short := strings.TrimPrefix(resp.GetResult(), "http://localhost:8080/")
+	ctx := metadata.AppendToOutgoingContext(context.Background(), authorizationKey, header.Get(authorizationKey)[0])
+	_, err = client.ShortenBatch(ctx, &pb.ShortenBatchRequest{Items: []*pb.BatchItem{{CorrelationId: "1", OriginalUrl: "https://a.ru"}}})
+	require.NoError(t, err)
+	_, err = client.DeleteUserURLs(ctx, &pb.DeleteUserURLsRequest{ShortUrls: []string{short, "missing"}})
+	require.NoError(t, err)
+
+	events, err := auditLog.Query(context.Background(), audit.Filter{})
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	for i, action := range []audit.Action{audit.ActionCreate, audit.ActionCreate, audit.ActionDelete} {
+		assert.Equal(t, action, events[i].Action)
+		assert.Equal(t, events[0].Actor, events[i].Actor)
+	}
+	assert.Equal(t, short, events[0].Short)
+	assert.Contains(t, string(events[0].After), "https://ya.ru")
+	assert.Equal(t, short, events[2].Short)
+	assert.Contains(t, string(events[2].Before), "https://ya.ru")
+}
+
+func TestChangesAreSentToWebhooks(t *testing.T) {
+	received := make(chan webhook.Payload, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var p webhook.Payload
+		json.Unmarshal(body, &p)
+		received <- p
+	}))
+	defer receiver.Close()
+	next := func() webhook.Payload {
+		select {
+		case p := <-received:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("delivery not received")
+			return webhook.Payload{}
+		}
+	}
+
+	u := user.New()
+	token, err := u.UserEncryptEncodeToString()
+	require.NoError(t, err)
+	urlStorage := storage.NewDataStorage()
+	require.NoError(t, urlStorage.AddWebhook(storage.Webhook{ID: uuid.New(), UserID: u.UserID, URL: receiver.URL, Secret: "secret", Events: []string{webhook.EventCreated, webhook.EventDeleted}}))
+	hooks := webhook.NewDispatcher(urlStorage, webhook.Options{AllowPrivate: true})
+	defer hooks.Close()
+	client := newServerClient(t, urlStorage, audit.NewMemoryLog(), hooks, app.RateLimiters{})
+	ctx := metadata.AppendToOutgoingContext(context.Background(), authorizationKey, token)
+
+	resp, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "https://ya.ru"})
+	require.NoError(t, err)
+	short := strings.TrimPrefix(resp.GetResult(), "http://localhost:8080/")
+	p := next()
+	assert.Equal(t, webhook.EventCreated, p.Event)
+	assert.Equal(t, short, p.Link.Short)
+
+	_, err = client.DeleteUserURLs(ctx, &pb.DeleteUserURLsRequest{ShortUrls: []string{short}})
+	require.NoError(t, err)
+	p = next()
+	assert.Equal(t, webhook.EventDeleted, p.Event)
+	assert.Equal(t, short, p.Link.Short)
+}
+
+func TestRateLimits(t *testing.T) {
+	urlStorage := storage.NewDataStorage()
+	hooks := webhook.NewDispatcher(urlStorage, webhook.Options{})
+	t.Cleanup(hooks.Close)
+	limits := app.RateLimiters{Shorten: app.NewRateLimiter(2), Batch: app.NewRateLimiter(3)}
+	client := newServerClient(t, urlStorage, audit.NewMemoryLog(), hooks, limits)
+	ctx := context.Background()
+
+	for i := range 2 {
+		_, err := client.Shorten(ctx, &pb.ShortenRequest{Url: fmt.Sprintf("https://ya.ru/%d", i)})
+		require.NoError(t, err)
+	}
+	var header metadata.MD
+	_, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "https://ya.ru/late"}, grpc.Header(&header))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.NotEmpty(t, header.Get("retry-after"))
+
+	batch := func(n int) error {
+		req := &pb.ShortenBatchRequest{}
+		for i := range n {
+			req.Items = append(req.Items, &pb.BatchItem{CorrelationId: fmt.Sprint(i), OriginalUrl: fmt.Sprintf("https://batch.ru/%d/%d", n, i)})
+		}
+		_, err := client.ShortenBatch(ctx, req)
+		return err
+	}
+	assert.Equal(t, codes.ResourceExhausted, status.Code(batch(4)), "a batch larger than the limit")
+	require.NoError(t, batch(3))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(batch(1)), "batches are weighted by their items")
+}
+
+func TestShortenBatchIsCapped(t *testing.T) {
+	client := newTestClient(t)
+	req := &pb.ShortenBatchRequest{}
+	for i := range maxBatchItems + 1 {
+		req.Items = append(req.Items, &pb.BatchItem{CorrelationId: fmt.Sprint(i), OriginalUrl: fmt.Sprintf("https://ya.ru/%d", i)})
+	}
+	_, err := client.ShortenBatch(context.Background(), req)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,135 @@
+// Package qr renders QR codes as PNG or SVG images with a configurable
+// size, error correction level and quiet zone.
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	FormatPNG = "png"
+	FormatSVG = "svg"
+)
+
+type Options struct {
+	// Size is the width and height of the image in pixels. The image is
+	// enlarged when it is too small to draw every module.
+	Size int
+	// Level is one of "L", "M", "Q" or "H".
+	Level string
+	// Margin is the width of the quiet zone in modules.
+	Margin int
+}
+
+func DefaultOptions() Options {
+	return Options{Size: 256, Level: "M", Margin: 4}
+}
+
+func recoveryLevel(level string) (qrcode.RecoveryLevel, error) {
+	switch strings.ToUpper(level) {
+	case "L":
+		return qrcode.Low, nil
+	case "M", "":
+		return qrcode.Medium, nil
+	case "Q":
+		return qrcode.High, nil
+	case "H":
+		return qrcode.Highest, nil
+	}
+	return 0, fmt.Errorf("unknown error correction level %q", level)
+}
+
+// bitmap returns the modules of the QR code surrounded by the margin.
+func bitmap(content string, opts Options) ([][]bool, error) {
+	level, err := recoveryLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, err
+	}
+	code.DisableBorder = true
+	modules := code.Bitmap()
+
+	n := len(modules) + 2*opts.Margin
+	bm := make([][]bool, n)
+	for y := range bm {
+		bm[y] = make([]bool, n)
+	}
+	for y, row := range modules {
+		copy(bm[y+opts.Margin][opts.Margin:], row)
+	}
+	return bm, nil
+}
+
+// scale returns the number of pixels per module and the offset that
+// centers the code in an image of opts.Size pixels.
+func scale(n int, size int) (px, offset, total int) {
+	px = size / n
+	if px < 1 {
+		px = 1
+	}
+	total = size
+	if n*px > total {
+		total = n * px
+	}
+	return px, (total - n*px) / 2, total
+}
+
+func PNG(content string, opts Options) ([]byte, error) {
+	bm, err := bitmap(content, opts)
+	if err != nil {
+		return nil, err
+	}
+	px, offset, total := scale(len(bm), opts.Size)
+
+	img := image.NewPaletted(image.Rect(0, 0, total, total), color.Palette{color.White, color.Black})
+	for y, row := range bm {
+		for x, set := range row {
+			if !set {
+				continue
+			}
+			for dy := 0; dy < px; dy++ {
+				for dx := 0; dx < px; dx++ {
+					img.SetColorIndex(offset+x*px+dx, offset+y*px+dy, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func SVG(content string, opts Options) ([]byte, error) {
+	bm, err := bitmap(content, opts)
+	if err != nil {
+		return nil, err
+	}
+	n := len(bm)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		opts.Size, opts.Size, n, n)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range bm {
+		for x, set := range row {
+			if set {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrUsernameTaken is returned by CreateAccount when the username is used
+// by another account.
+var ErrUsernameTaken = errors.New("username is taken")
+
+// ErrHasAccount is returned by CreateAccount when the user already has an
+// account.
+var ErrHasAccount = errors.New("user already has an account")
+
+// Account lets a user log in with a username and password and get back
+// the user, with its links, after losing the Authorization cookie.
+type Account struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	UserID       uuid.UUID `json:"userID"`
+	CreatedAt    time.Time `json:"created_at"`
+}
@@ -2,15 +2,18 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"github.com/Antony8720/url-shortener/internal/app/violationerror"
 	"github.com/google/uuid"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	"github.com/Antony8720/url-shortener/internal/app/violationerror"
+	"time"
 )
 
-type DatabaseStorage struct{
+type DatabaseStorage struct {
 	db *pgxpool.Pool
 }
 
@@ -20,7 +23,7 @@ type DatabaseURL struct {
 	long   string    `db:"long_url"`
 }
 
-func NewDatabaseStorage(DBAddress string) (*DatabaseStorage, error){
+func NewDatabaseStorage(DBAddress string) (*DatabaseStorage, error) {
 	pgxConfig, err := pgxpool.ParseConfig(DBAddress)
 	if err != nil {
 		return &DatabaseStorage{}, err
@@ -36,8 +39,82 @@ func NewDatabaseStorage(DBAddress string) (*DatabaseStorage, error){
 			 short_url text NOT NULL,
 			 long_url text NOT NULL,
 			 PRIMARY KEY (id));
-			 CREATE UNIQUE INDEX IF NOT EXISTS long_url_unique_idx on database_url(long_url);`
-	_, err = pgxConnPool.Exec(context.Background(), query) 
+			 CREATE UNIQUE INDEX IF NOT EXISTS long_url_unique_idx on database_url(long_url);
+			 CREATE INDEX IF NOT EXISTS user_id_idx on database_url(user_id);
+			 CREATE INDEX IF NOT EXISTS short_url_idx on database_url(short_url);
+			 ALTER TABLE database_url
+			 ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now(),
+			 ADD COLUMN IF NOT EXISTS title text NOT NULL DEFAULT '',
+			 ADD COLUMN IF NOT EXISTS interstitial boolean NOT NULL DEFAULT false,
+			 ADD COLUMN IF NOT EXISTS redirect_type integer NOT NULL DEFAULT 0,
+			 ADD COLUMN IF NOT EXISTS query_passthrough text NOT NULL DEFAULT '',
+			 ADD COLUMN IF NOT EXISTS path_passthrough boolean NOT NULL DEFAULT false,
+			 ADD COLUMN IF NOT EXISTS utm_source text NOT NULL DEFAULT '',
+			 ADD COLUMN IF NOT EXISTS utm_medium text NOT NULL DEFAULT '',
+			 ADD COLUMN IF NOT EXISTS utm_campaign text NOT NULL DEFAULT '',
+			 ADD COLUMN IF NOT EXISTS utm_term text NOT NULL DEFAULT '',
+			 ADD COLUMN IF NOT EXISTS utm_content text NOT NULL DEFAULT '',
+			 ADD COLUMN IF NOT EXISTS password_hash text NOT NULL DEFAULT '',
+			 ADD COLUMN IF NOT EXISTS max_clicks integer NOT NULL DEFAULT 0,
+			 ADD COLUMN IF NOT EXISTS remaining_clicks integer NOT NULL DEFAULT 0,
+			 ADD COLUMN IF NOT EXISTS rules jsonb NOT NULL DEFAULT '[]',
+			 ADD COLUMN IF NOT EXISTS sticky_variants boolean NOT NULL DEFAULT false,
+			 ADD COLUMN IF NOT EXISTS tags text[] NOT NULL DEFAULT '{}',
+			 ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+			 CREATE INDEX IF NOT EXISTS user_campaign_idx on database_url(user_id, utm_campaign);
+			 CREATE TABLE IF NOT EXISTS link_variant
+			 (
+			 short_url text NOT NULL,
+			 position integer NOT NULL,
+			 name text NOT NULL,
+			 destination text NOT NULL,
+			 weight integer NOT NULL,
+			 PRIMARY KEY (short_url, position));
+			 CREATE TABLE IF NOT EXISTS link_click
+			 (
+			 id bigint NOT NULL GENERATED ALWAYS AS IDENTITY,
+			 short_url text NOT NULL,
+			 variant text NOT NULL DEFAULT '',
+			 clicked_at timestamptz NOT NULL DEFAULT now(),
+			 PRIMARY KEY (id));
+			 CREATE INDEX IF NOT EXISTS link_click_short_url_idx on link_click(short_url);
+			 CREATE TABLE IF NOT EXISTS user_account
+			 (
+			 username text NOT NULL,
+			 password_hash text NOT NULL,
+			 user_id uuid NOT NULL,
+			 created_at timestamptz NOT NULL DEFAULT now(),
+			 PRIMARY KEY (username),
+			 CONSTRAINT user_account_user_id_key UNIQUE (user_id));
+			 CREATE TABLE IF NOT EXISTS workspace
+			 (
+			 id uuid NOT NULL,
+			 name text NOT NULL,
+			 created_at timestamptz NOT NULL DEFAULT now(),
+			 PRIMARY KEY (id));
+			 CREATE TABLE IF NOT EXISTS workspace_member
+			 (
+			 workspace_id uuid NOT NULL REFERENCES workspace (id) ON DELETE CASCADE,
+			 user_id uuid NOT NULL,
+			 role text NOT NULL,
+			 PRIMARY KEY (workspace_id, user_id));
+			 CREATE INDEX IF NOT EXISTS workspace_member_user_id_idx on workspace_member(user_id);
+			 CREATE TABLE IF NOT EXISTS webhook
+			 (
+			 id uuid NOT NULL,
+			 user_id uuid NOT NULL,
+			 url text NOT NULL,
+			 secret text NOT NULL,
+			 events text[] NOT NULL,
+			 created_at timestamptz NOT NULL DEFAULT now(),
+			 PRIMARY KEY (id));
+			 CREATE INDEX IF NOT EXISTS webhook_user_id_idx on webhook(user_id);
+			 CREATE TABLE IF NOT EXISTS server_secret
+			 (
+			 name text NOT NULL,
+			 value text NOT NULL,
+			 PRIMARY KEY (name));`
+	_, err = pgxConnPool.Exec(context.Background(), query)
 	if err != nil {
 		return &DatabaseStorage{}, err
 	}
@@ -47,19 +124,19 @@ func NewDatabaseStorage(DBAddress string) (*DatabaseStorage, error){
 func (dbs *DatabaseStorage) Get(short string) (string, bool) {
 	var url DatabaseURL
 	err := dbs.db.QueryRow(context.Background(),
-						  `SELECT user_id, short_url, long_url
+		`SELECT user_id, short_url, long_url
 						   FROM database_url 
 						   WHERE short_url = $1::text`, short).Scan(&url.userID, &url.short, &url.long)
 	if err != nil {
 		return "", false
 	}
-	return url.long, true		
+	return url.long, true
 }
 
 func (dbs *DatabaseStorage) GetHistory(userID uuid.UUID) (map[string]string, error) {
 	res := make(map[string]string)
-	rows, err := dbs.db.Query(context.Background(), 
-							`SELECT user_id, short_url, long_url 
+	rows, err := dbs.db.Query(context.Background(),
+		`SELECT user_id, short_url, long_url 
 							 FROM database_url 
 							 WHERE user_id = $1::uuid`, userID)
 	if err != nil {
@@ -81,34 +158,744 @@ func (dbs *DatabaseStorage) GetHistory(userID uuid.UUID) (map[string]string, err
 	return res, nil
 }
 
-func(dbs *DatabaseStorage) Set(userID uuid.UUID, short, long string) error {
+func (dbs *DatabaseStorage) Set(userID uuid.UUID, short, long string) error {
 	query := "INSERT INTO database_url(user_id, short_url, long_url) VALUES ($1::uuid, $2::text, $3::text)"
 	_, err := dbs.db.Exec(context.Background(), query, userID, short, long)
 	if err != nil {
 		var pgError *pgconn.PgError
-		if !errors.As(err, &pgError){
+		if !errors.As(err, &pgError) {
 			return err
 		}
 		pgErr, ok := err.(*pgconn.PgError)
 		if !ok {
 			return err
 		}
-		if pgErr.Code != pgerrcode.UniqueViolation{
+		if pgErr.Code != pgerrcode.UniqueViolation {
 			return err
 		}
 		var ndb DatabaseURL
 		if err := dbs.db.QueryRow(context.Background(),
-								  "SELECT user_id, short_url, long_url FROM database_url WHERE long_url = $1::text", long,
-								 ).Scan(&ndb.userID, &ndb.short, &ndb.long); err != nil{
-									return err
-								 }	
-		
+			"SELECT user_id, short_url, long_url FROM database_url WHERE long_url = $1::text", long,
+		).Scan(&ndb.userID, &ndb.short, &ndb.long); err != nil {
+			return err
+		}
+
 		return &violationerror.UniqueViolationError{
-			Err: err,
+			Err:    err,
 			UserID: ndb.userID,
-			Short: ndb.short,
-			Long: ndb.long,
-		}						 
+			Short:  ndb.short,
+			Long:   ndb.long,
+		}
+	}
+	return nil
+}
+
+// Delete removes the given short URLs owned by userID together with their
+// variants and clicks.
+func (dbs *DatabaseStorage) Delete(userID uuid.UUID, shorts []string) error {
+	_, err := dbs.db.Exec(context.Background(),
+		`WITH deleted AS (
+		   DELETE FROM database_url
+		   WHERE user_id = $1::uuid AND short_url = ANY($2::text[])
+		   RETURNING short_url
+		 ), deleted_variants AS (
+		   DELETE FROM link_variant WHERE short_url IN (SELECT short_url FROM deleted)
+		 )
+		 DELETE FROM link_click WHERE short_url IN (SELECT short_url FROM deleted)`, userID, shorts)
+	return err
+}
+
+func (dbs *DatabaseStorage) CountURLs() (int, error) {
+	var n int
+	err := dbs.db.QueryRow(context.Background(), `SELECT count(*) FROM database_url`).Scan(&n)
+	return n, err
+}
+
+// CountUsers returns the number of users owning at least one URL. Links
+// created without a user are not attributed to anyone.
+func (dbs *DatabaseStorage) CountUsers() (int, error) {
+	var n int
+	err := dbs.db.QueryRow(context.Background(),
+		`SELECT count(DISTINCT user_id)
+		 FROM database_url
+		 WHERE user_id <> $1::uuid`, uuid.Nil).Scan(&n)
+	return n, err
+}
+
+// linkColumns are the columns read by scanLink, in order.
+const linkColumns = `user_id, short_url, long_url, created_at, title, interstitial, redirect_type,
+	query_passthrough, path_passthrough,
+	utm_source, utm_medium, utm_campaign, utm_term, utm_content, password_hash,
+	max_clicks, remaining_clicks, rules::text, sticky_variants, tags, expires_at,
+	(SELECT coalesce(json_agg(json_build_object(
+	   'name', v.name, 'destination', v.destination, 'weight', v.weight) ORDER BY v.position), '[]')::text
+	 FROM link_variant v WHERE v.short_url = database_url.short_url)`
+
+func scanLink(row pgx.Row) (Link, error) {
+	var link Link
+	var rules, variants string
+	var expiresAt *time.Time
+	err := row.Scan(&link.UserID, &link.Short, &link.Long, &link.CreatedAt, &link.Title, &link.Interstitial, &link.RedirectType,
+		&link.QueryPassthrough, &link.PathPassthrough,
+		&link.UTM.Source, &link.UTM.Medium, &link.UTM.Campaign, &link.UTM.Term, &link.UTM.Content,
+		&link.PasswordHash, &link.MaxClicks, &link.RemainingClicks, &rules, &link.StickyVariants, &link.Tags, &expiresAt, &variants)
+	if err != nil {
+		return Link{}, err
+	}
+	if expiresAt != nil {
+		link.ExpiresAt = *expiresAt
+	}
+	if len(link.Tags) == 0 {
+		link.Tags = nil
+	}
+	if err = json.Unmarshal([]byte(rules), &link.Rules); err != nil {
+		return Link{}, err
+	}
+	if err = json.Unmarshal([]byte(variants), &link.Variants); err != nil {
+		return Link{}, err
+	}
+	if len(link.Rules) == 0 {
+		link.Rules = nil
+	}
+	if len(link.Variants) == 0 {
+		link.Variants = nil
+	}
+	return link, nil
+}
+
+func (dbs *DatabaseStorage) GetLink(short string) (Link, bool) {
+	link, err := scanLink(dbs.db.QueryRow(context.Background(),
+		`SELECT `+linkColumns+`
+		 FROM database_url
+		 WHERE short_url = $1::text`, short))
+	if err != nil {
+		return Link{}, false
+	}
+	return link, true
+}
+
+func (dbs *DatabaseStorage) SetOptions(userID uuid.UUID, short string, opts LinkOptions) error {
+	tag, err := dbs.db.Exec(context.Background(),
+		`UPDATE database_url
+		 SET title = $3::text, interstitial = $4::boolean, redirect_type = $5::integer,
+		 query_passthrough = $6::text, path_passthrough = $7::boolean,
+		 utm_source = $8::text, utm_medium = $9::text, utm_campaign = $10::text,
+		 utm_term = $11::text, utm_content = $12::text, password_hash = $13::text,
+		 remaining_clicks = CASE WHEN max_clicks = $14::integer THEN remaining_clicks ELSE $14::integer END,
+		 max_clicks = $14::integer
+		 WHERE user_id = $1::uuid AND short_url = $2::text`,
+		userID, short, opts.Title, opts.Interstitial, opts.RedirectType,
+		opts.QueryPassthrough, opts.PathPassthrough,
+		opts.UTM.Source, opts.UTM.Medium, opts.UTM.Campaign, opts.UTM.Term, opts.UTM.Content,
+		opts.PasswordHash, opts.MaxClicks)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (dbs *DatabaseStorage) GetUserLinks(userID uuid.UUID, filter LinkFilter) ([]Link, error) {
+	rows, err := dbs.db.Query(context.Background(),
+		`SELECT `+linkColumns+`
+		 FROM database_url
+		 WHERE user_id = $1::uuid AND ($2::text = '' OR utm_campaign = $2::text)`,
+		userID, filter.Campaign)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Link
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, link)
+	}
+	return result, rows.Err()
+}
+
+// EachUserLink streams the links of userID in creation order, calling fn
+// for each row as it arrives.
+func (dbs *DatabaseStorage) EachUserLink(ctx context.Context, userID uuid.UUID, fn func(Link) error) error {
+	rows, err := dbs.db.Query(ctx,
+		`SELECT `+linkColumns+`
+		 FROM database_url
+		 WHERE user_id = $1::uuid
+		 ORDER BY id`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Redeem uses up one click of a link limited by max_clicks. The decrement
+// and the check happen in a single statement, so concurrent visits can not
+// redeem more clicks than there are.
+func (dbs *DatabaseStorage) Redeem(short string) (int, error) {
+	var remaining int
+	err := dbs.db.QueryRow(context.Background(),
+		`UPDATE database_url
+		 SET remaining_clicks = remaining_clicks - 1
+		 WHERE short_url = $1::text AND max_clicks > 0 AND remaining_clicks > 0
+		 RETURNING remaining_clicks`, short).Scan(&remaining)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrExhausted
+	}
+	return remaining, err
+}
+
+func (dbs *DatabaseStorage) SetRules(userID uuid.UUID, short string, rules []Rule) error {
+	if rules == nil {
+		rules = []Rule{}
+	}
+	b, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	tag, err := dbs.db.Exec(context.Background(),
+		`UPDATE database_url
+		 SET rules = $3::jsonb
+		 WHERE user_id = $1::uuid AND short_url = $2::text`,
+		userID, short, string(b))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// SetVariants replaces the variants of a link owned by userID in a single
+// transaction, so visitors never see a partial set.
+func (dbs *DatabaseStorage) SetVariants(userID uuid.UUID, short string, variants []Variant, sticky bool) error {
+	ctx := context.Background()
+	tx, err := dbs.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE database_url
+		 SET sticky_variants = $3::boolean
+		 WHERE user_id = $1::uuid AND short_url = $2::text`,
+		userID, short, sticky)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM link_variant WHERE short_url = $1::text`, short); err != nil {
+		return err
+	}
+	for i, v := range variants {
+		_, err = tx.Exec(ctx,
+			`INSERT INTO link_variant(short_url, position, name, destination, weight)
+			 VALUES ($1::text, $2::integer, $3::text, $4::text, $5::integer)`,
+			short, i, v.Name, v.Destination, v.Weight)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (dbs *DatabaseStorage) RecordClick(click Click) error {
+	_, err := dbs.db.Exec(context.Background(),
+		`INSERT INTO link_click(short_url, variant, clicked_at)
+		 VALUES ($1::text, $2::text, $3::timestamptz)`,
+		click.Short, click.Variant, click.At)
+	return err
+}
+
+func (dbs *DatabaseStorage) GetClickStats(short string) (ClickStats, error) {
+	if _, ok := dbs.GetLink(short); !ok {
+		return ClickStats{}, ErrNotFound
+	}
+	rows, err := dbs.db.Query(context.Background(),
+		`SELECT variant, count(*)
+		 FROM link_click
+		 WHERE short_url = $1::text
+		 GROUP BY variant`, short)
+	if err != nil {
+		return ClickStats{}, err
+	}
+	defer rows.Close()
+	var stats ClickStats
+	for rows.Next() {
+		var variant string
+		var n int
+		if err := rows.Scan(&variant, &n); err != nil {
+			return ClickStats{}, err
+		}
+		stats.Total += n
+		if variant != "" {
+			if stats.Variants == nil {
+				stats.Variants = map[string]int{}
+			}
+			stats.Variants[variant] = n
+		}
+	}
+	return stats, rows.Err()
+}
+
+// AddLink stores a complete link with its variants in a single
+// transaction. A taken short URL fails with ErrExists, a taken long URL
+// with a UniqueViolationError as in Set.
+func (dbs *DatabaseStorage) AddLink(link Link) error {
+	rules, err := json.Marshal(link.Rules)
+	if err != nil {
+		return err
+	}
+	if link.Rules == nil {
+		rules = []byte("[]")
+	}
+	tags := link.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	var expiresAt *time.Time
+	if !link.ExpiresAt.IsZero() {
+		expiresAt = &link.ExpiresAt
+	}
+
+	ctx := context.Background()
+	tx, err := dbs.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	err = tx.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM database_url WHERE short_url = $1::text)`, link.Short).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrExists
+	}
+	opts := link.LinkOptions
+	_, err = tx.Exec(ctx,
+		`INSERT INTO database_url(user_id, short_url, long_url, created_at, title, interstitial, redirect_type,
+		 query_passthrough, path_passthrough, utm_source, utm_medium, utm_campaign, utm_term, utm_content,
+		 password_hash, max_clicks, remaining_clicks, rules, sticky_variants, tags, expires_at)
+		 VALUES ($1::uuid, $2::text, $3::text, $4::timestamptz, $5::text, $6::boolean, $7::integer,
+		 $8::text, $9::boolean, $10::text, $11::text, $12::text, $13::text, $14::text,
+		 $15::text, $16::integer, $17::integer, $18::jsonb, $19::boolean, $20::text[], $21::timestamptz)`,
+		link.UserID, link.Short, link.Long, link.CreatedAt, opts.Title, opts.Interstitial, opts.RedirectType,
+		opts.QueryPassthrough, opts.PathPassthrough,
+		opts.UTM.Source, opts.UTM.Medium, opts.UTM.Campaign, opts.UTM.Term, opts.UTM.Content,
+		opts.PasswordHash, opts.MaxClicks, link.RemainingClicks, string(rules), link.StickyVariants, tags, expiresAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			var ndb DatabaseURL
+			if err := dbs.db.QueryRow(ctx,
+				"SELECT user_id, short_url, long_url FROM database_url WHERE long_url = $1::text", link.Long,
+			).Scan(&ndb.userID, &ndb.short, &ndb.long); err != nil {
+				return err
+			}
+			return &violationerror.UniqueViolationError{Err: err, UserID: ndb.userID, Short: ndb.short, Long: ndb.long}
+		}
+		return err
+	}
+	for i, v := range link.Variants {
+		_, err = tx.Exec(ctx,
+			`INSERT INTO link_variant(short_url, position, name, destination, weight)
+			 VALUES ($1::text, $2::integer, $3::text, $4::text, $5::integer)`,
+			link.Short, i, v.Name, v.Destination, v.Weight)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// EachLink streams all links in creation order with a single query, calling
+// fn for each row as it arrives.
+func (dbs *DatabaseStorage) EachLink(ctx context.Context, fn func(Link) error) error {
+	return eachLink(ctx, dbs.db, fn)
+}
+
+// Snapshot reads the links, accounts, workspaces and webhooks in a single
+// read-only REPEATABLE READ transaction, so changes committed meanwhile are
+// not seen.
+func (dbs *DatabaseStorage) Snapshot(ctx context.Context, v Visitor) error {
+	tx, err := dbs.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if v.Link != nil {
+		if err := eachLink(ctx, tx, v.Link); err != nil {
+			return err
+		}
+	}
+	if v.Account != nil {
+		if err := eachAccount(ctx, tx, v.Account); err != nil {
+			return err
+		}
+	}
+	if v.Workspace != nil {
+		if err := eachWorkspace(ctx, tx, v.Workspace); err != nil {
+			return err
+		}
+	}
+	if v.Webhook != nil {
+		if err := eachWebhook(ctx, tx, v.Webhook); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// querier runs queries on the pool or in a transaction.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+func eachLink(ctx context.Context, q querier, fn func(Link) error) error {
+	rows, err := q.Query(ctx,
+		`SELECT `+linkColumns+`
+		 FROM database_url
+		 ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (dbs *DatabaseStorage) SetOwner(short string, userID uuid.UUID) error {
+	tag, err := dbs.db.Exec(context.Background(),
+		`UPDATE database_url
+		 SET user_id = $2::uuid
+		 WHERE short_url = $1::text`, short, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (dbs *DatabaseStorage) MergeUsers(from, to uuid.UUID) (int, error) {
+	if from == to {
+		return 0, nil
+	}
+	tag, err := dbs.db.Exec(context.Background(),
+		`UPDATE database_url
+		 SET user_id = $2::uuid
+		 WHERE user_id = $1::uuid`, from, to)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (dbs *DatabaseStorage) CreateAccount(account Account) error {
+	_, err := dbs.db.Exec(context.Background(),
+		`INSERT INTO user_account (username, password_hash, user_id, created_at)
+		 VALUES ($1::text, $2::text, $3::uuid, $4::timestamptz)`,
+		account.Username, account.PasswordHash, account.UserID, account.CreatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		if pgErr.ConstraintName == "user_account_user_id_key" {
+			return ErrHasAccount
+		}
+		return ErrUsernameTaken
+	}
+	return err
+}
+
+func (dbs *DatabaseStorage) GetAccount(username string) (Account, bool) {
+	var account Account
+	err := dbs.db.QueryRow(context.Background(),
+		`SELECT username, password_hash, user_id, created_at
+		 FROM user_account
+		 WHERE username = $1::text`, username).
+		Scan(&account.Username, &account.PasswordHash, &account.UserID, &account.CreatedAt)
+	if err != nil {
+		return Account{}, false
+	}
+	return account, true
+}
+
+func (dbs *DatabaseStorage) GetUserAccount(userID uuid.UUID) (Account, bool) {
+	var account Account
+	err := dbs.db.QueryRow(context.Background(),
+		`SELECT username, password_hash, user_id, created_at
+		 FROM user_account
+		 WHERE user_id = $1::uuid`, userID).
+		Scan(&account.Username, &account.PasswordHash, &account.UserID, &account.CreatedAt)
+	if err != nil {
+		return Account{}, false
+	}
+	return account, true
+}
+
+// EachAccount streams all accounts in the order they were created.
+func (dbs *DatabaseStorage) EachAccount(ctx context.Context, fn func(Account) error) error {
+	return eachAccount(ctx, dbs.db, fn)
+}
+
+func eachAccount(ctx context.Context, q querier, fn func(Account) error) error {
+	rows, err := q.Query(ctx,
+		`SELECT username, password_hash, user_id, created_at
+		 FROM user_account
+		 ORDER BY created_at, username`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var account Account
+		if err := rows.Scan(&account.Username, &account.PasswordHash, &account.UserID, &account.CreatedAt); err != nil {
+			return err
+		}
+		if err := fn(account); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (dbs *DatabaseStorage) CreateWorkspace(ws Workspace, owner uuid.UUID) error {
+	ctx := context.Background()
+	tx, err := dbs.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx,
+		`INSERT INTO workspace (id, name, created_at)
+		 VALUES ($1::uuid, $2::text, $3::timestamptz)`, ws.ID, ws.Name, ws.CreatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return ErrExists
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO workspace_member (workspace_id, user_id, role)
+		 VALUES ($1::uuid, $2::uuid, $3::text)`, ws.ID, owner, RoleOwner)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (dbs *DatabaseStorage) GetWorkspaces(userID uuid.UUID) ([]Membership, error) {
+	rows, err := dbs.db.Query(context.Background(),
+		`SELECT w.id, w.name, w.created_at, m.role
+		 FROM workspace w JOIN workspace_member m ON m.workspace_id = w.id
+		 WHERE m.user_id = $1::uuid
+		 ORDER BY w.created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Membership
+	for rows.Next() {
+		var m Membership
+		if err := rows.Scan(&m.ID, &m.Name, &m.CreatedAt, &m.Role); err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
+
+func (dbs *DatabaseStorage) GetMembers(workspaceID uuid.UUID) ([]Member, error) {
+	rows, err := dbs.db.Query(context.Background(),
+		`SELECT user_id, role
+		 FROM workspace_member
+		 WHERE workspace_id = $1::uuid`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Member
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.UserID, &m.Role); err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, ErrNotFound
+	}
+	return result, nil
+}
+
+// EachWorkspace streams all workspaces with their members, oldest workspace
+// first, with a single query.
+func (dbs *DatabaseStorage) EachWorkspace(ctx context.Context, fn func(Workspace, []Member) error) error {
+	return eachWorkspace(ctx, dbs.db, fn)
+}
+
+func eachWorkspace(ctx context.Context, q querier, fn func(Workspace, []Member) error) error {
+	rows, err := q.Query(ctx,
+		`SELECT w.id, w.name, w.created_at, m.user_id, m.role
+		 FROM workspace w JOIN workspace_member m ON m.workspace_id = w.id
+		 ORDER BY w.created_at, w.id, m.user_id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var ws Workspace
+	var members []Member
+	for rows.Next() {
+		var row Workspace
+		var m Member
+		if err := rows.Scan(&row.ID, &row.Name, &row.CreatedAt, &m.UserID, &m.Role); err != nil {
+			return err
+		}
+		if row.ID != ws.ID && members != nil {
+			if err := fn(ws, members); err != nil {
+				return err
+			}
+			members = nil
+		}
+		ws = row
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if members != nil {
+		return fn(ws, members)
+	}
+	return nil
+}
+
+func (dbs *DatabaseStorage) SetMember(workspaceID uuid.UUID, member Member) error {
+	_, err := dbs.db.Exec(context.Background(),
+		`INSERT INTO workspace_member (workspace_id, user_id, role)
+		 VALUES ($1::uuid, $2::uuid, $3::text)
+		 ON CONFLICT (workspace_id, user_id) DO UPDATE SET role = EXCLUDED.role`,
+		workspaceID, member.UserID, member.Role)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (dbs *DatabaseStorage) RemoveMember(workspaceID, userID uuid.UUID) error {
+	tag, err := dbs.db.Exec(context.Background(),
+		`DELETE FROM workspace_member
+		 WHERE workspace_id = $1::uuid AND user_id = $2::uuid`, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (dbs *DatabaseStorage) AddWebhook(hook Webhook) error {
+	_, err := dbs.db.Exec(context.Background(),
+		`INSERT INTO webhook (id, user_id, url, secret, events, created_at)
+		 VALUES ($1::uuid, $2::uuid, $3::text, $4::text, $5::text[], $6::timestamptz)`,
+		hook.ID, hook.UserID, hook.URL, hook.Secret, hook.Events, hook.CreatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return ErrExists
+	}
+	return err
+}
+
+func (dbs *DatabaseStorage) GetWebhooks(userID uuid.UUID) ([]Webhook, error) {
+	rows, err := dbs.db.Query(context.Background(),
+		`SELECT id, user_id, url, secret, events, created_at
+		 FROM webhook
+		 WHERE user_id = $1::uuid
+		 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Webhook
+	for rows.Next() {
+		var hook Webhook
+		if err := rows.Scan(&hook.ID, &hook.UserID, &hook.URL, &hook.Secret, &hook.Events, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, hook)
+	}
+	return result, rows.Err()
+}
+
+// EachWebhook streams all webhooks, oldest first.
+func (dbs *DatabaseStorage) EachWebhook(ctx context.Context, fn func(Webhook) error) error {
+	return eachWebhook(ctx, dbs.db, fn)
+}
+
+func eachWebhook(ctx context.Context, q querier, fn func(Webhook) error) error {
+	rows, err := q.Query(ctx,
+		`SELECT id, user_id, url, secret, events, created_at
+		 FROM webhook
+		 ORDER BY created_at, id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hook Webhook
+		if err := rows.Scan(&hook.ID, &hook.UserID, &hook.URL, &hook.Secret, &hook.Events, &hook.CreatedAt); err != nil {
+			return err
+		}
+		if err := fn(hook); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (dbs *DatabaseStorage) DeleteWebhook(userID, id uuid.UUID) error {
+	tag, err := dbs.db.Exec(context.Background(),
+		`DELETE FROM webhook
+		 WHERE user_id = $1::uuid AND id = $2::uuid`, userID, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
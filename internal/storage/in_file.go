@@ -2,21 +2,89 @@ package storage
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type FileStorage struct {
+	// mu serializes changes so that records are written in the order they
+	// were applied in memory.
+	mu      sync.Mutex
 	file    *os.File
 	storage DataStorage
+	// clicks are counted here and written as one record per link and
+	// variant every clickFlushInterval and on Close, so the file does not
+	// grow with every redirect. Guarded by mu.
+	clicks    map[clickKey]clickCount
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
+// clickFlushInterval is how often counted clicks are written to the file.
+// Clicks of the last interval are lost if the process crashes.
+const clickFlushInterval = time.Minute
+
+type clickKey struct {
+	short, variant string
+}
+
+type clickCount struct {
+	n int
+	// last is the time of the latest click.
+	last time.Time
+}
+
+// Operations recorded in the file. Records without an operation create a
+// link, which keeps files written by older versions readable.
+const (
+	opDelete   = "delete"
+	opOptions  = "options"
+	opRedeem   = "redeem"
+	opRules    = "rules"
+	opVariants = "variants"
+	opClick    = "click"
+	opOwner    = "owner"
+	opAccount  = "account"
+	// Workspace records carry the workspace in Workspace, member records
+	// its ID and the member in UserID and Role.
+	opWorkspace    = "workspace"
+	opMember       = "member"
+	opRemoveMember = "remove_member"
+	// Webhook records carry the webhook in Webhook, deletions only its ID
+	// and owner.
+	opWebhook       = "webhook"
+	opDeleteWebhook = "delete_webhook"
+)
+
 type url struct {
-	UserID uuid.UUID `json:"userID,omitempty"`
-	Short  string    `json:"short"`
-	Long   string    `json:"long"`
+	Op        string       `json:"op,omitempty"`
+	UserID    uuid.UUID    `json:"userID,omitempty"`
+	Short     string       `json:"short"`
+	Long      string       `json:"long,omitempty"`
+	CreatedAt *time.Time   `json:"created_at,omitempty"`
+	Options   *LinkOptions `json:"options,omitempty"`
+	// Remaining overrides the clicks left after options of restored links
+	// are applied.
+	Remaining *int       `json:"remaining_clicks,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Rules     []Rule     `json:"rules,omitempty"`
+	Variants  []Variant  `json:"variants,omitempty"`
+	Sticky    bool       `json:"sticky,omitempty"`
+	// Variant is the served variant of a click.
+	Variant string `json:"variant,omitempty"`
+	// Clicks is the number of clicks a click record stands for, the
+	// latest at CreatedAt. Zero means one.
+	Clicks    int        `json:"clicks,omitempty"`
+	Account   *Account   `json:"account,omitempty"`
+	Workspace *Workspace `json:"workspace,omitempty"`
+	Role      Role       `json:"role,omitempty"`
+	Webhook   *Webhook   `json:"webhook,omitempty"`
 }
 
 func NewFileStorage(filename string) (*FileStorage, error) {
@@ -24,34 +92,112 @@ func NewFileStorage(filename string) (*FileStorage, error) {
 	if err != nil {
 		return &FileStorage{}, err
 	}
-	return &FileStorage{
+	f := &FileStorage{
 		file:    file,
 		storage: *NewDataStorage(),
-	}, nil
+		clicks:  make(map[clickKey]clickCount),
+		done:    make(chan struct{}),
+	}
+	go f.flushClicksEvery(clickFlushInterval)
+	return f, nil
 }
 
+// Close writes the counted clicks and closes the file.
 func (f *FileStorage) Close() error {
-	return f.file.Close()
+	var err error
+	f.closeOnce.Do(func() {
+		close(f.done)
+		err = f.flushClicks()
+	})
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (f *FileStorage) flushClicksEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// A failed write keeps the counts for the next attempt.
+			f.flushClicks()
+		case <-f.done:
+			return
+		}
+	}
+}
+
+func (f *FileStorage) flushClicks() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, count := range f.clicks {
+		err := f.writeRecord(url{Op: opClick, Short: key.short, Variant: key.variant, Clicks: count.n, CreatedAt: &count.last})
+		if err != nil {
+			return err
+		}
+		delete(f.clicks, key)
+	}
+	return nil
 }
 
 func (f *FileStorage) LoadingDataFromFile() error {
 	scanner := bufio.NewScanner(f.file)
-	var url url
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
 	for scanner.Scan() {
+		var url url
 		data := scanner.Bytes()
 		err := json.Unmarshal(data, &url)
 		if err != nil {
 			return err
 		}
-		f.storage.cache[url.Short] = url.Long
-		if url.UserID != uuid.Nil {
-			if _, ok := f.storage.history[url.UserID]; !ok {
-				f.storage.history[url.UserID] = map[string]string{}
+		switch url.Op {
+		case opDelete:
+			f.storage.Delete(url.UserID, []string{url.Short})
+		case opOptions:
+			f.storage.SetOptions(url.UserID, url.Short, *url.Options)
+			if url.Remaining != nil {
+				f.storage.setRemaining(url.Short, *url.Remaining)
+			}
+		case opRedeem:
+			f.storage.Redeem(url.Short)
+		case opRules:
+			f.storage.SetRules(url.UserID, url.Short, url.Rules)
+		case opVariants:
+			f.storage.SetVariants(url.UserID, url.Short, url.Variants, url.Sticky)
+		case opOwner:
+			f.storage.SetOwner(url.Short, url.UserID)
+		case opClick:
+			click := Click{Short: url.Short, Variant: url.Variant}
+			if url.CreatedAt != nil {
+				click.At = *url.CreatedAt
+			}
+			f.storage.recordClicks(click, max(url.Clicks, 1))
+		case opAccount:
+			f.storage.CreateAccount(*url.Account)
+		case opWorkspace:
+			f.storage.CreateWorkspace(*url.Workspace, url.UserID)
+		case opMember:
+			f.storage.SetMember(url.Workspace.ID, Member{UserID: url.UserID, Role: url.Role})
+		case opRemoveMember:
+			f.storage.RemoveMember(url.Workspace.ID, url.UserID)
+		case opWebhook:
+			f.storage.AddWebhook(*url.Webhook)
+		case opDeleteWebhook:
+			f.storage.DeleteWebhook(url.Webhook.UserID, url.Webhook.ID)
+		default:
+			link := Link{UserID: url.UserID, Short: url.Short, Long: url.Long, Tags: url.Tags}
+			if url.CreatedAt != nil {
+				link.CreatedAt = *url.CreatedAt
+			}
+			if url.ExpiresAt != nil {
+				link.ExpiresAt = *url.ExpiresAt
 			}
-			f.storage.history[url.UserID][url.Short] = url.Long
+			f.storage.add(link)
 		}
 	}
-	return nil
+	return scanner.Err()
 }
 
 func (f *FileStorage) Get(short string) (long string, ok bool) {
@@ -59,23 +205,62 @@ func (f *FileStorage) Get(short string) (long string, ok bool) {
 }
 
 func (f *FileStorage) Set(userID uuid.UUID, short, long string) error {
-	err := f.storage.Set(userID, short, long)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	link := Link{UserID: userID, Short: short, Long: long, CreatedAt: time.Now()}
+	f.storage.add(link)
+	return f.writeRecord(url{
+		UserID:    userID,
+		Short:     short,
+		Long:      long,
+		CreatedAt: &link.CreatedAt,
+	})
+}
+
+// AddLink stores a complete link. Its options, rules and variants are
+// recorded after the link itself, as if they were set later.
+func (f *FileStorage) AddLink(link Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.AddLink(link)
 	if err != nil {
 		return err
 	}
-	err = f.WriteURLInFile(userID, short, long)
-	if err != nil {
-		return err
+	record := url{UserID: link.UserID, Short: link.Short, Long: link.Long, CreatedAt: &link.CreatedAt, Tags: link.Tags}
+	if !link.ExpiresAt.IsZero() {
+		record.ExpiresAt = &link.ExpiresAt
+	}
+	records := []url{record}
+	if link.LinkOptions != (LinkOptions{}) {
+		record := url{Op: opOptions, UserID: link.UserID, Short: link.Short, Options: &link.LinkOptions}
+		if link.RemainingClicks != link.MaxClicks {
+			record.Remaining = &link.RemainingClicks
+		}
+		records = append(records, record)
+	}
+	if len(link.Rules) > 0 {
+		records = append(records, url{Op: opRules, UserID: link.UserID, Short: link.Short, Rules: link.Rules})
+	}
+	if len(link.Variants) > 0 {
+		records = append(records, url{Op: opVariants, UserID: link.UserID, Short: link.Short, Variants: link.Variants, Sticky: link.StickyVariants})
+	}
+	for _, record := range records {
+		if err := f.writeRecord(record); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (f *FileStorage) WriteURLInFile(userID uuid.UUID, short, long string) error {
-	s := url{
+	return f.writeRecord(url{
 		UserID: userID,
 		Short:  short,
 		Long:   long,
-	}
+	})
+}
+
+func (f *FileStorage) writeRecord(s url) error {
 	data, err := json.Marshal(s)
 	if err != nil {
 		return err
@@ -89,5 +274,233 @@ func (f *FileStorage) WriteURLInFile(userID uuid.UUID, short, long string) error
 }
 
 func (f *FileStorage) GetHistory(userID uuid.UUID) (map[string]string, error) {
-	return f.storage.history[userID], nil
+	return f.storage.GetHistory(userID)
+}
+
+func (f *FileStorage) GetUserLinks(userID uuid.UUID, filter LinkFilter) ([]Link, error) {
+	return f.storage.GetUserLinks(userID, filter)
+}
+
+func (f *FileStorage) EachUserLink(ctx context.Context, userID uuid.UUID, fn func(Link) error) error {
+	return f.storage.EachUserLink(ctx, userID, fn)
+}
+
+func (f *FileStorage) Delete(userID uuid.UUID, shorts []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.Delete(userID, shorts)
+	if err != nil {
+		return err
+	}
+	for _, short := range shorts {
+		err = f.writeRecord(url{Op: opDelete, UserID: userID, Short: short})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileStorage) CountURLs() (int, error) {
+	return f.storage.CountURLs()
+}
+
+func (f *FileStorage) CountUsers() (int, error) {
+	return f.storage.CountUsers()
+}
+
+func (f *FileStorage) GetLink(short string) (Link, bool) {
+	return f.storage.GetLink(short)
+}
+
+func (f *FileStorage) SetOptions(userID uuid.UUID, short string, opts LinkOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.SetOptions(userID, short, opts)
+	if err != nil {
+		return err
+	}
+	return f.writeRecord(url{Op: opOptions, UserID: userID, Short: short, Options: &opts})
+}
+
+func (f *FileStorage) Redeem(short string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	remaining, err := f.storage.Redeem(short)
+	if err != nil {
+		return 0, err
+	}
+	return remaining, f.writeRecord(url{Op: opRedeem, Short: short})
+}
+
+func (f *FileStorage) SetRules(userID uuid.UUID, short string, rules []Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.SetRules(userID, short, rules)
+	if err != nil {
+		return err
+	}
+	return f.writeRecord(url{Op: opRules, UserID: userID, Short: short, Rules: rules})
+}
+
+func (f *FileStorage) SetVariants(userID uuid.UUID, short string, variants []Variant, sticky bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.SetVariants(userID, short, variants, sticky)
+	if err != nil {
+		return err
+	}
+	return f.writeRecord(url{Op: opVariants, UserID: userID, Short: short, Variants: variants, Sticky: sticky})
+}
+
+func (f *FileStorage) RecordClick(click Click) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.RecordClick(click)
+	if err != nil {
+		return err
+	}
+	key := clickKey{short: click.Short, variant: click.Variant}
+	count := f.clicks[key]
+	count.n++
+	if click.At.After(count.last) {
+		count.last = click.At
+	}
+	f.clicks[key] = count
+	return nil
+}
+
+func (f *FileStorage) GetClickStats(short string) (ClickStats, error) {
+	return f.storage.GetClickStats(short)
+}
+
+func (f *FileStorage) EachLink(ctx context.Context, fn func(Link) error) error {
+	return f.storage.EachLink(ctx, fn)
+}
+
+// Snapshot copies the links, accounts, workspaces and webhooks while
+// holding off changes, so the view matches a prefix of the file, and calls
+// v once changes may go on.
+func (f *FileStorage) Snapshot(ctx context.Context, v Visitor) error {
+	f.mu.Lock()
+	f.storage.RLock()
+	snap := f.storage.snapshotLocked(v)
+	f.storage.RUnlock()
+	f.mu.Unlock()
+	return snap.visit(ctx, v)
+}
+
+func (f *FileStorage) SetOwner(short string, userID uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.SetOwner(short, userID)
+	if err != nil {
+		return err
+	}
+	return f.writeRecord(url{Op: opOwner, UserID: userID, Short: short})
+}
+
+// MergeUsers moves all links of from to to. Every moved link is recorded as
+// a change of owner.
+func (f *FileStorage) MergeUsers(from, to uuid.UUID) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.storage.Lock()
+	shorts := f.storage.mergeLocked(from, to)
+	f.storage.Unlock()
+	for _, short := range shorts {
+		if err := f.writeRecord(url{Op: opOwner, UserID: to, Short: short}); err != nil {
+			return 0, err
+		}
+	}
+	return len(shorts), nil
+}
+
+func (f *FileStorage) CreateAccount(account Account) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.CreateAccount(account)
+	if err != nil {
+		return err
+	}
+	return f.writeRecord(url{Op: opAccount, Account: &account})
+}
+
+func (f *FileStorage) GetAccount(username string) (Account, bool) {
+	return f.storage.GetAccount(username)
+}
+
+func (f *FileStorage) GetUserAccount(userID uuid.UUID) (Account, bool) {
+	return f.storage.GetUserAccount(userID)
+}
+
+func (f *FileStorage) EachAccount(ctx context.Context, fn func(Account) error) error {
+	return f.storage.EachAccount(ctx, fn)
+}
+
+func (f *FileStorage) CreateWorkspace(ws Workspace, owner uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.CreateWorkspace(ws, owner)
+	if err != nil {
+		return err
+	}
+	return f.writeRecord(url{Op: opWorkspace, UserID: owner, Workspace: &ws})
+}
+
+func (f *FileStorage) GetWorkspaces(userID uuid.UUID) ([]Membership, error) {
+	return f.storage.GetWorkspaces(userID)
+}
+
+func (f *FileStorage) GetMembers(workspaceID uuid.UUID) ([]Member, error) {
+	return f.storage.GetMembers(workspaceID)
+}
+
+func (f *FileStorage) EachWorkspace(ctx context.Context, fn func(Workspace, []Member) error) error {
+	return f.storage.EachWorkspace(ctx, fn)
+}
+
+func (f *FileStorage) SetMember(workspaceID uuid.UUID, member Member) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.SetMember(workspaceID, member)
+	if err != nil {
+		return err
+	}
+	return f.writeRecord(url{Op: opMember, UserID: member.UserID, Role: member.Role, Workspace: &Workspace{ID: workspaceID}})
+}
+
+func (f *FileStorage) RemoveMember(workspaceID, userID uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.RemoveMember(workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	return f.writeRecord(url{Op: opRemoveMember, UserID: userID, Workspace: &Workspace{ID: workspaceID}})
+}
+
+func (f *FileStorage) AddWebhook(hook Webhook) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.storage.AddWebhook(hook)
+	return f.writeRecord(url{Op: opWebhook, Webhook: &hook})
+}
+
+func (f *FileStorage) GetWebhooks(userID uuid.UUID) ([]Webhook, error) {
+	return f.storage.GetWebhooks(userID)
+}
+
+func (f *FileStorage) DeleteWebhook(userID, id uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.storage.DeleteWebhook(userID, id)
+	if err != nil {
+		return err
+	}
+	return f.writeRecord(url{Op: opDeleteWebhook, Webhook: &Webhook{ID: id, UserID: userID}})
+}
+
+func (f *FileStorage) EachWebhook(ctx context.Context, fn func(Webhook) error) error {
+	return f.storage.EachWebhook(ctx, fn)
 }
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reopenFileStorage(t *testing.T, path string) *FileStorage {
+	fs, err := NewFileStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, fs.LoadingDataFromFile())
+	t.Cleanup(func() { fs.Close() })
+	return fs
+}
+
+func TestFileStorageReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.log")
+	userID := uuid.New()
+
+	fs := reopenFileStorage(t, path)
+	require.NoError(t, fs.Set(userID, "abc", "https://a.ru"))
+	require.NoError(t, fs.Set(userID, "def", "https://b.ru"))
+	require.NoError(t, fs.SetOptions(userID, "abc", LinkOptions{Title: "A", Interstitial: true}))
+	require.NoError(t, fs.SetRules(userID, "abc", []Rule{{OS: []string{"ios"}, Destination: "https://c.ru"}}))
+	require.NoError(t, fs.SetVariants(userID, "abc", []Variant{{Name: "a", Destination: "https://d.ru", Weight: 1}}, true))
+	require.NoError(t, fs.RecordClick(Click{Short: "abc", Variant: "a", At: time.Now()}))
+	require.NoError(t, fs.RecordClick(Click{Short: "abc", Variant: "a", At: time.Now()}))
+	require.NoError(t, fs.Delete(userID, []string{"def"}))
+	require.NoError(t, fs.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(data, []byte(`"op":"click"`)), "clicks are written as one record")
+
+	fs = reopenFileStorage(t, path)
+	link, ok := fs.GetLink("abc")
+	require.True(t, ok)
+	assert.Equal(t, "https://a.ru", link.Long)
+	assert.Equal(t, LinkOptions{Title: "A", Interstitial: true}, link.LinkOptions)
+	assert.False(t, link.CreatedAt.IsZero())
+	assert.Equal(t, []Rule{{OS: []string{"ios"}, Destination: "https://c.ru"}}, link.Rules)
+	assert.Equal(t, []Variant{{Name: "a", Destination: "https://d.ru", Weight: 1}}, link.Variants)
+	assert.True(t, link.StickyVariants)
+	stats, err := fs.GetClickStats("abc")
+	require.NoError(t, err)
+	assert.Equal(t, ClickStats{Total: 2, Variants: map[string]int{"a": 2}}, stats)
+	_, ok = fs.Get("def")
+	assert.False(t, ok)
+
+	history, err := fs.GetHistory(userID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"abc": "https://a.ru"}, history)
+}
+
+func TestFileStorageLongRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.log")
+	long := "https://a.ru/?q=" + strings.Repeat("a", 100*1024)
+
+	fs := reopenFileStorage(t, path)
+	require.NoError(t, fs.Set(uuid.New(), "abc", long))
+
+	fs = reopenFileStorage(t, path)
+	got, ok := fs.Get("abc")
+	require.True(t, ok)
+	assert.Equal(t, long, got)
+}
+
+func TestFileStorageAddLink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.log")
+	link := Link{
+		UserID:          uuid.New(),
+		Short:           "alias",
+		Long:            "https://a.ru",
+		CreatedAt:       time.Now().UTC().Truncate(time.Second),
+		ExpiresAt:       time.Now().UTC().Add(time.Hour).Truncate(time.Second),
+		Tags:            []string{"a", "b"},
+		RemainingClicks: 2,
+		Rules:           []Rule{{Languages: []string{"de"}, Destination: "https://a.de"}},
+		LinkOptions:     LinkOptions{Title: "A", MaxClicks: 5},
+	}
+
+	fs := reopenFileStorage(t, path)
+	require.NoError(t, fs.AddLink(link))
+	assert.ErrorIs(t, fs.AddLink(link), ErrExists)
+
+	fs = reopenFileStorage(t, path)
+	got, ok := fs.GetLink("alias")
+	require.True(t, ok)
+	assert.Equal(t, link, got)
+}
+
+func TestFileStorageAddLinkWithUsedClicks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.log")
+	link := Link{UserID: uuid.New(), Short: "many", Long: "https://a.ru", LinkOptions: LinkOptions{MaxClicks: 1000000}}
+
+	fs := reopenFileStorage(t, path)
+	require.NoError(t, fs.AddLink(link))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(data, []byte("\n")))
+
+	fs = reopenFileStorage(t, path)
+	got, ok := fs.GetLink("many")
+	require.True(t, ok)
+	assert.Equal(t, 0, got.RemainingClicks)
+	_, err = fs.Redeem("many")
+	assert.ErrorIs(t, err, ErrExhausted)
+}
+
+func TestFileStorageMergeUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.log")
+	from, to := uuid.New(), uuid.New()
+
+	fs := reopenFileStorage(t, path)
+	require.NoError(t, fs.Set(from, "a", "https://a.ru"))
+	require.NoError(t, fs.Set(from, "b", "https://b.ru"))
+	require.NoError(t, fs.Set(to, "c", "https://c.ru"))
+	n, err := fs.MergeUsers(from, to)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	fs = reopenFileStorage(t, path)
+	history, err := fs.GetHistory(to)
+	require.NoError(t, err)
+	assert.Len(t, history, 3)
+	history, err = fs.GetHistory(from)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+	users, _ := fs.CountUsers()
+	assert.Equal(t, 1, users)
+}
+
+func TestFileStorageAccounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.log")
+	account := Account{Username: "alice", PasswordHash: "hash", UserID: uuid.New(), CreatedAt: time.Now().UTC()}
+
+	fs := reopenFileStorage(t, path)
+	require.NoError(t, fs.CreateAccount(account))
+	assert.ErrorIs(t, fs.CreateAccount(Account{Username: "alice", UserID: uuid.New()}), ErrUsernameTaken)
+	assert.ErrorIs(t, fs.CreateAccount(Account{Username: "bob", UserID: account.UserID}), ErrHasAccount)
+
+	fs = reopenFileStorage(t, path)
+	got, ok := fs.GetAccount("alice")
+	require.True(t, ok)
+	assert.Equal(t, account.UserID, got.UserID)
+	assert.Equal(t, "hash", got.PasswordHash)
+	_, ok = fs.GetAccount("bob")
+	assert.False(t, ok)
+}
+
+func TestFileStorageWorkspaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.log")
+	owner, member := uuid.New(), uuid.New()
+	ws := Workspace{ID: uuid.New(), Name: "Team", CreatedAt: time.Now().UTC()}
+
+	fs := reopenFileStorage(t, path)
+	require.NoError(t, fs.CreateWorkspace(ws, owner))
+	require.NoError(t, fs.SetMember(ws.ID, Member{UserID: member, Role: RoleViewer}))
+	require.NoError(t, fs.SetMember(ws.ID, Member{UserID: member, Role: RoleEditor}))
+	assert.ErrorIs(t, fs.SetMember(uuid.New(), Member{UserID: member, Role: RoleEditor}), ErrNotFound)
+
+	fs = reopenFileStorage(t, path)
+	memberships, err := fs.GetWorkspaces(member)
+	require.NoError(t, err)
+	require.Len(t, memberships, 1)
+	assert.Equal(t, "Team", memberships[0].Name)
+	assert.Equal(t, RoleEditor, memberships[0].Role)
+
+	require.NoError(t, fs.RemoveMember(ws.ID, member))
+	fs = reopenFileStorage(t, path)
+	members, err := fs.GetMembers(ws.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []Member{{UserID: owner, Role: RoleOwner}}, members)
+}
+
+func TestFileStorageWebhooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.log")
+	userID := uuid.New()
+	first := Webhook{ID: uuid.New(), UserID: userID, URL: "https://crm.test/a", Secret: "s1", Events: []string{"link.created"}, CreatedAt: time.Now().UTC()}
+	second := Webhook{ID: uuid.New(), UserID: userID, URL: "https://crm.test/b", Secret: "s2", Events: []string{"link.clicked"}, CreatedAt: time.Now().UTC()}
+
+	fs := reopenFileStorage(t, path)
+	require.NoError(t, fs.AddWebhook(first))
+	require.NoError(t, fs.AddWebhook(second))
+	require.NoError(t, fs.DeleteWebhook(userID, first.ID))
+	assert.ErrorIs(t, fs.DeleteWebhook(uuid.New(), second.ID), ErrNotFound)
+
+	fs = reopenFileStorage(t, path)
+	hooks, err := fs.GetWebhooks(userID)
+	require.NoError(t, err)
+	require.Len(t, hooks, 1)
+	assert.Equal(t, second.URL, hooks[0].URL)
+	assert.Equal(t, "s2", hooks[0].Secret)
+	assert.True(t, hooks[0].Subscribed("link.clicked"))
+}
+
+func TestFileStorageSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.log")
+	generated := 0
+	generate := func() string {
+		generated++
+		return "s3cret"
+	}
+
+	fs := reopenFileStorage(t, path)
+	secret, err := fs.Secret(context.Background(), "cookie-key", generate)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", secret)
+
+	fs = reopenFileStorage(t, path)
+	secret, err = fs.Secret(context.Background(), "cookie-key", generate)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", secret)
+	assert.Equal(t, 1, generated)
+	info, err := os.Stat(path + ".cookie-key")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
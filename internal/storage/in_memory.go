@@ -1,50 +1,663 @@
 package storage
 
 import (
-	"github.com/google/uuid"
+	"context"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 type URLStorage interface {
 	Get(string) (string, bool)
 	Set(uuid.UUID, string, string) error
 	GetHistory(uuid.UUID) (map[string]string, error)
+	Delete(uuid.UUID, []string) error
+	CountURLs() (int, error)
+	CountUsers() (int, error)
+	GetLink(string) (Link, bool)
+	SetOptions(uuid.UUID, string, LinkOptions) error
+	GetUserLinks(uuid.UUID, LinkFilter) ([]Link, error)
+	Redeem(string) (int, error)
+	SetRules(uuid.UUID, string, []Rule) error
+	SetVariants(uuid.UUID, string, []Variant, bool) error
+	RecordClick(Click) error
+	GetClickStats(string) (ClickStats, error)
+	AddLink(Link) error
+	EachLink(context.Context, func(Link) error) error
+	EachUserLink(context.Context, uuid.UUID, func(Link) error) error
+	Snapshot(context.Context, Visitor) error
+	SetOwner(string, uuid.UUID) error
+	MergeUsers(from, to uuid.UUID) (int, error)
+	CreateAccount(Account) error
+	GetAccount(string) (Account, bool)
+	GetUserAccount(uuid.UUID) (Account, bool)
+	EachAccount(context.Context, func(Account) error) error
+	CreateWorkspace(Workspace, uuid.UUID) error
+	GetWorkspaces(uuid.UUID) ([]Membership, error)
+	GetMembers(uuid.UUID) ([]Member, error)
+	EachWorkspace(context.Context, func(Workspace, []Member) error) error
+	SetMember(uuid.UUID, Member) error
+	RemoveMember(workspaceID, userID uuid.UUID) error
+	AddWebhook(Webhook) error
+	GetWebhooks(uuid.UUID) ([]Webhook, error)
+	DeleteWebhook(userID, id uuid.UUID) error
+	EachWebhook(context.Context, func(Webhook) error) error
 }
 
 type DataStorage struct {
 	sync.RWMutex
-	cache   map[string]string
-	history map[uuid.UUID]map[string]string
+	links   map[string]*Link
+	history map[uuid.UUID]map[string]struct{}
+	clicks  map[string]*ClickStats
+	// accounts are keyed by username, accountUsers maps users with an
+	// account to its username.
+	accounts     map[string]Account
+	accountUsers map[uuid.UUID]string
+
+	workspaces map[uuid.UUID]Workspace
+	members    map[uuid.UUID]map[uuid.UUID]Role
+
+	webhooks map[uuid.UUID][]Webhook
 }
 
 func NewDataStorage() *DataStorage {
 	return &DataStorage{
-		cache:   make(map[string]string),
-		history: make(map[uuid.UUID]map[string]string),
+		links:   make(map[string]*Link),
+		history: make(map[uuid.UUID]map[string]struct{}),
+		clicks:  make(map[string]*ClickStats),
+
+		accounts:     make(map[string]Account),
+		accountUsers: make(map[uuid.UUID]string),
+
+		workspaces: make(map[uuid.UUID]Workspace),
+		members:    make(map[uuid.UUID]map[uuid.UUID]Role),
+
+		webhooks: make(map[uuid.UUID][]Webhook),
 	}
 }
 
 func (ds *DataStorage) Get(key string) (string, bool) {
 	ds.RLock()
 	defer ds.RUnlock()
-	value, ok := ds.cache[key]
-	return value, ok
+	link, ok := ds.links[key]
+	if !ok {
+		return "", false
+	}
+	return link.Long, true
 }
 
 func (ds *DataStorage) Set(userID uuid.UUID, key, value string) error {
+	ds.add(Link{UserID: userID, Short: key, Long: value, CreatedAt: time.Now()})
+	return nil
+}
+
+func (ds *DataStorage) add(link Link) {
 	ds.Lock()
 	defer ds.Unlock()
-	if userID != uuid.Nil {
-		if _, ok := ds.history[userID]; !ok {
-			ds.history[userID] = map[string]string{}
+	ds.addLocked(link)
+}
+
+// addLocked stores link and records it in the history of its owner. Links
+// without an owner, written by versions that did not issue a user to every
+// client, are kept out of the history.
+func (ds *DataStorage) addLocked(link Link) {
+	if link.UserID != uuid.Nil {
+		if _, ok := ds.history[link.UserID]; !ok {
+			ds.history[link.UserID] = map[string]struct{}{}
 		}
-		ds.history[userID][key] = value
+		ds.history[link.UserID][link.Short] = struct{}{}
+	}
+	ds.links[link.Short] = &link
+}
+
+// AddLink stores a complete link, failing with ErrExists if its short URL
+// is taken.
+func (ds *DataStorage) AddLink(link Link) error {
+	ds.Lock()
+	defer ds.Unlock()
+	if _, ok := ds.links[link.Short]; ok {
+		return ErrExists
 	}
-	ds.cache[key] = value
+	ds.addLocked(link)
 	return nil
 }
 
 func (ds *DataStorage) GetHistory(uuid uuid.UUID) (map[string]string, error) {
-	result := ds.history[uuid]
+	ds.RLock()
+	defer ds.RUnlock()
+	result := make(map[string]string, len(ds.history[uuid]))
+	for short := range ds.history[uuid] {
+		result[short] = ds.links[short].Long
+	}
+	return result, nil
+}
+
+func (ds *DataStorage) GetUserLinks(userID uuid.UUID, filter LinkFilter) ([]Link, error) {
+	ds.RLock()
+	defer ds.RUnlock()
+	var result []Link
+	for short := range ds.history[userID] {
+		if link := ds.links[short]; filter.match(link) {
+			result = append(result, *link)
+		}
+	}
+	return result, nil
+}
+
+// EachUserLink calls fn for every link of userID, oldest first. The links
+// are copied first, so fn may take its time.
+func (ds *DataStorage) EachUserLink(ctx context.Context, userID uuid.UUID, fn func(Link) error) error {
+	ds.RLock()
+	links := make([]Link, 0, len(ds.history[userID]))
+	for short := range ds.history[userID] {
+		links = append(links, *ds.links[short])
+	}
+	ds.RUnlock()
+	sort.Slice(links, func(i, j int) bool {
+		if !links[i].CreatedAt.Equal(links[j].CreatedAt) {
+			return links[i].CreatedAt.Before(links[j].CreatedAt)
+		}
+		return links[i].Short < links[j].Short
+	})
+
+	for _, link := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the given short URLs owned by userID. Short URLs that do
+// not exist or belong to another user are ignored.
+func (ds *DataStorage) Delete(userID uuid.UUID, shorts []string) error {
+	ds.Lock()
+	defer ds.Unlock()
+	for _, short := range shorts {
+		if link, ok := ds.links[short]; !ok || link.UserID != userID {
+			continue
+		}
+		delete(ds.history[userID], short)
+		delete(ds.links, short)
+		delete(ds.clicks, short)
+	}
+	if len(ds.history[userID]) == 0 {
+		delete(ds.history, userID)
+	}
+	return nil
+}
+
+func (ds *DataStorage) CountURLs() (int, error) {
+	ds.RLock()
+	defer ds.RUnlock()
+	return len(ds.links), nil
+}
+
+// CountUsers returns the number of users owning at least one URL.
+func (ds *DataStorage) CountUsers() (int, error) {
+	ds.RLock()
+	defer ds.RUnlock()
+	return len(ds.history), nil
+}
+
+func (ds *DataStorage) GetLink(short string) (Link, bool) {
+	ds.RLock()
+	defer ds.RUnlock()
+	link, ok := ds.links[short]
+	if !ok {
+		return Link{}, false
+	}
+	return *link, true
+}
+
+// SetOptions replaces the options of a link owned by userID.
+func (ds *DataStorage) SetOptions(userID uuid.UUID, short string, opts LinkOptions) error {
+	ds.Lock()
+	defer ds.Unlock()
+	link, ok := ds.links[short]
+	if !ok || link.UserID != userID {
+		return ErrNotFound
+	}
+	if link.MaxClicks != opts.MaxClicks {
+		link.RemainingClicks = opts.MaxClicks
+	}
+	link.LinkOptions = opts
+	return nil
+}
+
+// setRemaining sets the clicks left of a link, for links restored with
+// some of their clicks used up.
+func (ds *DataStorage) setRemaining(short string, remaining int) {
+	ds.Lock()
+	defer ds.Unlock()
+	if link, ok := ds.links[short]; ok {
+		link.RemainingClicks = remaining
+	}
+}
+
+// Redeem uses up one click of a link limited by MaxClicks and returns the
+// number of clicks left.
+func (ds *DataStorage) Redeem(short string) (int, error) {
+	ds.Lock()
+	defer ds.Unlock()
+	link, ok := ds.links[short]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if link.MaxClicks == 0 || link.RemainingClicks <= 0 {
+		return 0, ErrExhausted
+	}
+	link.RemainingClicks--
+	return link.RemainingClicks, nil
+}
+
+// SetRules replaces the targeting rules of a link owned by userID.
+func (ds *DataStorage) SetRules(userID uuid.UUID, short string, rules []Rule) error {
+	ds.Lock()
+	defer ds.Unlock()
+	link, ok := ds.links[short]
+	if !ok || link.UserID != userID {
+		return ErrNotFound
+	}
+	link.Rules = rules
+	return nil
+}
+
+// SetVariants replaces the destinations visitors of a link owned by userID
+// are split between.
+func (ds *DataStorage) SetVariants(userID uuid.UUID, short string, variants []Variant, sticky bool) error {
+	ds.Lock()
+	defer ds.Unlock()
+	link, ok := ds.links[short]
+	if !ok || link.UserID != userID {
+		return ErrNotFound
+	}
+	link.Variants = variants
+	link.StickyVariants = sticky
+	return nil
+}
+
+func (ds *DataStorage) RecordClick(click Click) error {
+	return ds.recordClicks(click, 1)
+}
+
+// recordClicks counts n clicks like click.
+func (ds *DataStorage) recordClicks(click Click, n int) error {
+	ds.Lock()
+	defer ds.Unlock()
+	if _, ok := ds.links[click.Short]; !ok {
+		return ErrNotFound
+	}
+	stats, ok := ds.clicks[click.Short]
+	if !ok {
+		stats = &ClickStats{}
+		ds.clicks[click.Short] = stats
+	}
+	stats.Total += n
+	if click.Variant != "" {
+		if stats.Variants == nil {
+			stats.Variants = map[string]int{}
+		}
+		stats.Variants[click.Variant] += n
+	}
+	return nil
+}
+
+func (ds *DataStorage) GetClickStats(short string) (ClickStats, error) {
+	ds.RLock()
+	defer ds.RUnlock()
+	if _, ok := ds.links[short]; !ok {
+		return ClickStats{}, ErrNotFound
+	}
+	stats, ok := ds.clicks[short]
+	if !ok {
+		return ClickStats{}, nil
+	}
+	result := ClickStats{Total: stats.Total}
+	if stats.Variants != nil {
+		result.Variants = make(map[string]int, len(stats.Variants))
+		for name, n := range stats.Variants {
+			result.Variants[name] = n
+		}
+	}
 	return result, nil
 }
+
+// EachLink calls fn for every stored link, including links without a
+// user, until fn returns an error or ctx is done. The lock is not held
+// while fn runs, so fn may use the storage; links added meanwhile may be
+// missed and deleted ones are skipped.
+func (ds *DataStorage) EachLink(ctx context.Context, fn func(Link) error) error {
+	ds.RLock()
+	shorts := make([]string, 0, len(ds.links))
+	for short := range ds.links {
+		shorts = append(shorts, short)
+	}
+	ds.RUnlock()
+
+	for _, short := range shorts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		link, ok := ds.GetLink(short)
+		if !ok {
+			continue
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Visitor holds the functions Snapshot calls for the items of a storage.
+// Items of a kind without a function are skipped.
+type Visitor struct {
+	Link      func(Link) error
+	Account   func(Account) error
+	Workspace func(Workspace, []Member) error
+	Webhook   func(Webhook) error
+}
+
+// Snapshot calls v for every link, then every account, workspace and
+// webhook, as of a single point in time. The items are copied under the read lock
+// and handed to v after it is released, so a slow v, such as a download of
+// a backup, does not hold off writers.
+func (ds *DataStorage) Snapshot(ctx context.Context, v Visitor) error {
+	ds.RLock()
+	snap := ds.snapshotLocked(v)
+	ds.RUnlock()
+	return snap.visit(ctx, v)
+}
+
+// snapshot is a copy of the items of a storage taken for a Visitor.
+type snapshot struct {
+	links      []Link
+	accounts   []Account
+	workspaces []workspaceMembers
+	webhooks   []Webhook
+}
+
+type workspaceMembers struct {
+	ws      Workspace
+	members []Member
+}
+
+// snapshotLocked copies the items of the kinds v visits, accounts in the
+// order of their usernames, workspaces and webhooks oldest first. The
+// caller holds the lock.
+func (ds *DataStorage) snapshotLocked(v Visitor) snapshot {
+	var snap snapshot
+	if v.Link != nil {
+		snap.links = make([]Link, 0, len(ds.links))
+		for _, link := range ds.links {
+			snap.links = append(snap.links, *link)
+		}
+	}
+	if v.Account != nil {
+		snap.accounts = make([]Account, 0, len(ds.accounts))
+		for _, account := range ds.accounts {
+			snap.accounts = append(snap.accounts, account)
+		}
+		sort.Slice(snap.accounts, func(i, j int) bool { return snap.accounts[i].Username < snap.accounts[j].Username })
+	}
+	if v.Workspace != nil {
+		snap.workspaces = make([]workspaceMembers, 0, len(ds.workspaces))
+		for id, ws := range ds.workspaces {
+			members := make([]Member, 0, len(ds.members[id]))
+			for userID, role := range ds.members[id] {
+				members = append(members, Member{UserID: userID, Role: role})
+			}
+			sort.Slice(members, func(i, j int) bool { return members[i].UserID.String() < members[j].UserID.String() })
+			snap.workspaces = append(snap.workspaces, workspaceMembers{ws: ws, members: members})
+		}
+		all := snap.workspaces
+		sort.Slice(all, func(i, j int) bool {
+			if !all[i].ws.CreatedAt.Equal(all[j].ws.CreatedAt) {
+				return all[i].ws.CreatedAt.Before(all[j].ws.CreatedAt)
+			}
+			return all[i].ws.ID.String() < all[j].ws.ID.String()
+		})
+	}
+	if v.Webhook != nil {
+		for _, hooks := range ds.webhooks {
+			snap.webhooks = append(snap.webhooks, hooks...)
+		}
+		hooks := snap.webhooks
+		sort.Slice(hooks, func(i, j int) bool {
+			if !hooks[i].CreatedAt.Equal(hooks[j].CreatedAt) {
+				return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+			}
+			return hooks[i].ID.String() < hooks[j].ID.String()
+		})
+	}
+	return snap
+}
+
+func (snap snapshot) visit(ctx context.Context, v Visitor) error {
+	for _, link := range snap.links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := v.Link(link); err != nil {
+			return err
+		}
+	}
+	for _, account := range snap.accounts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := v.Account(account); err != nil {
+			return err
+		}
+	}
+	for _, w := range snap.workspaces {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := v.Workspace(w.ws, w.members); err != nil {
+			return err
+		}
+	}
+	for _, hook := range snap.webhooks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := v.Webhook(hook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetOwner moves a link to userID.
+func (ds *DataStorage) SetOwner(short string, userID uuid.UUID) error {
+	ds.Lock()
+	defer ds.Unlock()
+	link, ok := ds.links[short]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(ds.history[link.UserID], short)
+	if len(ds.history[link.UserID]) == 0 {
+		delete(ds.history, link.UserID)
+	}
+	link.UserID = userID
+	ds.addLocked(*link)
+	return nil
+}
+
+// MergeUsers moves all links of from to to and returns how many were
+// moved.
+func (ds *DataStorage) MergeUsers(from, to uuid.UUID) (int, error) {
+	ds.Lock()
+	defer ds.Unlock()
+	return len(ds.mergeLocked(from, to)), nil
+}
+
+func (ds *DataStorage) mergeLocked(from, to uuid.UUID) []string {
+	if from == to {
+		return nil
+	}
+	shorts := make([]string, 0, len(ds.history[from]))
+	for short := range ds.history[from] {
+		link := ds.links[short]
+		link.UserID = to
+		ds.addLocked(*link)
+		shorts = append(shorts, short)
+	}
+	delete(ds.history, from)
+	return shorts
+}
+
+// CreateAccount stores an account for a user that has none.
+func (ds *DataStorage) CreateAccount(account Account) error {
+	ds.Lock()
+	defer ds.Unlock()
+	if _, ok := ds.accounts[account.Username]; ok {
+		return ErrUsernameTaken
+	}
+	if _, ok := ds.accountUsers[account.UserID]; ok {
+		return ErrHasAccount
+	}
+	ds.accounts[account.Username] = account
+	ds.accountUsers[account.UserID] = account.Username
+	return nil
+}
+
+func (ds *DataStorage) GetAccount(username string) (Account, bool) {
+	ds.RLock()
+	defer ds.RUnlock()
+	account, ok := ds.accounts[username]
+	return account, ok
+}
+
+// GetUserAccount returns the account of userID, if it has one.
+func (ds *DataStorage) GetUserAccount(userID uuid.UUID) (Account, bool) {
+	ds.RLock()
+	defer ds.RUnlock()
+	username, ok := ds.accountUsers[userID]
+	if !ok {
+		return Account{}, false
+	}
+	return ds.accounts[username], true
+}
+
+// EachAccount calls fn for every account in the order of their usernames.
+// The accounts are copied first, so fn may take its time.
+func (ds *DataStorage) EachAccount(ctx context.Context, fn func(Account) error) error {
+	return ds.Snapshot(ctx, Visitor{Account: fn})
+}
+
+// CreateWorkspace stores a new workspace with owner as its first member.
+func (ds *DataStorage) CreateWorkspace(ws Workspace, owner uuid.UUID) error {
+	ds.Lock()
+	defer ds.Unlock()
+	if _, ok := ds.workspaces[ws.ID]; ok {
+		return ErrExists
+	}
+	ds.workspaces[ws.ID] = ws
+	ds.members[ws.ID] = map[uuid.UUID]Role{owner: RoleOwner}
+	return nil
+}
+
+// GetWorkspaces returns the workspaces userID is a member of.
+func (ds *DataStorage) GetWorkspaces(userID uuid.UUID) ([]Membership, error) {
+	ds.RLock()
+	defer ds.RUnlock()
+	var result []Membership
+	for id, members := range ds.members {
+		if role, ok := members[userID]; ok {
+			result = append(result, Membership{Workspace: ds.workspaces[id], Role: role})
+		}
+	}
+	return result, nil
+}
+
+func (ds *DataStorage) GetMembers(workspaceID uuid.UUID) ([]Member, error) {
+	ds.RLock()
+	defer ds.RUnlock()
+	members, ok := ds.members[workspaceID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	result := make([]Member, 0, len(members))
+	for userID, role := range members {
+		result = append(result, Member{UserID: userID, Role: role})
+	}
+	return result, nil
+}
+
+// EachWorkspace calls fn for every workspace with its members, oldest
+// workspace first. The workspaces are copied first, so fn may take its
+// time.
+func (ds *DataStorage) EachWorkspace(ctx context.Context, fn func(Workspace, []Member) error) error {
+	return ds.Snapshot(ctx, Visitor{Workspace: fn})
+}
+
+// SetMember adds a member to a workspace or changes the role of a member.
+func (ds *DataStorage) SetMember(workspaceID uuid.UUID, member Member) error {
+	ds.Lock()
+	defer ds.Unlock()
+	members, ok := ds.members[workspaceID]
+	if !ok {
+		return ErrNotFound
+	}
+	members[member.UserID] = member.Role
+	return nil
+}
+
+func (ds *DataStorage) RemoveMember(workspaceID, userID uuid.UUID) error {
+	ds.Lock()
+	defer ds.Unlock()
+	if _, ok := ds.members[workspaceID][userID]; !ok {
+		return ErrNotFound
+	}
+	delete(ds.members[workspaceID], userID)
+	return nil
+}
+
+func (ds *DataStorage) AddWebhook(hook Webhook) error {
+	ds.Lock()
+	defer ds.Unlock()
+	ds.webhooks[hook.UserID] = append(ds.webhooks[hook.UserID], hook)
+	return nil
+}
+
+// GetWebhooks returns the webhooks of userID in the order they were added.
+func (ds *DataStorage) GetWebhooks(userID uuid.UUID) ([]Webhook, error) {
+	ds.RLock()
+	defer ds.RUnlock()
+	hooks := ds.webhooks[userID]
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	return append([]Webhook(nil), hooks...), nil
+}
+
+// EachWebhook calls fn for every webhook, oldest first. The webhooks are
+// copied first, so fn may take its time.
+func (ds *DataStorage) EachWebhook(ctx context.Context, fn func(Webhook) error) error {
+	return ds.Snapshot(ctx, Visitor{Webhook: fn})
+}
+
+func (ds *DataStorage) DeleteWebhook(userID, id uuid.UUID) error {
+	ds.Lock()
+	defer ds.Unlock()
+	hooks := ds.webhooks[userID]
+	for i, hook := range hooks {
+		if hook.ID == id {
+			ds.webhooks[userID] = append(hooks[:i:i], hooks[i+1:]...)
+			if len(ds.webhooks[userID]) == 0 {
+				delete(ds.webhooks, userID)
+			}
+			return nil
+		}
+	}
+	return ErrNotFound
+}
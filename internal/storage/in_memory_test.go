@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConcurrentRedeem(t *testing.T, s URLStorage) {
+	userID := uuid.New()
+	require.NoError(t, s.Set(userID, "once", "https://a.ru"))
+	require.NoError(t, s.SetOptions(userID, "once", LinkOptions{MaxClicks: 10}))
+
+	var redeemed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Redeem("once")
+			if err == nil {
+				redeemed.Add(1)
+				return
+			}
+			assert.ErrorIs(t, err, ErrExhausted)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(10), redeemed.Load())
+
+	link, ok := s.GetLink("once")
+	require.True(t, ok)
+	assert.Equal(t, 0, link.RemainingClicks)
+}
+
+func TestDataStorageConcurrentRedeem(t *testing.T) {
+	testConcurrentRedeem(t, NewDataStorage())
+}
+
+func TestFileStorageConcurrentRedeem(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.log")
+	testConcurrentRedeem(t, reopenFileStorage(t, path))
+
+	_, err := reopenFileStorage(t, path).Redeem("once")
+	assert.ErrorIs(t, err, ErrExhausted)
+}
+
+func TestSetOptionsResetsRemainingClicks(t *testing.T) {
+	s := NewDataStorage()
+	userID := uuid.New()
+	require.NoError(t, s.Set(userID, "abc", "https://a.ru"))
+	require.NoError(t, s.SetOptions(userID, "abc", LinkOptions{MaxClicks: 2}))
+	_, err := s.Redeem("abc")
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetOptions(userID, "abc", LinkOptions{MaxClicks: 2, Title: "A"}))
+	link, _ := s.GetLink("abc")
+	assert.Equal(t, 1, link.RemainingClicks)
+
+	require.NoError(t, s.SetOptions(userID, "abc", LinkOptions{MaxClicks: 5}))
+	link, _ = s.GetLink("abc")
+	assert.Equal(t, 5, link.RemainingClicks)
+}
+
+func TestDataStorageEachLink(t *testing.T) {
+	s := NewDataStorage()
+	require.NoError(t, s.Set(uuid.New(), "a", "https://a.ru"))
+	require.NoError(t, s.Set(uuid.Nil, "b", "https://b.ru"))
+	require.NoError(t, s.Set(uuid.New(), "c", "https://c.ru"))
+
+	seen := map[string]string{}
+	err := s.EachLink(context.Background(), func(link Link) error {
+		seen[link.Short] = link.Long
+		// The storage stays usable while iterating.
+		return s.Delete(link.UserID, []string{"c"})
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "https://b.ru", seen["b"])
+	assert.LessOrEqual(t, len(seen), 3)
+
+	stop := errors.New("stop")
+	calls := 0
+	err = s.EachLink(context.Background(), func(Link) error {
+		calls++
+		return stop
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 1, calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, s.EachLink(ctx, func(Link) error { return nil }), context.Canceled)
+}
+
+func TestSnapshotDoesNotBlockWriters(t *testing.T) {
+	s := NewDataStorage()
+	userID := uuid.New()
+	require.NoError(t, s.Set(userID, "a", "https://a.ru"))
+	require.NoError(t, s.Set(userID, "b", "https://b.ru"))
+
+	var seen []string
+	err := s.Snapshot(context.Background(), Visitor{Link: func(link Link) error {
+		seen = append(seen, link.Short)
+		return s.Set(userID, "during-"+link.Short, link.Long)
+	}})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, seen)
+	n, err := s.CountURLs()
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+}
+
+func TestSnapshotIsConsistent(t *testing.T) {
+	s := NewDataStorage()
+	userID := uuid.New()
+	require.NoError(t, s.Set(userID, "a", "https://a.ru"))
+
+	var accounts, workspaces int
+	err := s.Snapshot(context.Background(), Visitor{
+		Link: func(Link) error {
+			require.NoError(t, s.CreateAccount(Account{Username: "alice", UserID: userID}))
+			return s.CreateWorkspace(Workspace{ID: uuid.New(), Name: "team"}, userID)
+		},
+		Account: func(Account) error {
+			accounts++
+			return nil
+		},
+		Workspace: func(Workspace, []Member) error {
+			workspaces++
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	assert.Zero(t, accounts)
+	assert.Zero(t, workspaces)
+}
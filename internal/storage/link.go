@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned when a link does not exist or does not belong to
+// the user performing the operation.
+var ErrNotFound = errors.New("link not found")
+
+// ErrExhausted is returned by Redeem when a link has no clicks left.
+var ErrExhausted = errors.New("link has no clicks left")
+
+// ErrExists is returned by AddLink when the short URL is already taken.
+var ErrExists = errors.New("short URL is taken")
+
+// Link is a shortened URL together with its per-link settings.
+type Link struct {
+	UserID    uuid.UUID `json:"userID,omitempty"`
+	Short     string    `json:"short"`
+	Long      string    `json:"long"`
+	CreatedAt time.Time `json:"created_at"`
+	// RemainingClicks is the number of visits left for links with MaxClicks.
+	RemainingClicks int `json:"remaining_clicks,omitempty"`
+	// Tags are free-form labels of the link.
+	Tags []string `json:"tags,omitempty"`
+	// ExpiresAt is when the link stops redirecting. Zero means never.
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// Rules send visitors matching them to other destinations. The first
+	// matching rule wins, Long is the fallback.
+	Rules []Rule `json:"rules,omitempty"`
+	// Variants split visitors between several destinations. Long is used
+	// when there are none or a rule matched.
+	Variants []Variant `json:"variants,omitempty"`
+	// StickyVariants sends a returning visitor to the variant served on
+	// their first visit.
+	StickyVariants bool `json:"sticky_variants,omitempty"`
+	LinkOptions
+}
+
+// Expired reports whether the link has expired at now.
+func (l Link) Expired(now time.Time) bool {
+	return !l.ExpiresAt.IsZero() && !now.Before(l.ExpiresAt)
+}
+
+// Variant is one of the destinations of a link. Visitors are distributed
+// between the variants in proportion to their weights.
+type Variant struct {
+	Name        string `json:"name"`
+	Destination string `json:"destination"`
+	Weight      int    `json:"weight"`
+}
+
+// Click is a visit of a link.
+type Click struct {
+	Short string
+	// Variant is the name of the served variant, empty when the visitor
+	// was not sent to a variant.
+	Variant string
+	At      time.Time
+}
+
+// ClickStats summarizes the visits of a link.
+type ClickStats struct {
+	Total int `json:"total"`
+	// Variants counts the visits per variant name.
+	Variants map[string]int `json:"variants,omitempty"`
+}
+
+// Rule targets visitors by device, language and country. A rule matches
+// when each of its non-empty conditions matches, and a condition matches
+// when the visitor has any of the listed values.
+type Rule struct {
+	// Devices are "mobile", "tablet" or "desktop".
+	Devices []string `json:"devices,omitempty"`
+	// OS are "ios", "android", "windows", "macos" or "linux".
+	OS []string `json:"os,omitempty"`
+	// Languages are primary language subtags such as "de", compared with
+	// the preferred language of the visitor.
+	Languages []string `json:"languages,omitempty"`
+	// Countries are ISO 3166-1 alpha-2 codes, "EU" matches every member
+	// state of the European Union.
+	Countries   []string `json:"countries,omitempty"`
+	Destination string   `json:"destination"`
+}
+
+// LinkOptions are the settings of a link that its owner may change.
+type LinkOptions struct {
+	Title string `json:"title,omitempty"`
+	// Interstitial makes the redirect show a preview page instead of
+	// sending the visitor straight to the destination.
+	Interstitial bool `json:"interstitial,omitempty"`
+	// RedirectType is the HTTP status used for the redirect: 301, 302, 307
+	// or 308. Zero uses the server default.
+	RedirectType int `json:"redirect_type,omitempty"`
+	// QueryPassthrough merges the query of the visit into the destination
+	// using one of the QueryPassthrough policies. Empty disables merging.
+	QueryPassthrough string `json:"query_passthrough,omitempty"`
+	// PathPassthrough appends path segments following the short identifier
+	// to the destination path.
+	PathPassthrough bool `json:"path_passthrough,omitempty"`
+	// UTM holds the campaign parameters the link was created with. They are
+	// already part of the destination and kept separately for filtering.
+	UTM UTM `json:"utm,omitzero"`
+	// PasswordHash is the bcrypt hash of the password visitors have to
+	// enter. Empty means the link is not protected.
+	PasswordHash string `json:"password_hash,omitempty"`
+	// MaxClicks limits the number of visits. Zero means unlimited. Changing
+	// it resets the remaining clicks.
+	MaxClicks int `json:"max_clicks,omitempty"`
+}
+
+// UTM are the Google Analytics campaign parameters.
+type UTM struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+// LinkFilter narrows the links returned by GetUserLinks. Empty fields match
+// every link.
+type LinkFilter struct {
+	Campaign string
+}
+
+func (f LinkFilter) match(link *Link) bool {
+	return f.Campaign == "" || f.Campaign == link.UTM.Campaign
+}
+
+// Policies for parameters present both in the visit and the destination.
+const (
+	// QueryPassthroughKeep keeps the value of the destination.
+	QueryPassthroughKeep = "keep"
+	// QueryPassthroughOverride replaces it with the value of the visit.
+	QueryPassthroughOverride = "override"
+	// QueryPassthroughAppend keeps both values.
+	QueryPassthroughAppend = "append"
+)
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Antony8720/url-shortener/internal/app/violationerror"
+)
+
+// Conflict is a link, an account, a workspace or a webhook of the source
+// that can not be stored in the target.
+type Conflict struct {
+	Short     string `json:"short_url,omitempty"`
+	Long      string `json:"original_url,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+	Webhook   string `json:"webhook,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// MigrationReport is the outcome of Migrate.
+type MigrationReport struct {
+	// Migrated counts the links copied, or that would be copied in a dry
+	// run.
+	Migrated int `json:"migrated"`
+	// Skipped counts the links already present in the target, for example
+	// from an interrupted earlier run.
+	Skipped int `json:"skipped"`
+	// Accounts counts the accounts copied, or that would be copied in a
+	// dry run. Accounts already present in the target are not counted.
+	Accounts int `json:"accounts"`
+	// Workspaces counts the workspaces copied with their members, or that
+	// would be copied in a dry run. Workspaces already present in the
+	// target are not counted.
+	Workspaces int `json:"workspaces"`
+	// Webhooks counts the webhooks copied with their secrets, or that
+	// would be copied in a dry run. Webhooks already present in the target
+	// are not counted.
+	Webhooks  int        `json:"webhooks"`
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+}
+
+// UniqueLongURLs reports whether s rejects a second link to the same long
+// URL, as DatabaseStorage does.
+func UniqueLongURLs(s URLStorage) bool {
+	_, ok := s.(*DatabaseStorage)
+	return ok
+}
+
+// Migrate copies every link of from to to, with its owner and settings,
+// and then every account, every workspace with its members and every
+// webhook with its secret. Links are streamed one at a time. Links already
+// present in the target are skipped, so an interrupted migration can simply
+// be run again. With dryRun nothing is written and the report lists the
+// conflicts a real run would meet.
+func Migrate(ctx context.Context, from, to URLStorage, dryRun bool) (MigrationReport, error) {
+	return migrate(ctx, from, to, dryRun, UniqueLongURLs(to))
+}
+
+func migrate(ctx context.Context, from, to URLStorage, dryRun, uniqueLong bool) (MigrationReport, error) {
+	// longs maps the long URLs of the target, and of the links migrated so
+	// far, to their short URLs. Only needed to predict conflicts.
+	var longs map[string]string
+	if dryRun && uniqueLong {
+		longs = map[string]string{}
+		err := to.EachLink(ctx, func(link Link) error {
+			longs[link.Long] = link.Short
+			return nil
+		})
+		if err != nil {
+			return MigrationReport{}, err
+		}
+	}
+
+	var report MigrationReport
+	conflict := func(link Link, format string, args ...any) {
+		report.Conflicts = append(report.Conflicts, Conflict{Short: link.Short, Long: link.Long, Reason: fmt.Sprintf(format, args...)})
+	}
+	err := from.EachLink(ctx, func(link Link) error {
+		if existing, ok := to.GetLink(link.Short); ok {
+			if existing.Long == link.Long && existing.UserID == link.UserID {
+				report.Skipped++
+			} else {
+				conflict(link, "short URL is taken by %s", existing.Long)
+			}
+			return nil
+		}
+
+		if dryRun {
+			if longs != nil {
+				if short, ok := longs[link.Long]; ok {
+					conflict(link, "long URL is already shortened as %s", short)
+					return nil
+				}
+				longs[link.Long] = link.Short
+			}
+			report.Migrated++
+			return nil
+		}
+
+		err := to.AddLink(link)
+		var uve *violationerror.UniqueViolationError
+		switch {
+		case errors.As(err, &uve):
+			conflict(link, "long URL is already shortened as %s", uve.Short)
+		case errors.Is(err, ErrExists):
+			conflict(link, "short URL is taken")
+		case err != nil:
+			return fmt.Errorf("migrating %s: %w", link.Short, err)
+		default:
+			report.Migrated++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = from.EachAccount(ctx, func(account Account) error {
+		accountConflict := func(reason string) {
+			report.Conflicts = append(report.Conflicts, Conflict{Username: account.Username, Reason: reason})
+		}
+		if existing, ok := to.GetAccount(account.Username); ok {
+			if existing.UserID != account.UserID {
+				accountConflict("username is taken")
+			}
+			return nil
+		}
+		if dryRun {
+			report.Accounts++
+			return nil
+		}
+		err := to.CreateAccount(account)
+		switch {
+		case errors.Is(err, ErrUsernameTaken):
+			accountConflict("username is taken")
+		case errors.Is(err, ErrHasAccount):
+			accountConflict("user already has another account")
+		case err != nil:
+			return fmt.Errorf("migrating account %s: %w", account.Username, err)
+		default:
+			report.Accounts++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = from.EachWorkspace(ctx, func(ws Workspace, members []Member) error {
+		if _, err := to.GetMembers(ws.ID); err == nil {
+			return nil
+		}
+		if dryRun {
+			report.Workspaces++
+			return nil
+		}
+		err := AddWorkspace(to, ws, members)
+		switch {
+		case errors.Is(err, ErrExists):
+			report.Conflicts = append(report.Conflicts, Conflict{Workspace: ws.ID.String(), Reason: "workspace ID is taken"})
+		case err != nil:
+			return fmt.Errorf("migrating workspace %s: %w", ws.ID, err)
+		default:
+			report.Workspaces++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = from.EachWebhook(ctx, func(hook Webhook) error {
+		existing, err := to.GetWebhooks(hook.UserID)
+		if err != nil {
+			return err
+		}
+		for _, e := range existing {
+			if e.ID == hook.ID {
+				return nil
+			}
+		}
+		if dryRun {
+			report.Webhooks++
+			return nil
+		}
+		err = to.AddWebhook(hook)
+		switch {
+		case errors.Is(err, ErrExists):
+			report.Conflicts = append(report.Conflicts, Conflict{Webhook: hook.ID.String(), Reason: "webhook ID is taken"})
+		case err != nil:
+			return fmt.Errorf("migrating webhook %s: %w", hook.ID, err)
+		default:
+			report.Webhooks++
+		}
+		return nil
+	})
+	return report, err
+}
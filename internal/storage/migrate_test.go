@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	userID := uuid.New()
+	source := NewDataStorage()
+	now := time.Now()
+	for i, link := range []Link{
+		{UserID: userID, Short: "a", Long: "https://a.ru", Tags: []string{"x"}},
+		{UserID: uuid.Nil, Short: "anon", Long: "https://anon.ru"},
+		{UserID: userID, Short: "dup", Long: "https://a.ru"},
+	} {
+		link.CreatedAt = now.Add(time.Duration(i) * time.Second)
+		require.NoError(t, source.AddLink(link))
+	}
+	require.NoError(t, source.SetOptions(userID, "a", LinkOptions{Title: "A"}))
+	require.NoError(t, source.CreateAccount(Account{Username: "alice", PasswordHash: "hash", UserID: userID, CreatedAt: now}))
+	require.NoError(t, source.CreateAccount(Account{Username: "bob", PasswordHash: "hash", UserID: uuid.New(), CreatedAt: now}))
+	ws := Workspace{ID: uuid.New(), Name: "Marketing", CreatedAt: now}
+	editorID := uuid.New()
+	require.NoError(t, source.CreateWorkspace(ws, userID))
+	require.NoError(t, source.SetMember(ws.ID, Member{UserID: editorID, Role: RoleEditor}))
+	hook := Webhook{ID: uuid.New(), UserID: userID, URL: "https://hooks.example/a", Secret: "whsec", Events: []string{"link.created"}, CreatedAt: now.UTC()}
+	require.NoError(t, source.AddWebhook(hook))
+
+	target := reopenFileStorage(t, filepath.Join(t.TempDir(), "urls.log"))
+	require.NoError(t, target.Set(uuid.New(), "anon", "https://other.ru"))
+	require.NoError(t, target.CreateAccount(Account{Username: "bob", PasswordHash: "other", UserID: uuid.New(), CreatedAt: now}))
+
+	report, err := migrate(context.Background(), source, target, true, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Migrated)
+	assert.Equal(t, 1, report.Accounts)
+	assert.Equal(t, 1, report.Workspaces)
+	assert.Equal(t, 1, report.Webhooks)
+	require.Len(t, report.Conflicts, 3)
+	assert.Contains(t, report.Conflicts, Conflict{Username: "bob", Reason: "username is taken"})
+	assert.Contains(t, report.Conflicts, Conflict{Short: "anon", Long: "https://anon.ru", Reason: "short URL is taken by https://other.ru"})
+	_, ok := target.GetLink("a")
+	assert.False(t, ok, "dry run must not write")
+
+	report, err = Migrate(context.Background(), source, target, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Migrated)
+	assert.Equal(t, 1, report.Accounts)
+	assert.Len(t, report.Conflicts, 2)
+	account, ok := target.GetAccount("alice")
+	require.True(t, ok)
+	assert.Equal(t, userID, account.UserID)
+	memberships, err := target.GetWorkspaces(editorID)
+	require.NoError(t, err)
+	require.Len(t, memberships, 1)
+	assert.Equal(t, "Marketing", memberships[0].Name)
+	assert.Equal(t, RoleEditor, memberships[0].Role)
+	hooks, err := target.GetWebhooks(userID)
+	require.NoError(t, err)
+	assert.Equal(t, []Webhook{hook}, hooks)
+
+	link, ok := target.GetLink("a")
+	require.True(t, ok)
+	assert.Equal(t, userID, link.UserID)
+	assert.Equal(t, "A", link.Title)
+	assert.Equal(t, []string{"x"}, link.Tags)
+
+	report, err = Migrate(context.Background(), source, target, false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Migrated)
+	assert.Equal(t, 0, report.Accounts)
+	assert.Equal(t, 0, report.Workspaces)
+	assert.Equal(t, 0, report.Webhooks)
+	assert.Equal(t, 2, report.Skipped)
+}
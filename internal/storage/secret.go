@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// SecretStore is implemented by storages that outlive the process and can
+// keep server secrets, such as the key that signs user cookies, next to the
+// data they protect.
+type SecretStore interface {
+	// Secret returns the secret stored under name, storing the result of
+	// generate first if there is none.
+	Secret(ctx context.Context, name string, generate func() string) (string, error)
+}
+
+// Secret keeps the secret in a file readable by the owner only, next to the
+// storage file, named after the storage file and name.
+func (f *FileStorage) Secret(_ context.Context, name string, generate func() string) (string, error) {
+	path := f.file.Name() + "." + name
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		// created by another process in the meantime
+		b, err := os.ReadFile(path)
+		return strings.TrimSpace(string(b)), err
+	}
+	if err != nil {
+		return "", err
+	}
+	secret := generate()
+	if _, err := file.WriteString(secret + "\n"); err != nil {
+		file.Close()
+		os.Remove(path)
+		return "", err
+	}
+	return secret, file.Close()
+}
+
+// Secret keeps the secret in the server_secret table. Concurrent servers
+// agree on the secret stored first.
+func (dbs *DatabaseStorage) Secret(ctx context.Context, name string, generate func() string) (string, error) {
+	_, err := dbs.db.Exec(ctx, `INSERT INTO server_secret (name, value) VALUES ($1, $2)
+			 ON CONFLICT (name) DO NOTHING`, name, generate())
+	if err != nil {
+		return "", err
+	}
+	var secret string
+	err = dbs.db.QueryRow(ctx, `SELECT value FROM server_secret WHERE name = $1`, name).Scan(&secret)
+	return secret, err
+}
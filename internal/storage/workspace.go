@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Role is the role of a member of a workspace.
+type Role string
+
+// Roles from the least to the most privileged.
+const (
+	RoleViewer Role = "viewer"
+	RoleEditor Role = "editor"
+	RoleOwner  Role = "owner"
+)
+
+var roleRanks = map[Role]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+// Valid reports whether r is one of the known roles.
+func (r Role) Valid() bool {
+	return roleRanks[r] > 0
+}
+
+// Allows reports whether r grants everything min does.
+func (r Role) Allows(min Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[min]
+}
+
+// Workspace is a group of users sharing links. The links of a workspace are
+// owned by its ID, the same way links of a user are owned by the user ID.
+type Workspace struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Member is a user of a workspace with its role.
+type Member struct {
+	UserID uuid.UUID `json:"user_id"`
+	Role   Role      `json:"role"`
+}
+
+// Membership is a workspace of a user with the role of the user.
+type Membership struct {
+	Workspace
+	Role Role `json:"role"`
+}
+
+// AddWorkspace stores a workspace of another storage with its members, for
+// example when restoring a backup. The workspace is created by one of its
+// owners, the other members are added after.
+func AddWorkspace(s URLStorage, ws Workspace, members []Member) error {
+	owner := -1
+	for i, m := range members {
+		if m.Role == RoleOwner {
+			owner = i
+			break
+		}
+	}
+	if owner < 0 {
+		return fmt.Errorf("workspace %s has no owner", ws.ID)
+	}
+	if err := s.CreateWorkspace(ws, members[owner].UserID); err != nil {
+		return err
+	}
+	for i, m := range members {
+		if i == owner {
+			continue
+		}
+		if err := s.SetMember(ws.ID, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,12 +2,46 @@ package user
 
 import (
 	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"github.com/google/uuid"
 )
 
 const key = "aqHC5SN1UQ!mWRrMyJF86lbgo.3Yjein"
 
+// signingKey authenticates encrypted users, so that a token cannot be made
+// up from a known user ID. It is random unless set with SetSecret.
+var signingKey = []byte(NewSecret())
+
+// NewSecret returns a random secret for SetSecret.
+func NewSecret() string {
+	k := make([]byte, 32)
+	rand.Read(k)
+	return hex.EncodeToString(k)
+}
+
+// SetSecret makes tokens be signed with secret, so that they stay valid
+// across restarts and replicas. An empty secret keeps the current key. It
+// must be called before tokens are issued.
+func SetSecret(secret string) {
+	if secret != "" {
+		signingKey = []byte(secret)
+	}
+}
+
+func sign(b []byte) []byte {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+// ErrInvalid is returned when decrypting something that is not an
+// encrypted user.
+var ErrInvalid = errors.New("invalid user")
+
 type User struct {
 	UserID uuid.UUID
 }
@@ -16,6 +50,7 @@ func New() User {
 	return User{UserID: uuid.New()}
 }
 
+// UserEncrypt returns the encrypted user ID followed by its signature.
 func (u *User) UserEncrypt() ([]byte, error) {
 	aesBlock, err := aes.NewCipher([]byte(key))
 	if err != nil {
@@ -29,18 +64,30 @@ func (u *User) UserEncrypt() ([]byte, error) {
 
 	encryptedUser := make([]byte, aes.BlockSize)
 	aesBlock.Encrypt(encryptedUser, byteUser)
-	return encryptedUser, nil
+	return append(encryptedUser, sign(encryptedUser)...), nil
 }
 
 func (u *User) UserEncryptEncodeToString() (string, error) {
 	eb, err := u.UserEncrypt()
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 	return hex.EncodeToString(eb), nil
 }
 
+// UserDecrypt restores the user from a token made by UserEncrypt. Tokens
+// that are not signed with the current key are rejected with ErrInvalid.
 func (u *User) UserDecrypt(b []byte) error {
+	if len(b) != aes.BlockSize+sha256.Size {
+		return ErrInvalid
+	}
+	if !hmac.Equal(b[aes.BlockSize:], sign(b[:aes.BlockSize])) {
+		return ErrInvalid
+	}
+	return u.decrypt(b[:aes.BlockSize])
+}
+
+func (u *User) decrypt(b []byte) error {
 	aesBlock, err := aes.NewCipher([]byte(key))
 	if err != nil {
 		return err
@@ -64,3 +111,17 @@ func (u *User) UserDecryptDecodeFromString(s string) error {
 	}
 	return u.UserDecrypt(b)
 }
+
+// LegacyDecodeFromString restores the user from a token in the unsigned
+// format issued before tokens were signed. It only serves to exchange such
+// tokens for signed ones and is to be removed in the next release.
+func (u *User) LegacyDecodeFromString(s string) error {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != aes.BlockSize {
+		return ErrInvalid
+	}
+	return u.decrypt(b)
+}
@@ -0,0 +1,472 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned when retrying a delivery that is not a dead
+// letter.
+var ErrNotFound = errors.New("delivery not found")
+
+// ErrQueueFull is returned when retrying a delivery to a webhook that has
+// MaxPending deliveries outstanding.
+var ErrQueueFull = errors.New("too many pending deliveries")
+
+const (
+	// historySize is the number of deliveries kept per webhook.
+	historySize = 100
+	// deadLetterSize is the number of dead letters kept per user.
+	deadLetterSize = 100
+	// notifyQueueSize is the number of events waiting for their webhooks
+	// to be looked up. Events beyond it are dropped.
+	notifyQueueSize = 1024
+)
+
+// Store gives the webhooks of a user.
+type Store interface {
+	GetWebhooks(uuid.UUID) ([]storage.Webhook, error)
+}
+
+// Options tune a Dispatcher. Zero fields take the defaults.
+type Options struct {
+	// MaxAttempts is the number of attempts before a delivery is dead.
+	MaxAttempts int
+	// BaseDelay is the wait after the first failed attempt, it doubles
+	// after every further failure up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Timeout bounds a single attempt.
+	Timeout time.Duration
+	// Workers is the number of deliveries posted at the same time.
+	Workers int
+	// MaxPending bounds the deliveries of a webhook waiting for an attempt
+	// or a retry. Further deliveries go straight to the dead letters.
+	MaxPending int
+	// AllowPrivate lets webhooks post to loopback and private addresses,
+	// for tests and receivers on the same network.
+	AllowPrivate bool
+	// Client posts the deliveries. The default client refuses addresses
+	// that are not public unless AllowPrivate is set.
+	Client *http.Client
+}
+
+func (o *Options) defaults() {
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 8
+	}
+	if o.BaseDelay <= 0 {
+		o.BaseDelay = 10 * time.Second
+	}
+	if o.MaxDelay <= 0 {
+		o.MaxDelay = time.Hour
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 10 * time.Second
+	}
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+	if o.MaxPending <= 0 {
+		o.MaxPending = 1000
+	}
+	if o.Client == nil {
+		dialer := &net.Dialer{Timeout: o.Timeout}
+		if !o.AllowPrivate {
+			dialer.Control = dialControl
+		}
+		o.Client = &http.Client{
+			// No proxy, so that the address checked when dialing is the
+			// address of the receiver.
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: o.Timeout,
+				IdleConnTimeout:     90 * time.Second,
+				MaxIdleConns:        100,
+			},
+			// A redirect is a failed delivery, receivers are expected to
+			// answer at the URL they subscribed.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+}
+
+// Dispatcher queues and posts deliveries.
+type Dispatcher struct {
+	store Store
+	opts  Options
+
+	mu      sync.Mutex
+	pending []*Delivery
+	// queued counts the pending and in-flight deliveries per webhook.
+	queued  map[uuid.UUID]int
+	history map[uuid.UUID][]*Delivery
+	dead    map[uuid.UUID][]*Delivery
+
+	notifications chan notification
+	wake          chan struct{}
+	stop          chan struct{}
+	stopOnce      sync.Once
+	inflight      sync.WaitGroup
+	scheduler     sync.WaitGroup
+}
+
+// NewDispatcher starts a dispatcher posting to the webhooks in store.
+func NewDispatcher(store Store, opts Options) *Dispatcher {
+	opts.defaults()
+	d := &Dispatcher{
+		store:         store,
+		opts:          opts,
+		queued:        make(map[uuid.UUID]int),
+		history:       make(map[uuid.UUID][]*Delivery),
+		dead:          make(map[uuid.UUID][]*Delivery),
+		notifications: make(chan notification, notifyQueueSize),
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+	d.scheduler.Add(2)
+	go d.run()
+	go d.expand()
+	return d
+}
+
+// Close stops the dispatcher and waits for the attempts in progress.
+// Pending deliveries and events not yet looked up are dropped.
+func (d *Dispatcher) Close() {
+	d.stopOnce.Do(func() { close(d.stop) })
+	d.scheduler.Wait()
+	d.inflight.Wait()
+}
+
+// notification is an event waiting for the webhooks of its link to be
+// looked up.
+type notification struct {
+	event   string
+	link    storage.Link
+	variant string
+	time    time.Time
+}
+
+// Notify queues a delivery of event for every webhook of the owner of link
+// subscribed to it. variant is the variant served on a click. The webhooks
+// are looked up in the background, so Notify does not wait for the store.
+func (d *Dispatcher) Notify(event string, link storage.Link, variant string) {
+	if link.UserID == uuid.Nil {
+		return
+	}
+	select {
+	case d.notifications <- notification{event: event, link: link, variant: variant, time: time.Now().UTC()}:
+	default:
+		log.Printf("webhook: dropping %s of %q, too many events queued", event, link.Short)
+	}
+}
+
+// expand turns notifications into deliveries until the dispatcher stops.
+func (d *Dispatcher) expand() {
+	defer d.scheduler.Done()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case n := <-d.notifications:
+			d.deliver(n.event, n.link, n.variant, n.time)
+		}
+	}
+}
+
+// deliver queues a delivery of event for every webhook of the owner of link
+// subscribed to it.
+func (d *Dispatcher) deliver(event string, link storage.Link, variant string, now time.Time) {
+	hooks, err := d.store.GetWebhooks(link.UserID)
+	if err != nil {
+		log.Printf("webhook: listing webhooks of %s: %v", link.UserID, err)
+		return
+	}
+	for _, hook := range hooks {
+		if !hook.Subscribed(event) {
+			continue
+		}
+		id := uuid.New()
+		payload, err := json.Marshal(Payload{ID: id, Event: event, Time: now, Link: linkData(link), Variant: variant})
+		if err != nil {
+			log.Printf("webhook: encoding %s of %q: %v", event, link.Short, err)
+			return
+		}
+		d.enqueue(&Delivery{
+			ID:          id,
+			WebhookID:   hook.ID,
+			UserID:      hook.UserID,
+			Event:       event,
+			Status:      StatusPending,
+			CreatedAt:   now,
+			NextAttempt: now,
+			url:         hook.URL,
+			secret:      hook.Secret,
+			payload:     payload,
+		})
+	}
+}
+
+// enqueue adds a new delivery to the queue and the history of its webhook.
+// Once the webhook has MaxPending deliveries outstanding, the delivery is
+// dead-lettered right away.
+func (d *Dispatcher) enqueue(delivery *Delivery) {
+	d.mu.Lock()
+	history := append(d.history[delivery.WebhookID], delivery)
+	if len(history) > historySize {
+		history = history[len(history)-historySize:]
+	}
+	d.history[delivery.WebhookID] = history
+	if d.queued[delivery.WebhookID] >= d.opts.MaxPending {
+		delivery.Status = StatusDead
+		delivery.NextAttempt = time.Time{}
+		delivery.Error = ErrQueueFull.Error()
+		d.deadLocked(delivery)
+		d.mu.Unlock()
+		return
+	}
+	d.queued[delivery.WebhookID]++
+	d.pending = append(d.pending, delivery)
+	d.mu.Unlock()
+	d.signal()
+}
+
+// deadLocked adds delivery to the dead letters of its user. d.mu must be
+// held.
+func (d *Dispatcher) deadLocked(delivery *Delivery) {
+	dead := append(d.dead[delivery.UserID], delivery)
+	if len(dead) > deadLetterSize {
+		dead = dead[len(dead)-deadLetterSize:]
+	}
+	d.dead[delivery.UserID] = dead
+}
+
+func (d *Dispatcher) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// History returns the latest deliveries to the webhook id, newest first.
+func (d *Dispatcher) History(id uuid.UUID) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return snapshot(d.history[id])
+}
+
+// DeadLetters returns the deliveries to the webhooks of userID that failed
+// all their attempts, newest first.
+func (d *Dispatcher) DeadLetters(userID uuid.UUID) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return snapshot(d.dead[userID])
+}
+
+func snapshot(deliveries []*Delivery) []Delivery {
+	result := make([]Delivery, 0, len(deliveries))
+	for i := len(deliveries) - 1; i >= 0; i-- {
+		result = append(result, *deliveries[i])
+	}
+	return result
+}
+
+// Retry takes the dead letter id of userID off the dead-letter list and
+// queues it again with a fresh set of attempts. It fails with ErrQueueFull
+// while the webhook has MaxPending deliveries outstanding.
+func (d *Dispatcher) Retry(userID, id uuid.UUID) error {
+	d.mu.Lock()
+	dead := d.dead[userID]
+	var delivery *Delivery
+	for i, dl := range dead {
+		if dl.ID == id {
+			if d.queued[dl.WebhookID] >= d.opts.MaxPending {
+				d.mu.Unlock()
+				return ErrQueueFull
+			}
+			delivery = dl
+			d.dead[userID] = append(dead[:i:i], dead[i+1:]...)
+			break
+		}
+	}
+	if delivery == nil {
+		d.mu.Unlock()
+		return ErrNotFound
+	}
+	d.queued[delivery.WebhookID]++
+	delivery.Status = StatusPending
+	delivery.Attempts = 0
+	delivery.NextAttempt = time.Now().UTC()
+	d.pending = append(d.pending, delivery)
+	d.mu.Unlock()
+	d.signal()
+	return nil
+}
+
+// Forget drops the pending deliveries, the history and the dead letters of
+// the webhook id of userID, for when it is deleted.
+func (d *Dispatcher) Forget(userID, id uuid.UUID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	keep := func(deliveries []*Delivery) []*Delivery {
+		result := deliveries[:0]
+		for _, dl := range deliveries {
+			if dl.WebhookID != id {
+				result = append(result, dl)
+			}
+		}
+		return result
+	}
+	d.pending = keep(d.pending)
+	delete(d.queued, id)
+	d.dead[userID] = keep(d.dead[userID])
+	if len(d.dead[userID]) == 0 {
+		delete(d.dead, userID)
+	}
+	for _, dl := range d.history[id] {
+		dl.forgotten = true
+	}
+	delete(d.history, id)
+}
+
+func (d *Dispatcher) run() {
+	defer d.scheduler.Done()
+	workers := make(chan struct{}, d.opts.Workers)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		due, wait := d.takeDue(time.Now())
+		for _, delivery := range due {
+			select {
+			case workers <- struct{}{}:
+			case <-d.stop:
+				return
+			}
+			d.inflight.Add(1)
+			go func() {
+				defer d.inflight.Done()
+				d.attempt(delivery)
+				<-workers
+			}()
+		}
+		timer.Reset(wait)
+		select {
+		case <-d.stop:
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// takeDue removes the deliveries due at now from the queue and returns them
+// with the time until the next one is due.
+func (d *Dispatcher) takeDue(now time.Time) ([]*Delivery, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	wait := time.Hour
+	var due []*Delivery
+	pending := d.pending[:0]
+	for _, delivery := range d.pending {
+		if until := delivery.NextAttempt.Sub(now); until > 0 {
+			wait = min(wait, until)
+			pending = append(pending, delivery)
+			continue
+		}
+		due = append(due, delivery)
+	}
+	clear(d.pending[len(pending):])
+	d.pending = pending
+	return due, wait
+}
+
+func (d *Dispatcher) attempt(delivery *Delivery) {
+	status, err := d.post(delivery)
+	now := time.Now().UTC()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delivery.Attempts++
+	delivery.ResponseStatus = status
+	delivery.NextAttempt = time.Time{}
+	done := func() {
+		if !delivery.forgotten {
+			d.queued[delivery.WebhookID]--
+			if d.queued[delivery.WebhookID] <= 0 {
+				delete(d.queued, delivery.WebhookID)
+			}
+		}
+	}
+	if err == nil {
+		delivery.Status = StatusDelivered
+		delivery.Error = ""
+		delivery.DeliveredAt = now
+		done()
+		return
+	}
+	delivery.Error = err.Error()
+	if delivery.forgotten {
+		return
+	}
+	if delivery.Attempts >= d.opts.MaxAttempts {
+		delivery.Status = StatusDead
+		d.deadLocked(delivery)
+		done()
+		return
+	}
+	delivery.NextAttempt = now.Add(d.backoff(delivery.Attempts))
+	d.pending = append(d.pending, delivery)
+	d.signal()
+}
+
+// backoff returns the wait after the given number of failed attempts.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.opts.BaseDelay
+	for i := 1; i < attempts && delay < d.opts.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, d.opts.MaxDelay)
+}
+
+// post sends the delivery once and returns the HTTP status of the
+// response. Statuses other than 2xx are errors.
+func (d *Dispatcher) post(delivery *Delivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "url-shortener-webhook")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, delivery.ID.String())
+	req.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(SignatureHeader, Sign(delivery.secret, now, delivery.payload))
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
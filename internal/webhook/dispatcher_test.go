@@ -0,0 +1,199 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type hookStore []storage.Webhook
+
+func (s hookStore) GetWebhooks(userID uuid.UUID) ([]storage.Webhook, error) {
+	var result []storage.Webhook
+	for _, hook := range s {
+		if hook.UserID == userID {
+			result = append(result, hook)
+		}
+	}
+	return result, nil
+}
+
+func TestDispatcherSignsAndRetries(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan Payload, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !Verify("secret", r.Header.Get(TimestampHeader), body, r.Header.Get(SignatureHeader)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		if calls.Add(1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		var p Payload
+		json.Unmarshal(body, &p)
+		received <- p
+	}))
+	defer receiver.Close()
+
+	owner := uuid.New()
+	hook := storage.Webhook{ID: uuid.New(), UserID: owner, URL: receiver.URL, Secret: "secret", Events: []string{EventClicked}}
+	d := NewDispatcher(hookStore{hook}, Options{BaseDelay: 10 * time.Millisecond, AllowPrivate: true})
+	defer d.Close()
+
+	link := storage.Link{UserID: owner, Short: "abc", Long: "https://example.com"}
+	d.Notify(EventCreated, link, "")
+	d.Notify(EventClicked, link, "B")
+
+	select {
+	case p := <-received:
+		assert.Equal(t, EventClicked, p.Event)
+		assert.Equal(t, "abc", p.Link.Short)
+		assert.Equal(t, "B", p.Variant)
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery not received")
+	}
+	require.Eventually(t, func() bool {
+		history := d.History(hook.ID)
+		return len(history) == 1 && history[0].Status == StatusDelivered
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 3, d.History(hook.ID)[0].Attempts)
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	var healthy atomic.Bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	owner := uuid.New()
+	hook := storage.Webhook{ID: uuid.New(), UserID: owner, URL: receiver.URL, Secret: "secret", Events: Events}
+	d := NewDispatcher(hookStore{hook}, Options{MaxAttempts: 3, BaseDelay: time.Millisecond, AllowPrivate: true})
+	defer d.Close()
+
+	d.Notify(EventDeleted, storage.Link{UserID: owner, Short: "abc"}, "")
+	require.Eventually(t, func() bool { return len(d.DeadLetters(owner)) == 1 }, 5*time.Second, 5*time.Millisecond)
+	dead := d.DeadLetters(owner)[0]
+	assert.Equal(t, StatusDead, dead.Status)
+	assert.Equal(t, 3, dead.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, dead.ResponseStatus)
+	assert.Empty(t, d.DeadLetters(uuid.New()))
+
+	assert.ErrorIs(t, d.Retry(uuid.New(), dead.ID), ErrNotFound)
+	healthy.Store(true)
+	require.NoError(t, d.Retry(owner, dead.ID))
+	assert.Empty(t, d.DeadLetters(owner))
+	require.Eventually(t, func() bool { return d.History(hook.ID)[0].Status == StatusDelivered }, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestDispatcherRefusesPrivateAddresses(t *testing.T) {
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer receiver.Close()
+
+	owner := uuid.New()
+	hook := storage.Webhook{ID: uuid.New(), UserID: owner, URL: receiver.URL, Secret: "secret", Events: Events}
+	d := NewDispatcher(hookStore{hook}, Options{MaxAttempts: 1})
+	defer d.Close()
+
+	assert.ErrorIs(t, d.CheckDestination(context.Background(), receiver.URL), ErrForbiddenDestination)
+	d.Notify(EventCreated, storage.Link{UserID: owner, Short: "abc"}, "")
+	require.Eventually(t, func() bool { return len(d.DeadLetters(owner)) == 1 }, 5*time.Second, 5*time.Millisecond)
+	assert.Contains(t, d.DeadLetters(owner)[0].Error, ErrForbiddenDestination.Error())
+	assert.Zero(t, calls.Load())
+}
+
+func TestCheckDestination(t *testing.T) {
+	d := &Dispatcher{}
+	for _, target := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.1.2.3/hook",
+		"http://192.168.0.1/hook",
+		"http://100.64.0.1/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+		"http://0.0.0.0/hook",
+	} {
+		assert.ErrorIs(t, d.CheckDestination(context.Background(), target), ErrForbiddenDestination, target)
+	}
+	assert.NoError(t, d.CheckDestination(context.Background(), "https://93.184.216.34/hook"))
+	assert.NoError(t, (&Dispatcher{opts: Options{AllowPrivate: true}}).CheckDestination(context.Background(), "http://127.0.0.1/hook"))
+}
+
+func TestDispatcherCapsPendingDeliveries(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	owner := uuid.New()
+	hook := storage.Webhook{ID: uuid.New(), UserID: owner, URL: receiver.URL, Secret: "secret", Events: Events}
+	d := NewDispatcher(hookStore{hook}, Options{MaxPending: 2, BaseDelay: time.Hour, AllowPrivate: true})
+	defer d.Close()
+
+	for range 3 {
+		d.Notify(EventClicked, storage.Link{UserID: owner, Short: "abc"}, "")
+	}
+	require.Eventually(t, func() bool { return len(d.History(hook.ID)) == 3 }, 5*time.Second, 5*time.Millisecond)
+	dead := d.DeadLetters(owner)
+	require.Len(t, dead, 1)
+	assert.Equal(t, ErrQueueFull.Error(), dead[0].Error)
+	assert.Zero(t, dead[0].Attempts)
+	assert.ErrorIs(t, d.Retry(owner, dead[0].ID), ErrQueueFull)
+}
+
+// blockingStore holds GetWebhooks until release is closed.
+type blockingStore struct {
+	release chan struct{}
+}
+
+func (s blockingStore) GetWebhooks(uuid.UUID) ([]storage.Webhook, error) {
+	<-s.release
+	return nil, nil
+}
+
+func TestNotifyDoesNotWaitForStore(t *testing.T) {
+	store := blockingStore{release: make(chan struct{})}
+	d := NewDispatcher(store, Options{})
+	defer d.Close()
+	defer close(store.release)
+
+	done := make(chan struct{})
+	go func() {
+		for range 10 {
+			d.Notify(EventClicked, storage.Link{UserID: uuid.New(), Short: "abc"}, "")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Notify waited for the store")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{opts: Options{BaseDelay: time.Second, MaxDelay: 10 * time.Second}}
+	assert.Equal(t, time.Second, d.backoff(1))
+	assert.Equal(t, 2*time.Second, d.backoff(2))
+	assert.Equal(t, 8*time.Second, d.backoff(4))
+	assert.Equal(t, 10*time.Second, d.backoff(5))
+	assert.Equal(t, 10*time.Second, d.backoff(50))
+}
@@ -0,0 +1,127 @@
+// Package webhook posts events of links to the webhooks their owners
+// subscribed.
+//
+// Each event becomes a delivery per subscribed webhook. Deliveries are
+// queued in memory and posted by a Dispatcher, failed attempts are retried
+// with exponential backoff and deliveries that keep failing end up in a
+// dead-letter list, from which they can be retried by hand. Webhooks may
+// only post to public addresses, which is checked when they are created and
+// again for every connection. The queue, the delivery history and the dead
+// letters are lost on restart; the webhooks themselves are kept in the
+// storage of the links.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/Antony8720/url-shortener/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Events webhooks can subscribe to.
+const (
+	EventCreated = "link.created"
+	EventClicked = "link.clicked"
+	EventDeleted = "link.deleted"
+)
+
+// Events lists all events in the order they are documented.
+var Events = []string{EventCreated, EventClicked, EventDeleted}
+
+// ValidEvent reports whether event is one of Events.
+func ValidEvent(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers of a delivery. SignatureHeader is "sha256=" followed by the hex
+// HMAC-SHA256 of TimestampHeader, a dot and the body, keyed with the secret
+// of the webhook.
+const (
+	EventHeader     = "X-Shortener-Event"
+	DeliveryHeader  = "X-Shortener-Delivery"
+	TimestampHeader = "X-Shortener-Timestamp"
+	SignatureHeader = "X-Shortener-Signature"
+)
+
+// Sign returns the signature of body sent at t with secret.
+func Sign(secret string, t time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(t.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the signature of body sent at the
+// Unix time timestamp with secret.
+func Verify(secret, timestamp string, body []byte, signature string) bool {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, time.Unix(sec, 0), body)), []byte(signature))
+}
+
+// Payload is the JSON body of a delivery.
+type Payload struct {
+	ID    uuid.UUID `json:"id"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Link  LinkData  `json:"link"`
+	// Variant is the A/B variant served on a click, if any.
+	Variant string `json:"variant,omitempty"`
+}
+
+// LinkData describes the link of an event.
+type LinkData struct {
+	Short     string    `json:"short"`
+	Long      string    `json:"original_url"`
+	CreatedAt time.Time `json:"created_at"`
+	Tags      []string  `json:"tags,omitempty"`
+}
+
+func linkData(link storage.Link) LinkData {
+	return LinkData{Short: link.Short, Long: link.Long, CreatedAt: link.CreatedAt, Tags: link.Tags}
+}
+
+// Status is the state of a delivery.
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusDelivered Status = "delivered"
+	// StatusDead is a delivery that failed all its attempts.
+	StatusDead Status = "dead"
+)
+
+// Delivery is a payload posted, or to be posted, to a webhook.
+type Delivery struct {
+	ID        uuid.UUID `json:"id"`
+	WebhookID uuid.UUID `json:"webhook_id"`
+	UserID    uuid.UUID `json:"-"`
+	Event     string    `json:"event"`
+	Status    Status    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	// ResponseStatus is the HTTP status of the last attempt, zero when no
+	// response was received.
+	ResponseStatus int       `json:"response_status,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	NextAttempt    time.Time `json:"next_attempt,omitzero"`
+	DeliveredAt    time.Time `json:"delivered_at,omitzero"`
+
+	url     string
+	secret  string
+	payload []byte
+	// forgotten is set when the webhook is deleted during an attempt.
+	forgotten bool
+}